@@ -0,0 +1,168 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const debugHelp = `Commands:
+  break [file:]line    stop at a line (b)
+  break func           stop when a function is called
+  delete [file:]line   remove a breakpoint (d)
+  delete func          remove a function breakpoint
+  next                 run until the next statement, stepping over calls (n)
+  step                 run until the next statement, stepping into calls (s)
+  finish               run until the current function returns (f)
+  continue             run until the next breakpoint (c)
+  print name...        print variables (p)
+  backtrace            print the call stack (bt)
+  quit                 exit the shell (q)
+An empty line repeats the last command.
+`
+
+// debugREPL is the interactive front end for interp.Debugger used by -debug.
+type debugREPL struct {
+	in   *bufio.Scanner
+	out  io.Writer
+	d    *interp.Debugger
+	last string
+}
+
+// openDebugInput opens the file from which the debugger reads commands, which
+// is the terminal by default, so that the program being debugged can still
+// read its standard input.
+func openDebugInput(path string) (*os.File, error) {
+	if path == "" {
+		path = "/dev/tty"
+		if runtime.GOOS == "windows" {
+			path = "CONIN$"
+		}
+	}
+	return os.Open(path)
+}
+
+// newDebugger returns a debugger which stops at the first statement, and then
+// reads commands from in and writes to out.
+func newDebugger(in io.Reader, out io.Writer) *interp.Debugger {
+	repl := &debugREPL{in: bufio.NewScanner(in), out: out}
+	repl.d = interp.NewDebugger(interp.DebugStepIn, repl.stop)
+	return repl.d
+}
+
+func (repl *debugREPL) stop(ctx context.Context, dc *interp.DebugContext) (interp.DebugAction, error) {
+	frame := dc.Stack[0]
+	fmt.Fprintf(repl.out, "%s: %s\n", frameLocation(frame), stmtLine(dc.Stmt))
+	for {
+		fmt.Fprintf(repl.out, "(debug) ")
+		if !repl.in.Scan() {
+			// No more commands; run the rest of the program.
+			fmt.Fprintln(repl.out)
+			return interp.DebugContinue, nil
+		}
+		line := strings.TrimSpace(repl.in.Text())
+		if line == "" {
+			line = repl.last
+		}
+		repl.last = line
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+		switch cmd {
+		case "b", "break", "d", "delete":
+			if len(args) != 1 {
+				fmt.Fprintf(repl.out, "usage: %s [file:]line | %s func\n", cmd, cmd)
+				continue
+			}
+			add := cmd == "b" || cmd == "break"
+			if file, line, ok := parseLocation(args[0], frame.File); ok {
+				if add {
+					repl.d.AddBreakpoint(file, line)
+					fmt.Fprintf(repl.out, "breakpoint at %s\n", args[0])
+				} else {
+					repl.d.RemoveBreakpoint(file, line)
+				}
+			} else if add {
+				repl.d.AddFuncBreakpoint(args[0])
+				fmt.Fprintf(repl.out, "breakpoint at function %s\n", args[0])
+			} else {
+				repl.d.RemoveFuncBreakpoint(args[0])
+			}
+		case "n", "next":
+			return interp.DebugStepOver, nil
+		case "s", "step":
+			return interp.DebugStepIn, nil
+		case "f", "finish":
+			return interp.DebugStepOut, nil
+		case "c", "continue":
+			return interp.DebugContinue, nil
+		case "p", "print":
+			for _, name := range args {
+				vr := dc.Var(name)
+				if !vr.IsSet() {
+					fmt.Fprintf(repl.out, "%s is unset\n", name)
+					continue
+				}
+				fmt.Fprintf(repl.out, "%s=%s\n", name, vr.String())
+			}
+		case "bt", "backtrace":
+			for i, frame := range dc.Stack {
+				fmt.Fprintf(repl.out, "#%d %s at %s\n", i, frame.Func, frameLocation(frame))
+			}
+		case "q", "quit":
+			return 0, interp.NewExitStatus(1)
+		case "h", "help":
+			fmt.Fprint(repl.out, debugHelp)
+		default:
+			fmt.Fprintf(repl.out, "unknown command %q; try help\n", cmd)
+		}
+	}
+}
+
+// parseLocation parses a breakpoint location like "file.sh:12" or "12", which
+// is in the current file.
+func parseLocation(s, curFile string) (file string, line uint, ok bool) {
+	file = curFile
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		file, s = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseUint(s, 10, 0)
+	if err != nil || n == 0 {
+		return "", 0, false
+	}
+	return file, uint(n), true
+}
+
+func frameLocation(frame interp.Frame) string {
+	file := frame.File
+	if file == "" {
+		file = "-"
+	}
+	return fmt.Sprintf("%s:%d", file, frame.Pos.Line())
+}
+
+// stmtLine returns the first line of a statement as printed in its canonical
+// format.
+func stmtLine(st *syntax.Stmt) string {
+	var buf bytes.Buffer
+	syntax.NewPrinter().Print(&buf, st)
+	line := buf.String()
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
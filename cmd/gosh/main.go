@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strings"
 
 	"golang.org/x/term"
@@ -17,7 +18,15 @@ import (
 	"mvdan.cc/sh/v3/syntax"
 )
 
-var command = flag.String("c", "", "command to be executed")
+var (
+	command = flag.String("c", "", "command to be executed")
+	debug   = flag.Bool("debug", false, "run interactively under a debugger")
+
+	debugInput = flag.String("debug-input", "", "read debugger commands from a file instead of the terminal; implies -debug")
+
+	coverProfile = flag.String("coverprofile", "", "write a coverage profile to a file; in Cobertura XML if it ends in .xml, and LCOV otherwise")
+	cpuProfile   = flag.String("cpuprofile", "", "write a wall time profile to a file in the pprof format")
+)
 
 func main() {
 	flag.Parse()
@@ -31,8 +40,45 @@ func main() {
 	}
 }
 
-func runAll() error {
-	r, err := interp.New(interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+func runAll() (err error) {
+	// Let the interpreter handle signals like SIGINT, running any traps.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardSignals...)
+	opts := []interp.RunnerOption{
+		interp.StdIO(os.Stdin, os.Stdout, os.Stderr),
+		interp.Signals(signals),
+		// Replacing the process would skip writing the profiles.
+		interp.RealExec(*coverProfile == "" && *cpuProfile == ""),
+	}
+	if *debug || *debugInput != "" {
+		// Leave standard input to the program being debugged.
+		in, err := openDebugInput(*debugInput)
+		if err != nil {
+			return fmt.Errorf("cannot read debugger commands, see -debug-input: %w", err)
+		}
+		defer in.Close()
+		d := newDebugger(in, os.Stderr)
+		opts = append(opts, interp.DebugHandler(d.Handle))
+	}
+	if *coverProfile != "" {
+		coverage := interp.NewCoverageProfile()
+		opts = append(opts, interp.Coverage(coverage))
+		defer func() {
+			if err2 := writeCoverage(coverage, *coverProfile); err2 != nil {
+				err = err2
+			}
+		}()
+	}
+	if *cpuProfile != "" {
+		profiler := interp.NewProfiler()
+		opts = append(opts, interp.Profile(profiler))
+		defer func() {
+			if err2 := writeProfile(profiler, *cpuProfile); err2 != nil {
+				err = err2
+			}
+		}()
+	}
+	r, err := interp.New(opts...)
 	if err != nil {
 		return err
 	}
@@ -54,6 +100,34 @@ func runAll() error {
 	return nil
 }
 
+func writeCoverage(coverage *interp.CoverageProfile, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, ".xml") {
+		err = coverage.WriteCobertura(f)
+	} else {
+		err = coverage.WriteLCOV(f)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func writeProfile(profiler *interp.Profiler, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = profiler.WritePprof(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 func run(r *interp.Runner, reader io.Reader, name string) error {
 	prog, err := syntax.NewParser().Parse(reader, name)
 	if err != nil {
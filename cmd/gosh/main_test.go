@@ -4,11 +4,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
 )
 
 // Each test has an even number of strings, which form input-output pairs for
@@ -238,3 +244,108 @@ func readString(r io.Reader, want string) error {
 	}
 	return nil
 }
+
+func TestDebug(t *testing.T) {
+	t.Parallel()
+	src := "f() {\n\tlocal v=$1\n\techo $v\n}\nf foo\necho bar\necho baz\n"
+	cmds := "b 3\nc\nbt\np v w\nn\n\nq\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	d := newDebugger(strings.NewReader(cmds), &buf)
+	runner, _ := interp.New(interp.StdIO(nil, &buf, &buf), interp.DebugHandler(d.Handle))
+	err = runner.Run(context.Background(), file)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 1 {
+		t.Fatalf("want exit status 1, got: %v\n%s", err, &buf)
+	}
+	want := `main.sh:1: f() {
+(debug) breakpoint at 3
+(debug) main.sh:3: echo $v
+(debug) #0 f at main.sh:3
+#1 main at main.sh:5
+(debug) v=foo
+w is unset
+(debug) foo
+main.sh:6: echo bar
+(debug) bar
+main.sh:7: echo baz
+(debug) `
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestDebugInput(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "cmds")
+	if err := os.WriteFile(path, []byte("c\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	in, err := openDebugInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	file, err := syntax.NewParser().Parse(strings.NewReader(`read x; echo "got [$x]"`), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The debugger must not consume the program's standard input.
+	var buf bytes.Buffer
+	d := newDebugger(in, &buf)
+	runner, _ := interp.New(interp.StdIO(strings.NewReader("hello\n"), &buf, &buf), interp.DebugHandler(d.Handle))
+	if err := runner.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	want := "main.sh:1: read x\n(debug) got [hello]\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestWriteCoverage(t *testing.T) {
+	t.Parallel()
+	file, err := syntax.NewParser().Parse(strings.NewReader("true && echo foo\n"), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coverage := interp.NewCoverageProfile()
+	runner, _ := interp.New(interp.StdIO(nil, io.Discard, io.Discard), interp.Coverage(coverage))
+	if err := runner.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, want := range map[string]string{
+		"out.lcov": "TN:\nSF:main.sh\n",
+		"out.xml":  "<?xml",
+	} {
+		path := filepath.Join(dir, name)
+		if err := writeCoverage(coverage, path); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(got), want) {
+			t.Fatalf("%s should start with %q, got:\n%s", name, want, got)
+		}
+	}
+}
+
+func TestProfilesWithExec(t *testing.T) {
+	// Not parallel, as it sets the flags. If "false" replaced the
+	// process, the test would fail and the profile would not be written.
+	path := filepath.Join(t.TempDir(), "out.lcov")
+	defer func(c, p string) { *command, *coverProfile = c, p }(*command, *coverProfile)
+	*command, *coverProfile = "exec false", path
+	err := runAll()
+	if status, ok := interp.IsExitStatus(err); !ok || status != 1 {
+		t.Fatalf("want exit status 1, got: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
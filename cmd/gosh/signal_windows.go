@@ -0,0 +1,16 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// forwardSignals are the signals which the shell can trap.
+var forwardSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGTERM,
+}
@@ -83,3 +83,59 @@ func Braces(word *syntax.Word) []*syntax.Word {
 	}
 	return []*syntax.Word{{Parts: left}}
 }
+
+// braceWords returns the number of words that Braces would return for a word
+// with the given parts, without expanding them. The count stops growing past
+// max, to not overflow.
+func braceWords(parts []syntax.WordPart, max int) int {
+	count := 1
+	for _, wp := range parts {
+		br, ok := wp.(*syntax.BraceExp)
+		if !ok {
+			continue
+		}
+		n := 0
+		if br.Sequence {
+			from, err1 := strconv.Atoi(br.Elems[0].Lit())
+			to, err2 := strconv.Atoi(br.Elems[1].Lit())
+			if err1 != nil || err2 != nil {
+				from = int(br.Elems[0].Lit()[0])
+				to = int(br.Elems[1].Lit()[0])
+			}
+			upward := from <= to
+			diff := uint64(to - from)
+			if !upward {
+				diff = uint64(from - to)
+			}
+			incr := uint64(1)
+			if len(br.Elems) > 2 {
+				step, _ := strconv.Atoi(br.Elems[2].Lit())
+				if step != 0 && step > 0 == upward {
+					incr = uint64(step)
+					if step < 0 {
+						incr = uint64(-step)
+					}
+				}
+			}
+			if words := diff/incr + 1; words > uint64(max) {
+				n = max + 1
+			} else {
+				n = int(words)
+			}
+		} else {
+			for _, elem := range br.Elems {
+				if n += braceWords(elem.Parts, max); n > max {
+					n = max + 1
+					break
+				}
+			}
+		}
+		if n > 0 && count > max/n {
+			return max + 1
+		}
+		if count *= n; count > max {
+			return max + 1
+		}
+	}
+	return count
+}
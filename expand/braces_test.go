@@ -165,6 +165,9 @@ func TestBraces(t *testing.T) {
 				t.Fatalf("mismatch in %q\nwant:\n%s\ngot: %s",
 					inStr, wantStr, gotStr)
 			}
+			if n := braceWords(inBraces.Parts, 1000); n != len(got) {
+				t.Fatalf("braceWords in %q: want %d, got %d", inStr, len(got), n)
+			}
 		})
 	}
 }
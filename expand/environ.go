@@ -70,6 +70,15 @@ type Variable struct {
 	Exported bool
 	ReadOnly bool
 
+	// Integer means that values assigned to the variable are evaluated as
+	// arithmetic expressions, like "declare -i".
+	Integer bool
+	// LowerCase and UpperCase mean that values assigned to the variable
+	// are converted to lower or upper case, like "declare -l" and
+	// "declare -u". At most one of them should be set.
+	LowerCase bool
+	UpperCase bool
+
 	Kind ValueKind
 
 	Str  string            // Used when Kind is String or NameRef.
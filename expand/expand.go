@@ -14,6 +14,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"mvdan.cc/sh/v3/pattern"
 	"mvdan.cc/sh/v3/syntax"
@@ -57,6 +59,15 @@ type Config struct {
 	// Use ioutil.ReadDir to use the filesystem directly.
 	ReadDir func(string) ([]os.FileInfo, error)
 
+	// Stat is used by file path globbing to check whether a path exists,
+	// for the parts of a pattern without any special characters. If nil,
+	// os.Stat is used.
+	Stat func(string) (os.FileInfo, error)
+
+	// Now returns the current time, such as for printf's "%(datefmt)T"
+	// format without a time argument. If nil, time.Now is used.
+	Now func() time.Time
+
 	// GlobStar corresponds to the shell option that allows globbing with
 	// "**".
 	GlobStar bool
@@ -69,6 +80,14 @@ type Config struct {
 	// as errors.
 	NoUnset bool
 
+	// MaxSize, if positive, is the maximum size in bytes of an expansion's
+	// result. For Fields, each field also counts one extra byte, as if the
+	// fields were joined by spaces. The output of command substitutions and
+	// the number of words from brace expansions are limited as well, before
+	// they are fully expanded. Exceeding the limit results in a
+	// SizeLimitError.
+	MaxSize int
+
 	bufferAlloc bytes.Buffer // TODO: use strings.Builder
 	fieldAlloc  [4]fieldPart
 	fieldsAlloc [4][]fieldPart
@@ -89,6 +108,47 @@ func (u UnexpectedCommandError) Error() string {
 	return fmt.Sprintf("unexpected command substitution at %s", u.Node.Pos())
 }
 
+// SizeLimitError is returned if an expansion's result exceeds Config.MaxSize.
+type SizeLimitError struct {
+	MaxSize int
+}
+
+func (e SizeLimitError) Error() string {
+	return fmt.Sprintf("expansion exceeds the maximum size of %d bytes", e.MaxSize)
+}
+
+// checkSize returns a SizeLimitError if size is above cfg.MaxSize.
+func (cfg *Config) checkSize(size int) error {
+	if cfg.MaxSize > 0 && size > cfg.MaxSize {
+		return SizeLimitError{MaxSize: cfg.MaxSize}
+	}
+	return nil
+}
+
+// limitWriter is a writer that fails with a SizeLimitError once more than max
+// bytes have been written to it.
+type limitWriter struct {
+	w   io.Writer
+	max int
+	n   int
+	err error
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.err != nil {
+		return 0, lw.err
+	}
+	if lw.n+len(p) > lw.max {
+		n, _ := lw.w.Write(p[:lw.max-lw.n])
+		lw.n += n
+		lw.err = SizeLimitError{MaxSize: lw.max}
+		return n, lw.err
+	}
+	n, err := lw.w.Write(p)
+	lw.n += n
+	return n, err
+}
+
 var zeroConfig = &Config{}
 
 func prepareConfig(cfg *Config) *Config {
@@ -156,7 +216,11 @@ func Literal(cfg *Config, word *syntax.Word) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return cfg.fieldJoin(field), nil
+	str := cfg.fieldJoin(field)
+	if err := cfg.checkSize(len(str)); err != nil {
+		return "", err
+	}
+	return str, nil
 }
 
 // Document expands a single shell word as if it were within double quotes. It
@@ -174,7 +238,11 @@ func Document(cfg *Config, word *syntax.Word) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return cfg.fieldJoin(field), nil
+	str := cfg.fieldJoin(field)
+	if err := cfg.checkSize(len(str)); err != nil {
+		return "", err
+	}
+	return str, nil
 }
 
 const patMode = pattern.Filenames | pattern.Braces
@@ -221,7 +289,7 @@ formatLoop:
 		// hexadecimal.
 		readDigits := func(max int, hex bool) string {
 			j := 0
-			for ; j < max; j++ {
+			for ; j < max && i+j < len(format); j++ {
 				c := format[i+j]
 				if (c >= '0' && c <= '9') ||
 					(hex && c >= 'a' && c <= 'f') ||
@@ -314,15 +382,55 @@ formatLoop:
 					return "", 0, fmt.Errorf("invalid format char: %c", c)
 				}
 				fmts = append(fmts, c)
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.':
 				fmts = append(fmts, c)
-			case 's', 'd', 'i', 'u', 'o', 'x':
+			case '*':
+				// The width or precision is taken from an argument.
+				arg := ""
+				if len(args) > 0 {
+					arg, args = args[0], args[1:]
+				}
+				n, _ := strconv.Atoi(arg)
+				if n < 0 && fmts[len(fmts)-1] == '.' {
+					// A negative precision is as if it was omitted.
+					fmts = fmts[:len(fmts)-1]
+					break
+				}
+				fmts = strconv.AppendInt(fmts, int64(n), 10)
+			case '(':
+				// "%(datefmt)T" formats a time via strftime.
+				end := strings.IndexByte(format[i:], ')')
+				if end < 0 || i+end+1 >= len(format) || format[i+end+1] != 'T' {
+					return "", 0, fmt.Errorf("missing time format char")
+				}
+				datefmt := format[i+1 : i+end]
+				i += end + 1
+				arg := ""
+				if len(args) > 0 {
+					arg, args = args[0], args[1:]
+				}
+				s, err := cfg.formatTime(datefmt, arg)
+				if err != nil {
+					return "", 0, err
+				}
+				if err := cfg.formatArg(buf, append(fmts, 's'), s); err != nil {
+					return "", 0, err
+				}
+				fmts = nil
+			case 's', 'd', 'i', 'u', 'o', 'x', 'q':
 				arg := ""
 				if len(args) > 0 {
 					arg, args = args[0], args[1:]
 				}
 				var farg interface{} = arg
-				if c != 's' {
+				if c == 'q' {
+					// Quoted so that it can be reused as shell input.
+					quoted, err := syntax.Quote(arg, syntax.LangBash)
+					if err != nil {
+						return "", 0, err
+					}
+					farg, c = quoted, 's'
+				} else if c != 's' {
 					n, _ := strconv.ParseInt(arg, 0, 0)
 					if c == 'i' || c == 'd' {
 						farg = int(n)
@@ -333,8 +441,9 @@ formatLoop:
 						c = 'd'
 					}
 				}
-				fmts = append(fmts, c)
-				fmt.Fprintf(buf, string(fmts), farg)
+				if err := cfg.formatArg(buf, append(fmts, c), farg); err != nil {
+					return "", 0, err
+				}
 				fmts = nil
 			default:
 				return "", 0, fmt.Errorf("invalid format char: %c", c)
@@ -350,9 +459,113 @@ formatLoop:
 	if len(fmts) > 0 {
 		return "", 0, fmt.Errorf("missing format char")
 	}
+	if err := cfg.checkSize(buf.Len()); err != nil {
+		return "", 0, err
+	}
 	return buf.String(), initialArgs - len(args), nil
 }
 
+// maxFmtWidth is the largest width or precision supported by package fmt.
+const maxFmtWidth = 1e6
+
+// formatArg writes arg to buf as formatted by the directive fmts, such as
+// "%-5s". Widths and precisions too large for package fmt are applied
+// manually, so that the output is never corrupted.
+func (cfg *Config) formatArg(buf *bytes.Buffer, fmts []byte, arg interface{}) error {
+	i := 1
+	for i < len(fmts)-1 && strings.IndexByte("+- 0", fmts[i]) >= 0 {
+		i++
+	}
+	flags, verb := string(fmts[1:i]), fmts[len(fmts)-1]
+	widthStr, precStr := string(fmts[i:len(fmts)-1]), ""
+	j := strings.IndexByte(widthStr, '.')
+	hasPrec := j >= 0
+	if hasPrec {
+		widthStr, precStr = widthStr[:j], widthStr[j+1:]
+	}
+	width, err := parseFmtNum(widthStr)
+	if err != nil {
+		return fmt.Errorf("invalid field width: %s", widthStr)
+	}
+	prec, err := parseFmtNum(precStr)
+	if err != nil {
+		return fmt.Errorf("invalid precision: %s", precStr)
+	}
+	if width <= maxFmtWidth && prec <= maxFmtWidth {
+		fmt.Fprintf(buf, string(fmts), arg)
+		return nil
+	}
+	if err := cfg.checkSize(buf.Len() + width + prec); err != nil {
+		return err
+	}
+	s := fmt.Sprintf("%"+strings.NewReplacer("-", "", "0", "").Replace(flags)+string(verb), arg)
+	sign := ""
+	if verb != 's' && s != "" && strings.IndexByte("+- ", s[0]) >= 0 {
+		sign, s = s[:1], s[1:]
+	}
+	switch {
+	case !hasPrec:
+	case verb == 's':
+		if r := []rune(s); prec < len(r) {
+			s = string(r[:prec])
+		}
+	case prec > len(s):
+		s = strings.Repeat("0", prec-len(s)) + s
+	}
+	if pad := width - len(sign) - utf8.RuneCountInString(s); pad > 0 {
+		switch {
+		case strings.Contains(flags, "-"):
+			s += strings.Repeat(" ", pad)
+		case strings.Contains(flags, "0") && verb != 's' && !hasPrec:
+			s = strings.Repeat("0", pad) + s
+		default:
+			sign = strings.Repeat(" ", pad) + sign
+		}
+	}
+	buf.WriteString(sign)
+	buf.WriteString(s)
+	return nil
+}
+
+// parseFmtNum parses a width or precision, where an empty one means zero.
+func parseFmtNum(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	return int(n), err
+}
+
+// formatTime formats a time given as seconds since the epoch via strftime,
+// for "%(datefmt)T". An empty or negative time means the current time.
+// The time zone is taken from $TZ if it's set.
+func (cfg *Config) formatTime(datefmt, arg string) (string, error) {
+	if datefmt == "" {
+		datefmt = "%X" // like Bash
+	}
+	var t time.Time
+	if cfg.Now != nil {
+		t = cfg.Now()
+	} else {
+		t = time.Now()
+	}
+	if arg != "" {
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s: invalid number", arg)
+		}
+		if n >= 0 {
+			t = time.Unix(n, 0)
+		}
+	}
+	if vr := cfg.Env.Get("TZ"); vr.IsSet() {
+		if loc, err := time.LoadLocation(vr.String()); err == nil {
+			t = t.In(loc)
+		}
+	}
+	return strftime(datefmt, t), nil
+}
+
 func (cfg *Config) fieldJoin(parts []fieldPart) string {
 	switch len(parts) {
 	case 0:
@@ -392,10 +605,19 @@ func Fields(cfg *Config, words ...*syntax.Word) ([]string, error) {
 	cfg = prepareConfig(cfg)
 	fields := make([]string, 0, len(words))
 	dir := cfg.envGet("PWD")
+	size := 0
+	addField := func(field string) error {
+		size += len(field) + 1
+		return cfg.checkSize(size)
+	}
 	for _, word := range words {
 		word := *word // make a copy, since SplitBraces replaces the Parts slice
 		afterBraces := []*syntax.Word{&word}
 		if syntax.SplitBraces(&word) {
+			if cfg.MaxSize > 0 && braceWords(word.Parts, cfg.MaxSize) > cfg.MaxSize-size {
+				// Each word would take at least one byte.
+				return nil, SizeLimitError{MaxSize: cfg.MaxSize}
+			}
 			afterBraces = Braces(&word)
 		}
 		for _, word2 := range afterBraces {
@@ -412,11 +634,20 @@ func Fields(cfg *Config, words ...*syntax.Word) ([]string, error) {
 						return nil, err
 					}
 					if len(matches) > 0 || cfg.NullGlob {
+						for _, match := range matches {
+							if err := addField(match); err != nil {
+								return nil, err
+							}
+						}
 						fields = append(fields, matches...)
 						continue
 					}
 				}
-				fields = append(fields, cfg.fieldJoin(field))
+				str := cfg.fieldJoin(field)
+				if err := addField(str); err != nil {
+					return nil, err
+				}
+				fields = append(fields, str)
 			}
 		}
 	}
@@ -518,7 +749,15 @@ func (cfg *Config) cmdSubst(cs *syntax.CmdSubst) (string, error) {
 		return "", UnexpectedCommandError{Node: cs}
 	}
 	buf := cfg.strBuilder()
-	if err := cfg.CmdSubst(buf, cs); err != nil {
+	var w io.Writer = buf
+	if cfg.MaxSize > 0 {
+		w = &limitWriter{w: buf, max: cfg.MaxSize}
+	}
+	err := cfg.CmdSubst(w, cs)
+	if lw, ok := w.(*limitWriter); ok && lw.err != nil {
+		return "", lw.err
+	}
+	if err != nil {
 		return "", err
 	}
 	out := buf.String()
@@ -778,7 +1017,11 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 					match = filepath.Join(base, match)
 				}
 				match = pathJoin2(match, part)
-				info, err := os.Stat(match)
+				stat := cfg.Stat
+				if stat == nil {
+					stat = os.Stat
+				}
+				info, err := stat(match)
 				if err != nil {
 					continue
 				}
@@ -4,6 +4,7 @@
 package expand
 
 import (
+	"io"
 	"os"
 	"reflect"
 	"strings"
@@ -90,3 +91,39 @@ func TestFieldsIdempotency(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxSize(t *testing.T) {
+	env := ListEnviron("FOO=foo")
+	tests := []struct {
+		src     string
+		wantErr bool
+	}{
+		{"$FOO$FOO", false},
+		{"$FOO$FOO$FOO$FOO", true},
+		{"{1..5}", false},
+		{"{1..6}", true},
+		{"{1..100000000000}", true},
+		{"{a,b}{1..3}", true},
+		{"$(x)", false},
+		{"$(xx)", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.src, func(t *testing.T) {
+			cfg := &Config{
+				Env:     env,
+				MaxSize: 11,
+				CmdSubst: func(w io.Writer, cs *syntax.CmdSubst) error {
+					// Write six bytes per character in the command.
+					lit := cs.Stmts[0].Cmd.(*syntax.CallExpr).Args[0].Lit()
+					_, err := io.WriteString(w, strings.Repeat("abcdef", len(lit)))
+					return err
+				},
+			}
+			word := parseWord(t, tc.src)
+			_, err := Fields(cfg, word)
+			if _, ok := err.(SizeLimitError); ok != tc.wantErr {
+				t.Fatalf("wanted size limit error %t, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -62,8 +62,12 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 	var vr Variable
 	switch name {
 	case "LINENO":
-		// This is the only parameter expansion that the environment
-		// interface cannot satisfy.
+		// The environment may keep track of the current line, such as
+		// the line of the command being run. Otherwise, use the line of
+		// the parameter expansion itself.
+		if vr = cfg.Env.Get(name); vr.IsSet() {
+			break
+		}
 		line := uint64(cfg.curParam.Pos().Line())
 		vr = Variable{Kind: String, Str: strconv.FormatUint(line, 10)}
 	default:
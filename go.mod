@@ -9,7 +9,6 @@ require (
 	github.com/kr/pretty v0.3.0
 	github.com/pkg/diff v0.0.0-20210226163009-20ebb0f2a09e
 	github.com/rogpeppe/go-internal v1.8.1-0.20211023094830-115ce09fd6b4
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/sys v0.0.0-20210925032602-92d5a993a665
 	golang.org/x/term v0.0.0-20210916214954-140adaaadfaf
 	mvdan.cc/editorconfig v0.2.0
@@ -15,10 +15,11 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"golang.org/x/sync/errgroup"
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
 )
@@ -65,6 +66,45 @@ type Runner struct {
 	// openHandler is a function responsible for opening files. It must be non-nil.
 	openHandler OpenHandlerFunc
 
+	// fs is the file system used by the interpreter; see FS.
+	fs FileSystem
+
+	// execMiddlewares and openMiddlewares wrap execHandler and openHandler
+	// when the Runner is created; see ExecHandlers and OpenHandlers.
+	execMiddlewares []func(next ExecHandlerFunc) ExecHandlerFunc
+	openMiddlewares []func(next OpenHandlerFunc) OpenHandlerFunc
+
+	// realExec is whether the exec builtin replaces the current process;
+	// see RealExec.
+	realExec bool
+
+	// replacingProcess is set while the exec builtin runs a program which
+	// should replace the current process.
+	replacingProcess bool
+
+	// builtins holds the custom builtins registered via Builtins.
+	builtins map[string]BuiltinFunc
+
+	// limits tracks the resource limits set via Limits, if any.
+	limits *limitState
+
+	// debugHandler is called before each statement, if set; see
+	// DebugHandler.
+	debugHandler DebugHandlerFunc
+
+	// coverage records the statements and branches run, if set; see
+	// Coverage.
+	coverage *CoverageProfile
+	// coverFile holds the counters of the file which the code being run
+	// is part of, or nil if it's not part of a file, such as with eval.
+	coverFile *fileCoverage
+
+	// profiler records the time spent running code, if set; see Profile.
+	profiler *Profiler
+
+	// jsonTrace writes a structured trace, if set; see JSONTrace.
+	jsonTrace *jsonTracer
+
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
@@ -79,8 +119,31 @@ type Runner struct {
 
 	usedNew bool
 
-	// rand is used mainly to generate temporary files.
-	rand *rand.Rand
+	// rand is used mainly to generate temporary files and for $RANDOM;
+	// see Runner.random. It is seeded with randSeed, unless the main shell
+	// uses the source given to Random. randSubshells counts the subshells
+	// seeded from randSeed.
+	rand          *rand.Rand
+	randSeed      int64
+	randSubshells uint64
+
+	// clock, randSource, shellPid, and shellPpid are set by the Clock,
+	// Random, and ProcessIDs options.
+	clock               func() time.Time
+	randSource          rand.Source
+	shellPid, shellPpid int
+	// mtimes is only set with a clock; see Clock.
+	mtimes *virtualMtimes
+
+	// startTime is when $SECONDS was zero, which is when the shell started
+	// unless it was assigned to.
+	startTime time.Time
+	// pid is the fake process ID of a subshell, as found in $BASHPID. It is
+	// zero in the main shell, which uses the real one.
+	pid int
+	// subshells counts the subshells created by the main shell and all of
+	// its subshells, to give them unique fake process IDs; see fakePid.
+	subshells *uint32
 
 	// wgProcSubsts allows waiting for any process substitution sub-shells
 	// to finish running.
@@ -93,6 +156,36 @@ type Runner struct {
 
 	inLoop    bool
 	inFunc    bool
+	funcDepth int // number of nested function calls
+
+	// callers holds the frames of the calls to the functions and sourced
+	// files being run, outermost first. frameFunc and frameFile are the
+	// function and file of the code being run; see Frame.
+	callers              []Frame
+	frameFunc, frameFile string
+	// funcFiles holds the files which defined each function, if known.
+	funcFiles map[string]string
+	// funcCover is like funcFiles, but with the files' coverage counters.
+	funcCover map[string]*fileCoverage
+	// profStack holds the statements and commands being profiled; see
+	// profStart.
+	profStack []*profEntry
+
+	// lineno is the line of the statement being run, for $LINENO.
+	lineno uint
+	// substLevel is the nesting level of command substitutions, and
+	// subshellLevel also includes subshells like "(cmd)".
+	substLevel, subshellLevel int
+	// traceStdout, traceStderr, and traceFds are the file descriptors
+	// before the redirections of the statement being run, which don't
+	// apply to its xtrace output.
+	traceStdout, traceStderr io.Writer
+	traceFds                 map[int]*fdEntry
+
+	// failure is the last simple command which failed, if no command
+	// succeeded since; see ExitError.
+	failure *ExitError
+
 	inSource  bool
 	noErrExit bool
 
@@ -110,7 +203,40 @@ type Runner struct {
 	exit     int
 	lastExit int
 
-	bgShells errgroup.Group
+	// jobs is the table of background jobs, sorted by job number.
+	jobs []*bgJob
+	// doneJobs holds finished jobs which are no longer in the job table,
+	// but whose exit status can still be collected by their PID.
+	doneJobs []*bgJob
+	// bgCount is the number of background jobs started so far.
+	bgCount int
+	// lastBgPid is the PID of the last background job, as found in "$!".
+	lastBgPid string
+
+	// fds holds the open file descriptors other than standard input,
+	// output, and error, such as the ones opened via "exec 3>file".
+	// The map is replaced rather than modified when opening or closing
+	// file descriptors; see Runner.setFd.
+	fds map[int]*fdEntry
+	// stdFds holds the entries for standard input, output, and error set
+	// via redirections which own a reference to an open file, such as via
+	// "<file" or ">&3", so that it can be released once the redirection
+	// ends.
+	stdFds [3]*fdEntry
+
+	// umask is the file mode creation mask, as set via the umask builtin.
+	umask os.FileMode
+	// rlimits holds the resource limits set via the ulimit builtin. Like
+	// fds, the map is replaced rather than modified.
+	rlimits map[int]Rlimit
+
+	// tracedFuncs holds the names of the functions with the trace
+	// attribute, set via "declare -ft".
+	tracedFuncs map[string]bool
+
+	// pendingRead is a read by the read builtin which was still blocked
+	// when it timed out or got cancelled; see Runner.startRead.
+	pendingRead *pendingRead
 
 	opts runnerOpts
 
@@ -132,9 +258,28 @@ type Runner struct {
 	// apply to the current shell, and not just the command.
 	keepRedirs bool
 
-	// Fake signal callbacks
-	callbackErr  string
-	callbackExit string
+	// traps holds the callbacks set via the trap builtin, keyed by signal
+	// names without the "SIG" prefix like "TERM", or by pseudo-signals like
+	// "EXIT" and "ERR". An empty callback means that a signal is ignored.
+	traps map[string]string
+
+	// signals is the channel from which incoming signals are received.
+	signals <-chan os.Signal
+
+	// sigMu guards the fields below as well as traps, since signals are
+	// received concurrently; see Runner.watchSignals.
+	sigMu sync.Mutex
+
+	// pendingSigs holds the trapped signals which weren't handled yet.
+	pendingSigs []syscall.Signal
+	// sigInterrupt is notified when a trapped signal is received, so that
+	// builtins like wait can return early.
+	sigInterrupt chan struct{}
+	// fatalSig is the signal received to terminate the shell, if any.
+	fatalSig syscall.Signal
+
+	// exitSig is the signal which terminated the last call to Run, if any.
+	exitSig syscall.Signal
 }
 
 type alias struct {
@@ -162,6 +307,7 @@ func New(opts ...RunnerOption) (*Runner, error) {
 		usedNew:     true,
 		execHandler: DefaultExecHandler(2 * time.Second),
 		openHandler: DefaultOpenHandler(),
+		fs:          DefaultFileSystem(),
 	}
 	r.dirStack = r.dirBootstrap[:0]
 	for _, opt := range opts {
@@ -177,10 +323,31 @@ func New(opts ...RunnerOption) (*Runner, error) {
 		if err := Dir("")(r); err != nil {
 			return nil, err
 		}
+	} else {
+		// Checked here, as the file system may be set after the directory.
+		info, err := r.fs.Stat(r.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat: %v", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", r.Dir)
+		}
 	}
 	if r.stdout == nil || r.stderr == nil {
 		StdIO(r.stdin, r.stdout, r.stderr)(r)
 	}
+	// Chain the middlewares, so that the first one is called first.
+	for i := len(r.execMiddlewares) - 1; i >= 0; i-- {
+		r.execHandler = r.execMiddlewares[i](r.execHandler)
+	}
+	for i := len(r.openMiddlewares) - 1; i >= 0; i-- {
+		r.openHandler = r.openMiddlewares[i](r.openHandler)
+	}
+	r.execMiddlewares, r.openMiddlewares = nil, nil
+	if r.limits != nil && r.limits.MaxOutputBytes > 0 {
+		r.stdout = &limitWriter{w: r.stdout, limits: r.limits, n: &r.limits.output[0]}
+		r.stderr = &limitWriter{w: r.stderr, limits: r.limits, n: &r.limits.output[1]}
+	}
 	return r, nil
 }
 
@@ -202,7 +369,7 @@ func Env(env expand.Environ) RunnerOption {
 }
 
 // Dir sets the interpreter's working directory. If empty, the process's current
-// directory is used.
+// directory is used. The directory must exist in the interpreter's file system.
 func Dir(path string) RunnerOption {
 	return func(r *Runner) error {
 		if path == "" {
@@ -217,14 +384,7 @@ func Dir(path string) RunnerOption {
 		if err != nil {
 			return fmt.Errorf("could not get absolute dir: %v", err)
 		}
-		info, err := os.Stat(path)
-		if err != nil {
-			return fmt.Errorf("could not stat: %v", err)
-		}
-		if !info.IsDir() {
-			return fmt.Errorf("%s is not a directory", path)
-		}
-		r.Dir = path
+		r.Dir = path // checked by New
 		return nil
 	}
 }
@@ -240,6 +400,14 @@ func Params(args ...string) RunnerOption {
 		for fp.more() {
 			flag := fp.flag()
 			enable := flag[0] == '-'
+			if flag[1] == 'r' {
+				if enable {
+					r.restrict()
+				} else if r.opts[optRestricted] {
+					return fmt.Errorf("invalid option: %q", flag)
+				}
+				continue
+			}
 			if flag[1] != 'o' {
 				opt := r.optByFlag(flag[1])
 				if opt == nil {
@@ -251,12 +419,17 @@ func Params(args ...string) RunnerOption {
 			value := fp.value()
 			if value == "" && enable {
 				for i, opt := range &shellOptsTable {
-					r.printOptLine(opt.name, r.opts[i])
+					if opt.name != "" {
+						r.printOptLine(opt.name, r.opts[i])
+					}
 				}
 				continue
 			}
 			if value == "" && !enable {
 				for i, opt := range &shellOptsTable {
+					if opt.name == "" {
+						continue
+					}
 					setFlag := "+o"
 					if r.opts[i] {
 						setFlag = "-o"
@@ -301,6 +474,111 @@ func OpenHandler(f OpenHandlerFunc) RunnerOption {
 	}
 }
 
+// FS sets the file system used by the interpreter, DefaultFileSystem by
+// default. See FileSystem for more info.
+//
+// DefaultOpenHandler opens files via the file system, so it's used for
+// redirections unless a different open handler is set via OpenHandler.
+func FS(fsys FileSystem) RunnerOption {
+	return func(r *Runner) error {
+		r.fs = fsys
+		return nil
+	}
+}
+
+// ExecHandlers appends middlewares to handle command execution, which wrap the
+// handler set via ExecHandler, DefaultExecHandler by default. The middlewares
+// are chained from first to last, and the first is called by the interpreter.
+//
+// Each middleware is given the next handler in the chain, which it may call
+// at most once per command. For example, a middleware may implement some
+// commands by itself without calling next, or it may call next with modified
+// arguments, or log each command before and after calling next.
+//
+// See LogExecs, AllowExecs, DryRunExecs, and TimeoutExecs for some examples.
+func ExecHandlers(middlewares ...func(next ExecHandlerFunc) ExecHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.execMiddlewares = append(r.execMiddlewares, middlewares...)
+		return nil
+	}
+}
+
+// OpenHandlers appends middlewares to handle opening files, which wrap the
+// handler set via OpenHandler, DefaultOpenHandler by default. They are chained
+// like with ExecHandlers.
+func OpenHandlers(middlewares ...func(next OpenHandlerFunc) OpenHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.openMiddlewares = append(r.openMiddlewares, middlewares...)
+		return nil
+	}
+}
+
+// Builtins registers custom builtin commands, keyed by name, which can read
+// and modify the state of the interpreter. See BuiltinFunc for more info.
+//
+// Like the standard builtins, they are found by the type, command, and builtin
+// builtins, and functions of the same name take precedence. A custom builtin
+// replaces any standard builtin of the same name. Using this option multiple
+// times adds to the registered builtins.
+func Builtins(fns map[string]BuiltinFunc) RunnerOption {
+	return func(r *Runner) error {
+		builtins := make(map[string]BuiltinFunc, len(r.builtins)+len(fns))
+		for name, fn := range r.builtins {
+			builtins[name] = fn
+		}
+		for name, fn := range fns {
+			if name == "" || strings.ContainsAny(name, "/=") {
+				return fmt.Errorf("invalid builtin name: %q", name)
+			}
+			builtins[name] = fn
+		}
+		r.builtins = builtins
+		return nil
+	}
+}
+
+// RealExec sets whether the exec builtin replaces the current process with the
+// given program via execve(2), like a shell would. By default, the program is
+// run via the exec handler instead, and the interpreter exits once it's done.
+//
+// Replacing the process is useful when the interpreter is the main program,
+// such as when it's the entrypoint of a container, as then the program keeps
+// the same PID and receives signals directly. It should not be enabled when
+// embedding the interpreter in a larger program.
+//
+// The exec handlers set via ExecHandler and ExecHandlers still apply, and the
+// process is only replaced once DefaultExecHandler is reached, so that
+// middlewares like AllowExecs keep working.
+//
+// The program inherits the interpreter's exported variables, directory, umask,
+// resource limits, and open files. It's only supported on Unix-like systems,
+// and only if standard input, output, and error are nil or *os.File values;
+// otherwise, the program is run as usual. Subshells never replace the process.
+func RealExec(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.realExec = enabled
+		return nil
+	}
+}
+
+// Signals sets the channel from which the interpreter receives signals, such as
+// os.Interrupt. The channel is typically set up via os/signal.Notify, which
+// lets the caller decide which signals to forward to the interpreter.
+//
+// A received signal with a trap set via the trap builtin runs its callback
+// between statements, and makes the wait builtin return early. Signals which
+// aren't trapped and would terminate a shell by default, such as SIGTERM,
+// make the interpreter stop with an exit status of 128 plus the signal number.
+// Any other signals, including those ignored via the trap builtin, are dropped.
+//
+// Only signals of type syscall.Signal are supported.
+func Signals(ch <-chan os.Signal) RunnerOption {
+	return func(r *Runner) error {
+		r.signals = ch
+		return nil
+	}
+}
+
 // StdIO configures an interpreter's standard input, standard output, and
 // standard error. If out or err are nil, they default to a writer that discards
 // the output.
@@ -328,7 +606,7 @@ func (r *Runner) optByName(name string, bash bool) *bool {
 		}
 	}
 	for i, opt := range &shellOptsTable {
-		if opt.name == name {
+		if opt.name == name && name != "" {
 			return &r.opts[i]
 		}
 	}
@@ -342,9 +620,13 @@ var shellOptsTable = [...]struct {
 	name string
 }{
 	// sorted alphabetically by name; use a space for the options
-	// that have no flag form
+	// that have no flag form, and an empty name for the ones that
+	// have no "-o name" form
+	{'r', ""},
 	{'a', "allexport"},
 	{'e', "errexit"},
+	{'E', "errtrace"},
+	{'T', "functrace"},
 	{'n', "noexec"},
 	{'f', "noglob"},
 	{'u', "nounset"},
@@ -363,8 +645,11 @@ var bashOptsTable = [...]string{
 // know which option we're after at compile time. First come the shell options,
 // then the bash options.
 const (
-	optAllExport = iota
+	optRestricted = iota
+	optAllExport
 	optErrExit
+	optErrTrace
+	optFuncTrace
 	optNoExec
 	optNoGlob
 	optNoUnset
@@ -395,11 +680,28 @@ func (r *Runner) Reset() {
 		r.origStdout = r.stdout
 		r.origStderr = r.stderr
 	}
+	r.closeFds()
+	// The initial variables below aren't subject to the limits.
+	limits := r.limits
 	// reset the internal state
 	*r = Runner{
 		Env:         r.Env,
 		execHandler: r.execHandler,
 		openHandler: r.openHandler,
+		realExec:    r.realExec,
+		builtins:    r.builtins,
+		fs:          r.fs,
+		signals:     r.signals,
+
+		debugHandler: r.debugHandler,
+		coverage:     r.coverage,
+		profiler:     r.profiler,
+		jsonTrace:    r.jsonTrace,
+
+		clock:      r.clock,
+		randSource: r.randSource,
+		shellPid:   r.shellPid,
+		shellPpid:  r.shellPpid,
 
 		// These can be set by functions like Dir or Params, but
 		// builtins can overwrite them; reset the fields to whatever the
@@ -422,6 +724,15 @@ func (r *Runner) Reset() {
 		Vars:     r.Vars,
 		dirStack: r.dirStack[:0],
 		usedNew:  r.usedNew,
+
+		subshells: new(uint32),
+	}
+	r.startTime = r.now()
+	if r.randSource == nil {
+		r.randSeed = time.Now().UnixNano()
+	}
+	if r.clock != nil {
+		r.mtimes = &virtualMtimes{mtimes: make(map[string]time.Time)}
 	}
 	if r.Vars == nil {
 		r.Vars = make(map[string]expand.Variable)
@@ -453,8 +764,26 @@ func (r *Runner) Reset() {
 	r.setVarString("PWD", r.Dir)
 	r.setVarString("IFS", " \t\n")
 	r.setVarString("OPTIND", "1")
+	if !r.writeEnv.Get("PS4").IsSet() {
+		r.setVarString("PS4", "+ ")
+	}
+	// Like Bash, increment the shell level inherited from the parent.
+	shlvl, _ := strconv.Atoi(r.writeEnv.Get("SHLVL").String())
+	if shlvl < 0 {
+		shlvl = 0
+	}
+	r.setVar("SHLVL", nil, expand.Variable{
+		Kind:     expand.String,
+		Exported: true,
+		Str:      strconv.Itoa(shlvl + 1),
+	})
+	if r.opts[optRestricted] {
+		r.restrict()
+	}
 
 	r.dirStack = append(r.dirStack, r.Dir)
+	r.umask = processUmask()
+	r.limits = limits
 	r.didReset = true
 }
 
@@ -477,9 +806,55 @@ func IsExitStatus(err error) (status uint8, ok bool) {
 	return 0, false
 }
 
+// ExitError is returned by Runner.Run when a simple command which failed made
+// the shell exit early with a non-zero status, such as under "set -e" or via
+// the exit builtin. Like any error from NewExitStatus, its status can be
+// retrieved with IsExitStatus, and its message is like "exit status 1".
+type ExitError struct {
+	// Status is the exit status of the shell.
+	Status uint8
+
+	// Args are the expanded arguments of the command which failed,
+	// including its name.
+	Args []string
+
+	// Pos is the position of the command which failed.
+	Pos syntax.Pos
+
+	// Stack is the call stack when the command failed, starting with the
+	// innermost frame. Its first frame has the command's position and the
+	// name of its file, if any.
+	Stack []Frame
+}
+
+func (e *ExitError) Error() string { return exitStatus(e.Status).Error() }
+
+func (e *ExitError) Unwrap() error { return exitStatus(e.Status) }
+
+// StackTrace describes where the command failed, such as:
+//
+//	deploy.sh:42 in install_pkg <- main: curl exited 22
+func (e *ExitError) StackTrace() string {
+	var sb strings.Builder
+	for i, frame := range e.Stack {
+		if i == 0 {
+			if frame.File != "" {
+				sb.WriteString(frame.File + ":")
+			}
+			fmt.Fprintf(&sb, "%d in ", e.Pos.Line())
+		} else {
+			sb.WriteString(" <- ")
+		}
+		sb.WriteString(frame.Func)
+	}
+	fmt.Fprintf(&sb, ": %s exited %d", e.Args[0], e.Status)
+	return sb.String()
+}
+
 // Run interprets a node, which can be a *File, *Stmt, or Command. If a non-nil
 // error is returned, it will typically contain a command's exit status, which
-// can be retrieved with IsExitStatus.
+// can be retrieved with IsExitStatus. If a failing command made the shell exit
+// early, the error is an *ExitError with more information.
 //
 // Run can be called multiple times synchronously to interpret programs
 // incrementally. To reuse a Runner without keeping the internal shell state,
@@ -491,17 +866,48 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	if !r.didReset {
 		r.Reset()
 	}
+	origCtx := ctx
+	if r.signals != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		r.sigInterrupt = make(chan struct{}, 1)
+		stop := r.watchSignals(cancel)
+		defer stop()
+	}
+	if r.limits != nil && r.limits.owner == r {
+		r.limits.reset()
+		if !r.limits.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, r.limits.deadline)
+			defer cancel()
+		}
+	}
 	r.fillExpandConfig(ctx)
 	r.err = nil
 	r.shellExited = false
+	if r.frameFunc == "" {
+		r.frameFunc = "main"
+	}
+	r.exitSig = 0
 	r.filename = ""
+	r.coverFile = nil
 	switch x := node.(type) {
 	case *syntax.File:
 		r.filename = x.Name
+		r.callers, r.frameFunc, r.frameFile = nil, "main", x.Name
+		if r.coverage != nil {
+			r.coverFile = r.coverage.addFile(x)
+		}
 		r.stmts(ctx, x.Stmts)
 		if !r.shellExited {
+			// Reaching the end of the script is not a failure.
+			r.failure = nil
 			r.exitShell(ctx, r.exit)
 		}
+		// Like a real shell exiting, let coprocesses see the end of
+		// their input.
+		r.closeFds()
 	case *syntax.Stmt:
 		r.stmt(ctx, x)
 	case syntax.Command:
@@ -509,8 +915,35 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	default:
 		return fmt.Errorf("node can only be File, Stmt, or Command: %T", x)
 	}
+	r.sigMu.Lock()
+	fatalSig := r.fatalSig
+	r.fatalSig = 0
+	r.sigMu.Unlock()
+	if fatalSig != 0 {
+		// Like a real shell, we got killed by a signal. Only run the exit
+		// trap, using the original context as ours was cancelled.
+		r.fillExpandConfig(origCtx)
+		r.err = nil
+		r.shellExited = false
+		callback, _ := r.getTrap("EXIT")
+		r.trapCallback(origCtx, callback, "exit")
+		r.shellExited = true
+		r.err = nil
+		r.exit = 128 + int(fatalSig)
+		r.exitSig = fatalSig
+		r.failure = nil
+	}
+	if r.limits != nil && !r.checkLimits(syntax.Pos{}) {
+		// Any other error, such as the context deadline, is a
+		// consequence of exceeding the limit.
+		r.err = r.limits.exceeded(syntax.Pos{})
+	}
 	if r.exit != 0 {
-		r.setErr(NewExitStatus(uint8(r.exit)))
+		if f := r.failure; f != nil && r.shellExited && int(f.Status) == r.exit {
+			r.setErr(f)
+		} else {
+			r.setErr(NewExitStatus(uint8(r.exit)))
+		}
 	}
 	if r.Vars != nil {
 		r.writeEnv.Each(func(name string, vr expand.Variable) bool {
@@ -545,12 +978,15 @@ func (r *Runner) Subshell() *Runner {
 		r.Reset()
 	}
 	// Keep in sync with the Runner type. Manually copy fields, to not copy
-	// sensitive ones like errgroup.Group, and to do deep copies of slices.
+	// sensitive ones like the job table, and to do deep copies of slices.
 	r2 := &Runner{
 		Dir:         r.Dir,
 		Params:      r.Params,
 		execHandler: r.execHandler,
 		openHandler: r.openHandler,
+		builtins:    r.builtins,
+		fs:          r.fs,
+		limits:      r.limits,
 		stdin:       r.stdin,
 		stdout:      r.stdout,
 		stderr:      r.stderr,
@@ -559,6 +995,36 @@ func (r *Runner) Subshell() *Runner {
 		usedNew:     r.usedNew,
 		exit:        r.exit,
 		lastExit:    r.lastExit,
+		lastBgPid:   r.lastBgPid,
+		umask:       r.umask,
+		rlimits:     r.rlimits,
+		funcDepth:   r.funcDepth,
+
+		debugHandler: r.debugHandler,
+		coverage:     r.coverage,
+		coverFile:    r.coverFile,
+		profiler:     r.profiler,
+		jsonTrace:    r.jsonTrace,
+		profStack:    append([]*profEntry(nil), r.profStack...),
+		callers:      append([]Frame(nil), r.callers...),
+		frameFunc:    r.frameFunc,
+		frameFile:    r.frameFile,
+
+		lineno:        r.lineno,
+		substLevel:    r.substLevel,
+		subshellLevel: r.subshellLevel,
+
+		// Like a forked Bash, a subshell has its own $RANDOM sequence
+		// and $BASHPID.
+		randSeed:   r.subshellSeed(),
+		clock:      r.clock,
+		randSource: r.randSource,
+		shellPid:   r.shellPid,
+		shellPpid:  r.shellPpid,
+		mtimes:     r.mtimes,
+		startTime:  r.startTime,
+		pid:        r.newSubshellPid(),
+		subshells:  r.subshells,
 
 		origStdout: r.origStdout, // used for process substitutions
 	}
@@ -588,6 +1054,24 @@ func (r *Runner) Subshell() *Runner {
 	for k, v := range r.Funcs {
 		r2.Funcs[k] = v
 	}
+	if len(r.funcFiles) > 0 {
+		r2.funcFiles = make(map[string]string, len(r.funcFiles))
+		for k, v := range r.funcFiles {
+			r2.funcFiles[k] = v
+		}
+	}
+	if len(r.funcCover) > 0 {
+		r2.funcCover = make(map[string]*fileCoverage, len(r.funcCover))
+		for k, v := range r.funcCover {
+			r2.funcCover[k] = v
+		}
+	}
+	if len(r.tracedFuncs) > 0 {
+		r2.tracedFuncs = make(map[string]bool, len(r.tracedFuncs))
+		for k, v := range r.tracedFuncs {
+			r2.tracedFuncs[k] = v
+		}
+	}
 	r2.Vars = make(map[string]expand.Variable)
 	if l := len(r.alias); l > 0 {
 		r2.alias = make(map[string]alias, l)
@@ -596,6 +1080,37 @@ func (r *Runner) Subshell() *Runner {
 		}
 	}
 
+	// Subshells don't inherit traps, but ignored signals stay ignored.
+	// The errtrace and functrace options make some traps inherited.
+	r.sigMu.Lock()
+	for name, callback := range r.traps {
+		inherit := false
+		switch name {
+		case "EXIT":
+		case "ERR":
+			inherit = r.opts[optErrTrace]
+		case "DEBUG", "RETURN":
+			inherit = r.opts[optFuncTrace]
+		default:
+			inherit = callback == ""
+		}
+		if inherit {
+			if r2.traps == nil {
+				r2.traps = make(map[string]string)
+			}
+			r2.traps[name] = callback
+		}
+	}
+	r.sigMu.Unlock()
+
+	// Open file descriptors are inherited, but the subshell can't close
+	// the files in use by the parent.
+	if len(r.fds) > 0 {
+		r2.fds = make(map[int]*fdEntry, len(r.fds))
+		for n, e := range r.fds {
+			r2.fds[n] = e.inherited()
+		}
+	}
 	r2.dirStack = append(r2.dirBootstrap[:0], r.dirStack...)
 	r2.fillExpandConfig(r.ectx)
 	r2.didReset = true
@@ -11,8 +11,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -25,12 +32,35 @@ func isBuiltin(name string) bool {
 		"wait", "builtin", "trap", "type", "source", ".", "command",
 		"dirs", "pushd", "popd", "umask", "alias", "unalias",
 		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return", "read", "shopt":
+		"return", "read", "mapfile", "readarray", "shopt", "jobs", "kill",
+		"disown", "ulimit", "caller":
 		return true
 	}
 	return false
 }
 
+// isBuiltin is like the isBuiltin func, but it also includes the custom
+// builtins registered via Builtins.
+func (r *Runner) isBuiltin(name string) bool {
+	return r.builtins[name] != nil || isBuiltin(name)
+}
+
+// customBuiltin runs a custom builtin registered via Builtins.
+func (r *Runner) customBuiltin(ctx context.Context, fn BuiltinFunc, name string, args []string) int {
+	bc := &BuiltinContext{r: r}
+	err := fn(r.handlerCtx(ctx), bc, append([]string{name}, args...))
+	bc.r = nil // must not be used once the builtin returns
+	if status, ok := IsExitStatus(err); ok {
+		return int(status)
+	}
+	if err != nil {
+		// handler's custom fatal error
+		r.setErr(err)
+		return 1
+	}
+	return 0
+}
+
 func oneIf(b bool) int {
 	if b {
 		return 1
@@ -46,6 +76,12 @@ func atoi(s string) int {
 }
 
 func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, args []string) int {
+	if r.restrictedBuiltin(pos, name, args) {
+		return 1
+	}
+	if fn := r.builtins[name]; fn != nil {
+		return r.customBuiltin(ctx, fn, name, args)
+	}
 	switch name {
 	case "true", ":":
 	case "false":
@@ -145,22 +181,59 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 	case "printf":
 		if len(args) == 0 {
-			r.errf("usage: printf format [arguments]\n")
+			r.errf("usage: printf [-v var] format [arguments]\n")
+			return 2
+		}
+		varName, hasVar := "", false
+		switch {
+		case args[0] == "--":
+			args = args[1:]
+		case args[0] == "-v":
+			if len(args) < 2 {
+				r.errf("printf: -v: option requires an argument\n")
+				return 2
+			}
+			varName, args, hasVar = args[1], args[2:], true
+		case strings.HasPrefix(args[0], "-v"):
+			varName, args, hasVar = args[0][2:], args[1:], true
+		}
+		var varIndex syntax.ArithmExpr
+		if hasVar {
+			ref, index, ok := r.parseVarRef(varName)
+			if !ok {
+				r.errf("printf: invalid identifier %q\n", varName)
+				return 2
+			}
+			varName, varIndex = ref, index
+		}
+		if len(args) == 0 {
+			r.errf("usage: printf [-v var] format [arguments]\n")
 			return 2
 		}
 		format, args := args[0], args[1:]
+		var sb strings.Builder
 		for {
 			s, n, err := expand.Format(r.ecfg, format, args)
+			if r.limitExpandErr(err) {
+				return 1
+			}
 			if err != nil {
 				r.errf("%v\n", err)
 				return 1
 			}
-			r.out(s)
+			if varName != "" {
+				sb.WriteString(s)
+			} else {
+				r.out(s)
+			}
 			args = args[n:]
 			if n == 0 || len(args) == 0 {
 				break
 			}
 		}
+		if varName != "" {
+			r.setVar(varName, varIndex, expand.Variable{Kind: expand.String, Str: sb.String()})
+		}
 	case "break", "continue":
 		if !r.inLoop {
 			r.errf("%s is only useful in a loop", name)
@@ -200,7 +273,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		pwd := r.envGet("PWD")
 		if evalSymlinks {
 			var err error
-			pwd, err = filepath.EvalSymlinks(pwd)
+			pwd, err = evalSymlinksFS(r.fs, pwd)
 			if err != nil {
 				r.setErr(err)
 				return 1
@@ -226,18 +299,306 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		return r.changeDir(path)
 	case "wait":
+		anyJob := false
+		varName := ""
+		fp := flagParser{remaining: args}
+		for fp.more() {
+			switch flag := fp.flag(); flag {
+			case "-n":
+				anyJob = true
+			case "-p":
+				varName = fp.value()
+				if !syntax.ValidName(varName) {
+					r.errf("wait: -p: invalid identifier %q\n", varName)
+					return 2
+				}
+			case "-f":
+				// We don't have job control, so this is the default.
+			default:
+				r.errf("wait: invalid option %q\n", flag)
+				r.errf("wait: usage: wait [-fn] [-p var] [id ...]\n")
+				return 2
+			}
+		}
+		args := fp.args()
+		if varName != "" {
+			r.delVar(varName)
+		}
+		var jobs []*bgJob
+		exit := 0
+		for _, arg := range args {
+			job, err := r.findJob(arg)
+			if err != nil {
+				r.errf("wait: %v\n", err)
+				exit = 127
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+		if len(args) == 0 {
+			jobs = append(jobs, r.jobs...)
+		}
+		if anyJob {
+			if len(jobs) == 0 {
+				return 127
+			}
+			job := waitJobs(ctx, jobs, r.sigInterrupt)
+			if job == nil {
+				return r.waitInterrupted()
+			}
+			if varName != "" {
+				r.setVarString(varName, job.pid)
+			}
+			return r.collectJob(job)
+		}
+		for _, job := range jobs {
+			if waitJobs(ctx, []*bgJob{job}, r.sigInterrupt) == nil {
+				return r.waitInterrupted()
+			}
+			if varName != "" {
+				r.setVarString(varName, job.pid)
+			}
+			exit = r.collectJob(job)
+		}
+		if len(args) == 0 {
+			// Like Bash, "wait" without arguments always succeeds.
+			return 0
+		}
+		return exit
+	case "jobs":
+		long, pidsOnly, running := false, false, false
+		fp := flagParser{remaining: args}
+		for fp.more() {
+			switch flag := fp.flag(); flag {
+			case "-l":
+				long = true
+			case "-p":
+				pidsOnly = true
+			case "-r":
+				running = true
+			case "-n", "-s":
+				// Jobs are never stopped, and we print all changes.
+			default:
+				r.errf("jobs: invalid option %q\n", flag)
+				r.errf("jobs: usage: jobs [-lnprs] [jobspec ...]\n")
+				return 2
+			}
+		}
+		args := fp.args()
+		jobs := r.jobs
+		exit := 0
 		if len(args) > 0 {
-			panic("wait with args not handled yet")
+			jobs = nil
+			for _, arg := range args {
+				if !strings.HasPrefix(arg, "%") {
+					arg = "%" + arg
+				}
+				job, err := r.findJob(arg)
+				if err != nil {
+					r.errf("jobs: %v\n", err)
+					exit = 1
+					continue
+				}
+				jobs = append(jobs, job)
+			}
+		}
+		var reported []*bgJob
+		for _, job := range jobs {
+			if running && job.finished() {
+				continue
+			}
+			if pidsOnly {
+				r.outf("%s\n", job.pid)
+				continue
+			}
+			r.printJob(job, long)
+			if job.finished() {
+				reported = append(reported, job)
+			}
 		}
-		err := r.bgShells.Wait()
-		if _, ok := IsExitStatus(err); err != nil && !ok {
-			r.setErr(err)
+		// Once a finished job has been reported, it leaves the job table.
+		for _, job := range reported {
+			r.forgetJob(job)
 		}
+		return exit
+	case "fg", "bg":
+		spec := "%+"
+		switch len(args) {
+		case 0:
+		case 1:
+			spec = args[0]
+			if !strings.HasPrefix(spec, "%") {
+				spec = "%" + spec
+			}
+		default:
+			r.errf("%s: usage: %s [job_spec]\n", name, name)
+			return 2
+		}
+		job, err := r.findJob(spec)
+		if err != nil {
+			if len(args) == 0 {
+				err = fmt.Errorf("current: no such job")
+			}
+			r.errf("%s: %v\n", name, err)
+			return 1
+		}
+		if name == "bg" {
+			// Jobs are never stopped, so they always run in the background.
+			if !job.finished() {
+				r.errf("bg: job %d already in background\n", job.id)
+			}
+			return 0
+		}
+		r.outf("%s\n", job.text())
+		// Signals are meant for the job in the foreground, so don't
+		// get interrupted by them.
+		if waitJobs(ctx, []*bgJob{job}, nil) == nil {
+			return 1 // cancelled
+		}
+		return r.collectJob(job)
+	case "disown":
+		all, running := false, false
+		fp := flagParser{remaining: args}
+		for fp.more() {
+			switch flag := fp.flag(); flag {
+			case "-a":
+				all = true
+			case "-r":
+				running = true
+			case "-h":
+				// We never send SIGHUP to jobs, so this is the default.
+			default:
+				r.errf("disown: invalid option %q\n", flag)
+				r.errf("disown: usage: disown [-h] [-ar] [jobspec ... | pid ...]\n")
+				return 2
+			}
+		}
+		args := fp.args()
+		var jobs []*bgJob
+		exit := 0
+		switch {
+		case len(args) > 0:
+			for _, arg := range args {
+				job, err := r.findJob(arg)
+				if err != nil {
+					r.errf("disown: %v\n", err)
+					exit = 1
+					continue
+				}
+				jobs = append(jobs, job)
+			}
+		case all || running:
+			jobs = append(jobs, r.jobs...)
+		default:
+			cur, _ := r.currentJobs()
+			if cur == nil {
+				r.errf("disown: current: no such job\n")
+				return 1
+			}
+			jobs = append(jobs, cur)
+		}
+		for _, job := range jobs {
+			if running && job.finished() {
+				continue
+			}
+			r.jobs = removeJob(r.jobs, job)
+			r.doneJobs = removeJob(r.doneJobs, job)
+		}
+		return exit
+	case "kill":
+		sig := signalNum("TERM")
+		fp := flagParser{remaining: args}
+		if fp.more() {
+			switch flag := fp.remaining[0]; flag {
+			case "-l", "-L":
+				fp.remaining = fp.remaining[1:]
+				if len(fp.remaining) == 0 {
+					r.printSignalList()
+					return 0
+				}
+				exit := 0
+				for _, arg := range fp.remaining {
+					if n, err := strconv.Atoi(arg); err == nil {
+						if n > 128 {
+							// Exit statuses after a signal, like 143.
+							n -= 128
+						}
+						if name := signalName(syscall.Signal(n)); name != "" {
+							r.outf("%s\n", name)
+							continue
+						}
+					} else if sig, ok := parseSignal(arg); ok {
+						r.outf("%d\n", int(sig))
+						continue
+					}
+					r.errf("kill: %s: invalid signal specification\n", arg)
+					exit = 1
+				}
+				return exit
+			case "-s", "-n":
+				fp.remaining = fp.remaining[1:]
+				spec := fp.value()
+				var ok bool
+				if sig, ok = parseSignal(spec); !ok {
+					r.errf("kill: %s: invalid signal specification\n", spec)
+					return 1
+				}
+			case "--":
+				fp.remaining = fp.remaining[1:]
+			default:
+				var ok bool
+				if sig, ok = parseSignal(flag[1:]); !ok || flag[0] != '-' {
+					r.errf("kill: %s: invalid signal specification\n", flag[1:])
+					return 1
+				}
+				fp.remaining = fp.remaining[1:]
+			}
+		}
+		args := fp.args()
+		if len(args) == 0 {
+			r.errf("kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\n")
+			return 2
+		}
+		exit := 0
+		for _, arg := range args {
+			if job, err := r.findJob(arg); err == nil {
+				r.killJob(job, sig)
+				continue
+			} else if strings.HasPrefix(arg, "%") {
+				r.errf("kill: %v\n", err)
+				exit = 1
+				continue
+			}
+			pid, err := strconv.Atoi(arg)
+			if err != nil {
+				r.errf("kill: %s: arguments must be process or job IDs\n", arg)
+				exit = 1
+				continue
+			}
+			if r.fakePid(pid) {
+				if pid != r.bashPid() {
+					// Another subshell; we can't signal it.
+					r.errf("kill: (%d) - %v\n", pid, syscall.ESRCH)
+					exit = 1
+					continue
+				}
+				r.signalSelf(ctx, sig)
+				if r.shellExited {
+					return r.exit
+				}
+				continue
+			}
+			if err := signalProcess(pid, sig); err != nil {
+				r.errf("kill: (%d) - %v\n", pid, err)
+				exit = 1
+			}
+		}
+		return exit
 	case "builtin":
 		if len(args) < 1 {
 			break
 		}
-		if !isBuiltin(args[0]) {
+		if !r.isBuiltin(args[0]) {
 			return 1
 		}
 		return r.builtinCode(ctx, pos, args[0], args[1:])
@@ -260,7 +621,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		args := fp.args()
 		for _, arg := range args {
 			if mode == "-p" {
-				if path, err := LookPathDir(r.Dir, r.writeEnv, arg); err == nil {
+				if path, err := r.lookPath(arg); err == nil {
 					r.outf("%s\n", path)
 				} else {
 					anyNotFound = true
@@ -301,7 +662,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				}
 				continue
 			}
-			if isBuiltin(arg) {
+			if r.isBuiltin(arg) {
 				if mode == "-t" {
 					r.out("builtin\n")
 				} else {
@@ -309,7 +670,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				}
 				continue
 			}
-			if path, err := LookPathDir(r.Dir, r.writeEnv, arg); err == nil {
+			if path, err := r.lookPath(arg); err == nil {
 				if mode == "-t" {
 					r.out("file\n")
 				} else {
@@ -333,14 +694,14 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("eval: %v\n", err)
 			return 1
 		}
-		r.stmts(ctx, file.Stmts)
+		r.stmtsNotCovered(ctx, file.Stmts)
 		return r.exit
 	case "source", ".":
 		if len(args) < 1 {
 			r.errf("%v: source: need filename\n", pos)
 			return 2
 		}
-		path, err := scriptFromPathDir(r.Dir, r.writeEnv, args[0])
+		path, err := scriptFromPathDir(r.fs, r.Dir, r.writeEnv, args[0])
 		if err != nil {
 			// If the script was not found in PATH or there was any error, pass
 			// the source path to the open handler so it has a chance to look
@@ -355,7 +716,8 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		defer f.Close()
 		p := syntax.NewParser()
-		file, err := p.Parse(f, path)
+		// Like Bash, name the file as given, such as for BASH_SOURCE.
+		file, err := p.Parse(f, args[0])
 		if err != nil {
 			r.errf("source: %v\n", err)
 			return 1
@@ -377,7 +739,14 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		// parameters.
 		r.sourceSetParams = false
 		r.inSource = true // know that we're inside a sourced script.
+		oldCoverFile := r.coverFile
+		if r.coverage != nil {
+			r.coverFile = r.coverage.addFile(file)
+		}
+		r.pushFrame(pos, "source", file.Name)
 		r.stmts(ctx, file.Stmts)
+		r.popFrame()
+		r.coverFile = oldCoverFile
 
 		// If we modified the parameters and the sourced file didn't
 		// explicitly set them, we restore the old ones.
@@ -389,8 +758,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 
 		if code, ok := r.err.(returnStatus); ok {
 			r.err = nil
-			return int(code)
+			r.exit = int(code)
 		}
+		r.runTrap(ctx, "RETURN")
 		return r.exit
 	case "[":
 		if len(args) == 0 || args[len(args)-1] != "]" {
@@ -415,14 +785,21 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		return oneIf(r.bashTest(ctx, expr, true) == "")
 	case "exec":
-		// TODO: Consider unix.Exec, i.e. actually replacing
-		// the process. It's in theory what a shell should do,
-		// but in practice it would kill the entire Go process
-		// and it's not available on Windows.
+		// By default, we don't replace the process, as it would kill the
+		// entire Go program and it's not available on Windows.
 		if len(args) == 0 {
 			r.keepRedirs = true
 			break
 		}
+		if r.realExec && runtime.GOOS != "windows" {
+			// The exec handlers still apply, and DefaultExecHandler
+			// replaces the process if it's reached.
+			r.replacingProcess = true
+			r.exec(ctx, args)
+			r.replacingProcess = false
+			r.exitShell(ctx, r.exit)
+			return r.exit
+		}
 		r.exitShell(ctx, 1)
 		r.exec(ctx, args)
 		return r.exit
@@ -443,7 +820,10 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			break
 		}
 		if !show {
-			if isBuiltin(args[0]) {
+			if r.restrictedCommand(pos, args[0]) {
+				return 1
+			}
+			if r.isBuiltin(args[0]) {
 				return r.builtinCode(ctx, pos, args[0], args[1:])
 			}
 			r.exec(ctx, args)
@@ -452,9 +832,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		last := 0
 		for _, arg := range args {
 			last = 0
-			if r.Funcs[arg] != nil || isBuiltin(arg) {
+			if r.Funcs[arg] != nil || r.isBuiltin(arg) {
 				r.outf("%s\n", arg)
-			} else if path, err := LookPathDir(r.Dir, r.writeEnv, arg); err == nil {
+			} else if path, err := r.lookPath(arg); err == nil {
 				r.outf("%s\n", path)
 			} else {
 				last = 1
@@ -553,16 +933,90 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			return 2
 		}
 		r.setErr(returnStatus(code))
+	case "caller":
+		// The innermost frame is the one calling us, so skip it.
+		callers := r.callStack(pos)[1:]
+		if len(callers) == 0 && r.frameFile == "" {
+			return 1 // nothing to report, like FUNCNAME being unset
+		}
+		if len(args) == 0 {
+			if len(callers) == 0 {
+				// Like Bash at the top level of a script file.
+				r.outf("0 NULL\n")
+				break
+			}
+			r.outf("%d %s\n", callers[0].Pos.Line(), callers[0].File)
+			break
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			r.errf("caller: %s: invalid number\n", args[0])
+			r.errf("caller: usage: caller [expr]\n")
+			return 2
+		}
+		if n >= len(callers) {
+			return 1
+		}
+		frame := callers[n]
+		r.outf("%d %s %s\n", frame.Pos.Line(), frame.Func, frame.File)
 	case "read":
-		var prompt string
-		raw := false
+		var prompt, arrayName, initial string
+		opts := readOpts{delim: '\n'}
+		timeout, nchars := -1.0, -1
+		silent, edit := false, false
+		in := r.stdin
 		fp := flagParser{remaining: args}
 		for fp.more() {
-			switch flag := fp.flag(); flag {
+			flag := fp.flag()
+			value := ""
+			switch flag {
+			case "-a", "-d", "-i", "-n", "-N", "-p", "-t", "-u":
+				if len(fp.remaining) == 0 {
+					r.errf("read: %s: option requires an argument\n", flag)
+					return 2
+				}
+				value = fp.value()
+			}
+			switch flag {
 			case "-r":
-				raw = true
+				opts.raw = true
+			case "-s":
+				silent = true
+			case "-e":
+				edit = true
+			case "-a":
+				arrayName = value
+			case "-d":
+				opts.delim = 0 // an empty delimiter means NUL
+				if value != "" {
+					opts.delim = value[0]
+				}
+			case "-i":
+				initial = value
+			case "-n", "-N":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					r.errf("read: %s: invalid number\n", value)
+					return 1
+				}
+				nchars = n
+				opts.exact = flag == "-N"
+			case "-t":
+				t, err := strconv.ParseFloat(value, 64)
+				if err != nil || t < 0 {
+					r.errf("read: %s: invalid timeout specification\n", value)
+					return 1
+				}
+				timeout = t
+			case "-u":
+				e := r.lookupFd(value)
+				if e == nil || e.reader == nil {
+					r.errf("read: %s: invalid file descriptor: bad file descriptor\n", value)
+					return 1
+				}
+				in = e.reader
 			case "-p":
-				prompt = fp.value()
+				prompt = value
 				if prompt == "" {
 					r.errf("read: -p: option requires an argument\n")
 					return 2
@@ -574,6 +1028,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 
 		args := fp.args()
+		if arrayName != "" {
+			args = append([]string{arrayName}, args...)
+		}
 		for _, name := range args {
 			if !syntax.ValidName(name) {
 				r.errf("read: invalid identifier %q\n", name)
@@ -581,27 +1038,203 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			}
 		}
 
-		if prompt != "" {
-			r.out(prompt)
+		if timeout == 0 {
+			// Only check whether there is any input to read.
+			if r.inputReady(in) {
+				return 0
+			}
+			return 1
+		}
+		if timeout > 0 {
+			opts.timeout = time.Duration(timeout * float64(time.Second))
+		}
+		if nchars > 0 {
+			opts.nchars = nchars
 		}
 
-		line, err := r.readLine(raw)
-		if err != nil {
+		var line []byte
+		var err error
+		switch f, _ := in.(*os.File); {
+		case nchars == 0:
+			// Nothing to read, but the variables are still assigned.
+		case f != nil && edit && term.IsTerminal(int(f.Fd())) &&
+			timeout < 0 && nchars < 0 && opts.delim == '\n' && ctx.Done() == nil:
+			// Line editing doesn't support timeouts, character counts,
+			// delimiters, nor cancellation; the plain reader does.
+			line, err = r.readLineEdit(f, prompt, initial, silent)
+		default:
+			if prompt != "" {
+				r.out(prompt)
+			}
+			if f != nil && silent {
+				restore := disableEcho(f)
+				line, err = r.readLine(ctx, in, opts)
+				restore()
+			} else {
+				line, err = r.readLine(ctx, in, opts)
+			}
+		}
+		switch {
+		case err == errReadTimeout, err == io.EOF:
+			// Like Bash, assign any partial input before failing.
+		case err != nil:
 			return 1
 		}
-		if len(args) == 0 {
-			args = append(args, "REPLY")
+
+		switch {
+		case arrayName != "":
+			values := expand.ReadFields(r.ecfg, string(line), -1, opts.raw)
+			r.setVar(arrayName, nil, expand.Variable{Kind: expand.Indexed, List: values})
+		case opts.exact:
+			name := "REPLY"
+			if len(args) > 0 {
+				name = args[0]
+			}
+			if !opts.raw {
+				line = unescapeRead(line)
+			}
+			r.setVarString(name, string(line))
+		default:
+			if len(args) == 0 {
+				args = append(args, "REPLY")
+			}
+			values := expand.ReadFields(r.ecfg, string(line), len(args), opts.raw)
+			for i, name := range args {
+				val := ""
+				if i < len(values) {
+					val = values[i]
+				}
+				r.setVarString(name, val)
+			}
+		}
+
+		switch err {
+		case errReadTimeout:
+			return 128 + int(syscall.SIGALRM)
+		case io.EOF:
+			return 1
 		}
+		return 0
 
-		values := expand.ReadFields(r.ecfg, string(line), len(args), raw)
-		for i, name := range args {
-			val := ""
-			if i < len(values) {
-				val = values[i]
+	case "mapfile", "readarray":
+		opts := readOpts{raw: true, delim: '\n'}
+		trim := false
+		count, origin, skip := 0, -1, 0
+		callback, quantum := "", 5000
+		in := r.stdin
+		fp := flagParser{remaining: args}
+		for fp.more() {
+			flag := fp.flag()
+			value := ""
+			switch flag {
+			case "-d", "-n", "-O", "-s", "-u", "-C", "-c":
+				if len(fp.remaining) == 0 {
+					r.errf("%s: %s: option requires an argument\n", name, flag)
+					return 2
+				}
+				value = fp.value()
 			}
-			r.setVarString(name, val)
+			switch flag {
+			case "-t":
+				trim = true
+			case "-d":
+				opts.delim = 0 // an empty delimiter means NUL
+				if value != "" {
+					opts.delim = value[0]
+				}
+			case "-n", "-s":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					r.errf("%s: %s: invalid line count\n", name, value)
+					return 1
+				}
+				if flag == "-n" {
+					count = n
+				} else {
+					skip = n
+				}
+			case "-O":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					r.errf("%s: %s: invalid array origin\n", name, value)
+					return 1
+				}
+				origin = n
+			case "-u":
+				e := r.lookupFd(value)
+				if e == nil || e.reader == nil {
+					r.errf("%s: %s: invalid file descriptor: bad file descriptor\n", name, value)
+					return 1
+				}
+				in = e.reader
+			case "-C":
+				callback = value
+			case "-c":
+				n, err := strconv.Atoi(value)
+				if err != nil || n <= 0 {
+					r.errf("%s: %s: invalid callback quantum\n", name, value)
+					return 1
+				}
+				quantum = n
+			default:
+				r.errf("%s: invalid option %q\n", name, flag)
+				return 2
+			}
+		}
+		arrayName := "MAPFILE"
+		if args := fp.args(); len(args) > 0 {
+			arrayName = args[0]
+		}
+		if !syntax.ValidName(arrayName) {
+			r.errf("%s: invalid identifier %q\n", name, arrayName)
+			return 1
 		}
 
+		// Like Bash, the array is emptied unless an origin is given.
+		var list []string
+		if origin < 0 {
+			origin = 0
+		} else if vr := r.lookupVar(arrayName); vr.Kind == expand.Indexed {
+			list = append(list, vr.List...)
+		}
+		r.setVar(arrayName, nil, expand.Variable{Kind: expand.Indexed, List: list})
+
+		for lines := 0; count == 0 || lines < count+skip; lines++ {
+			line, err := r.readLine(ctx, in, opts)
+			if err == nil && !trim {
+				line = append(line, opts.delim)
+			}
+			if err != nil && (err != io.EOF || len(line) == 0) {
+				break
+			}
+			if lines < skip {
+				continue
+			}
+			index := origin + lines - skip
+			if callback != "" && (lines-skip+1)%quantum == 0 {
+				// Like Bash, the index and line are appended as
+				// arguments to the callback, which is then evaluated.
+				quoted, err := syntax.Quote(string(line), syntax.LangBash)
+				if err != nil {
+					quoted = quoteTrap(string(line))
+				}
+				src := callback + " " + strconv.Itoa(index) + " " + quoted
+				file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+				if err != nil {
+					r.errf("%s: %v\n", name, err)
+					return 1
+				}
+				r.stmtsNotCovered(ctx, file.Stmts)
+			}
+			for len(list) <= index {
+				list = append(list, "")
+			}
+			list[index] = string(line)
+			r.setVar(arrayName, nil, expand.Variable{Kind: expand.Indexed, List: list})
+			if err != nil {
+				break
+			}
+		}
 		return 0
 
 	case "getopts":
@@ -674,7 +1307,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				break
 			}
 			for i, opt := range &shellOptsTable {
-				r.printOptLine(opt.name, r.opts[i])
+				if opt.name != "" {
+					r.printOptLine(opt.name, r.opts[i])
+				}
 			}
 			break
 		}
@@ -753,14 +1388,16 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 
 	case "trap":
 		fp := flagParser{remaining: args}
-		callback := "-"
+		list, print := false, false
 		for fp.more() {
+			if fp.current == "" && fp.remaining[0] == "-" {
+				break // resetting signals to their defaults
+			}
 			switch flag := fp.flag(); flag {
-			case "-l", "-p":
-				r.errf("trap: %q: NOT IMPLEMENTED flag\n", flag)
-				return 2
-			case "-":
-				// default signal
+			case "-l":
+				list = true
+			case "-p":
+				print = true
 			default:
 				r.errf("trap: %q: invalid option\n", flag)
 				r.errf("trap: usage: trap [-lp] [[arg] signal_spec ...]\n")
@@ -768,44 +1405,199 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			}
 		}
 		args := fp.args()
-		switch len(args) {
-		case 0:
-			// Print non-default signals
-			if r.callbackExit != "" {
-				r.outf("trap -- %q EXIT\n", r.callbackExit)
+		if list {
+			r.printSignalList()
+			return 0
+		}
+		exit := 0
+		if print || len(args) == 0 {
+			names := trapNames()
+			if len(args) > 0 {
+				names = names[:0]
+				for _, arg := range args {
+					name, ok := parseTrapSpec(arg)
+					if !ok {
+						r.errf("trap: %s: invalid signal specification\n", arg)
+						exit = 2
+						continue
+					}
+					names = append(names, name)
+				}
 			}
-			if r.callbackErr != "" {
-				r.outf("trap -- %q ERR\n", r.callbackErr)
+			for _, name := range names {
+				if callback, ok := r.getTrap(name); ok {
+					r.outf("trap -- %s %s\n", quoteTrap(callback), trapDisplayName(name))
+				}
 			}
-		case 1:
-			// assume it's a signal, the default will be restored
-		default:
+			return exit
+		}
+		// Like Bash, a single argument or a first argument which is a
+		// signal number means that the signals are reset.
+		callback := "-"
+		if _, err := strconv.ParseUint(args[0], 10, 32); err != nil && len(args) > 1 {
 			callback = args[0]
 			args = args[1:]
 		}
-		// For now, treat both empty and - the same since ERR and EXIT have no
-		// default callback.
-		if callback == "-" {
-			callback = ""
-		}
 		for _, arg := range args {
-			switch arg {
-			case "ERR":
-				r.callbackErr = callback
-			case "EXIT":
-				r.callbackExit = callback
-			default:
+			name, ok := parseTrapSpec(arg)
+			if !ok {
 				r.errf("trap: %s: invalid signal specification\n", arg)
+				exit = 2
+				continue
+			}
+			if callback == "-" {
+				r.resetTrap(name)
+			} else {
+				r.setTrap(name, callback)
+			}
+		}
+		return exit
+	case "umask":
+		symbolic, printCmd := false, false
+		fp := flagParser{remaining: args}
+		for fp.more() {
+			if fp.current == "" && fp.remaining[0][0] == '+' {
+				break // a symbolic mode like "+x"
+			}
+			switch flag := fp.flag(); flag {
+			case "-S":
+				symbolic = true
+			case "-p":
+				printCmd = true
+			default:
+				r.errf("umask: invalid option %q\n", flag)
 				return 2
 			}
 		}
+		args := fp.args()
+		if len(args) == 0 {
+			str := fmt.Sprintf("%04o", uint32(r.umask))
+			if symbolic {
+				str = umaskSymbolic(r.umask)
+			}
+			switch {
+			case printCmd && symbolic:
+				r.outf("umask -S %s\n", str)
+			case printCmd:
+				r.outf("umask %s\n", str)
+			default:
+				r.outf("%s\n", str)
+			}
+			return 0
+		}
+		mode := args[0]
+		if mode == "" {
+			r.errf("umask: invalid symbolic mode\n")
+			return 1
+		}
+		if mode[0] >= '0' && mode[0] <= '9' {
+			n, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil || n > 0o777 {
+				r.errf("umask: %s: octal number out of range\n", mode)
+				return 1
+			}
+			r.umask = os.FileMode(n)
+		} else {
+			mask, err := parseUmaskSymbolic(r.umask, mode)
+			if err != nil {
+				r.errf("umask: %v\n", err)
+				return 1
+			}
+			r.umask = mask
+		}
+		if symbolic {
+			r.outf("%s\n", umaskSymbolic(r.umask))
+		}
+	case "ulimit":
+		return r.ulimit(args)
 	default:
-		// "umask", "fg", "bg",
 		panic(fmt.Sprintf("unhandled builtin: %s", name))
 	}
 	return 0
 }
 
+// umaskSymbolic formats a umask like "umask -S", showing the permissions which
+// it allows, such as "u=rwx,g=rx,o=rx".
+func umaskSymbolic(mask os.FileMode) string {
+	var b strings.Builder
+	for i, who := range "ugo" {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(who)
+		b.WriteByte('=')
+		shift := uint(6 - 3*i)
+		for j, perm := range "rwx" {
+			if mask&(1<<(shift+2-uint(j))) == 0 {
+				b.WriteRune(perm)
+			}
+		}
+	}
+	return b.String()
+}
+
+// parseUmaskSymbolic applies a symbolic mode like "u=rwx,g-w,o+r" to a umask.
+// As with chmod(1), the mode describes the permissions to allow, so it clears
+// the bits in the umask.
+func parseUmaskSymbolic(mask os.FileMode, mode string) (os.FileMode, error) {
+	allowed := ^mask & 0o777
+	for _, clause := range strings.Split(mode, ",") {
+		var who os.FileMode
+		i := 0
+	who:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 0o700
+			case 'g':
+				who |= 0o070
+			case 'o':
+				who |= 0o007
+			case 'a':
+				who |= 0o777
+			default:
+				break who
+			}
+		}
+		if who == 0 {
+			who = 0o777
+		}
+		if i == len(clause) {
+			return 0, fmt.Errorf("`%s': invalid symbolic mode operator", clause)
+		}
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return 0, fmt.Errorf("`%c': invalid symbolic mode operator", op)
+			}
+			i++
+			var perms os.FileMode
+			for ; i < len(clause) && strings.IndexByte("+-=", clause[i]) < 0; i++ {
+				switch c := clause[i]; c {
+				case 'r':
+					perms |= 0o444
+				case 'w':
+					perms |= 0o222
+				case 'x':
+					perms |= 0o111
+				default:
+					return 0, fmt.Errorf("`%c': invalid symbolic mode character", c)
+				}
+			}
+			perms &= who
+			switch op {
+			case '+':
+				allowed |= perms
+			case '-':
+				allowed &^= perms
+			case '=':
+				allowed = allowed&^who | perms
+			}
+		}
+	}
+	return ^allowed & 0o777, nil
+}
+
 func (r *Runner) printOptLine(name string, enabled bool) {
 	status := "off"
 	if enabled {
@@ -814,41 +1606,242 @@ func (r *Runner) printOptLine(name string, enabled bool) {
 	r.outf("%s\t%s\n", name, status)
 }
 
-func (r *Runner) readLine(raw bool) ([]byte, error) {
-	if r.stdin == nil {
+// readOpts holds the options for Runner.readLine, as set by the flags of the
+// read builtin.
+type readOpts struct {
+	raw    bool // don't treat backslashes as escape characters
+	delim  byte // the byte ending the line
+	nchars int  // if non-zero, the maximum number of characters to read
+	exact  bool // read exactly nchars characters, ignoring delim
+
+	timeout time.Duration // if non-zero, fail with errReadTimeout after it
+}
+
+var errReadTimeout = errors.New("read timed out")
+
+// readLine reads a line from in, up to and excluding the delimiter. Unless
+// opts.raw is set, backslashes are kept in the line so that the fields can be
+// split later via expand.ReadFields, but escaped newlines are removed as line
+// continuations.
+//
+// If the input ends or the timeout is reached before the line is complete,
+// what was read is returned alongside io.EOF or errReadTimeout respectively.
+func (r *Runner) readLine(ctx context.Context, in io.Reader, opts readOpts) ([]byte, error) {
+	if in == nil {
 		return nil, errors.New("interp: can't read, there's no stdin")
 	}
+	var deadline <-chan time.Time
+	if opts.timeout > 0 {
+		timer := time.NewTimer(opts.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	pr := r.startRead(ctx, in, deadline)
+	if pr != nil {
+		defer r.stopRead(pr)
+	}
 
 	var line []byte
 	esc := false
-
+	nchars := 0
+	runeStart := 0 // where the last character starts in line
 	for {
-		var buf [1]byte
-		n, err := r.stdin.Read(buf[:])
-		if n > 0 {
-			b := buf[0]
-			switch {
-			case !raw && b == '\\':
-				line = append(line, b)
-				esc = !esc
-			case !raw && b == '\n' && esc:
-				// line continuation
-				line = line[len(line)-1:]
-				esc = false
-			case b == '\n':
-				return line, nil
-			default:
-				line = append(line, b)
-				esc = false
-			}
+		if opts.nchars > 0 && nchars >= opts.nchars && utf8.FullRune(line[runeStart:]) {
+			return line, nil
 		}
-		if err == io.EOF && len(line) > 0 {
+		b, err := r.readByte(ctx, pr, in, deadline)
+		if err != nil {
+			return line, err
+		}
+		switch {
+		case !opts.raw && b == '\\' && !esc:
+			line = append(line, b)
+			esc = true
+			continue
+		case !opts.raw && b == '\n' && esc:
+			// line continuation
+			line = line[:len(line)-1]
+			esc = false
+			continue
+		case b == opts.delim && !esc && !opts.exact:
 			return line, nil
 		}
+		esc = false
+		if !utf8.RuneStart(b) && len(line) > runeStart {
+			line = append(line, b) // continuing a multibyte character
+			continue
+		}
+		runeStart = len(line)
+		line = append(line, b)
+		nchars++
+	}
+}
+
+// pendingRead reads single bytes from a reader in the background, one at a
+// time as requested via next, so that reads can be interrupted.
+type pendingRead struct {
+	in      io.Reader
+	next    chan struct{}
+	done    chan readResult
+	reading bool // whether a byte was requested and not received yet
+}
+
+type readResult struct {
+	b   byte
+	err error
+}
+
+// startRead prepares to read a line from in. If the read needs to be
+// interrupted when the context is cancelled or the deadline is reached, a
+// goroutine is started to read in the background, which must be stopped via
+// stopRead. Otherwise, nil is returned.
+//
+// If a previous read from the same input was interrupted while a byte was
+// still being read, it is continued, so that the byte isn't lost.
+func (r *Runner) startRead(ctx context.Context, in io.Reader, deadline <-chan time.Time) *pendingRead {
+	if pr := r.pendingRead; pr != nil {
+		r.pendingRead = nil
+		if sameReader(pr.in, in) {
+			return pr
+		}
+		close(pr.next) // the byte being read is lost
+	}
+	if ctx.Done() == nil && deadline == nil {
+		return nil
+	}
+	pr := &pendingRead{
+		in:   in,
+		next: make(chan struct{}, 1),
+		done: make(chan readResult, 1),
+	}
+	go func() {
+		for range pr.next {
+			b, err := readOneByte(in)
+			pr.done <- readResult{b, err}
+		}
+	}()
+	return pr
+}
+
+// stopRead stops the goroutine started by startRead, unless a byte is still
+// being read, in which case it is left pending for the next read.
+func (r *Runner) stopRead(pr *pendingRead) {
+	if pr.reading {
+		r.pendingRead = pr
+		return
+	}
+	close(pr.next)
+}
+
+// readByte reads a single byte from in, so that the read builtin doesn't
+// consume any input past the end of the line, like Bash does. If pr is not
+// nil, the byte is read in the background via pr; see startRead.
+func (r *Runner) readByte(ctx context.Context, pr *pendingRead, in io.Reader, deadline <-chan time.Time) (byte, error) {
+	if pr == nil {
+		return readOneByte(in)
+	}
+	if !pr.reading {
+		pr.next <- struct{}{}
+		pr.reading = true
+	}
+	select {
+	case res := <-pr.done:
+		pr.reading = false
+		return res.b, res.err
+	case <-deadline:
+		return 0, errReadTimeout
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// sameReader reports whether two readers are the same, without panicking on
+// those which can't be compared, which are never the same.
+func sameReader(a, b io.Reader) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	return ta == tb && ta != nil && ta.Comparable() && a == b
+}
+
+func readOneByte(in io.Reader) (byte, error) {
+	var buf [1]byte
+	for {
+		n, err := in.Read(buf[:])
+		if n > 0 {
+			return buf[0], nil
+		}
 		if err != nil {
-			return nil, err
+			return 0, err
+		}
+	}
+}
+
+// inputReady reports whether there is input available to read from in,
+// for "read -t 0". Readers other than files are always considered ready.
+func (r *Runner) inputReady(in io.Reader) bool {
+	if pr := r.pendingRead; pr != nil && sameReader(pr.in, in) {
+		select {
+		case res := <-pr.done:
+			pr.done <- res // put it back for the next read
+			return true
+		default:
+			return false
+		}
+	}
+	if f, ok := in.(*os.File); ok {
+		return fileReady(f)
+	}
+	return in != nil
+}
+
+// unescapeRead removes the backslashes used as escape characters from a line
+// returned by readLine, for "read -N" which doesn't split fields.
+func unescapeRead(line []byte) []byte {
+	var res []byte
+	esc := false
+	for _, b := range line {
+		if b == '\\' && !esc {
+			esc = true
+			continue
 		}
+		res = append(res, b)
+		esc = false
+	}
+	return res
+}
+
+// readLineEdit reads a line from a terminal with line editing, for "read -e".
+// The initial text is inserted as if it had been typed.
+func (r *Runner) readLineEdit(f *os.File, prompt, initial string, silent bool) ([]byte, error) {
+	state, err := term.MakeRaw(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	defer term.Restore(int(f.Fd()), state)
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{io.MultiReader(strings.NewReader(initial), oneByteReader{f}), r.stderr}
+	t := term.NewTerminal(rw, prompt)
+	var line string
+	if silent {
+		line, err = t.ReadPassword(prompt)
+	} else {
+		line, err = t.ReadLine()
+	}
+	return []byte(line), err
+}
+
+// oneByteReader reads one byte at a time, so that a terminal reading a line
+// doesn't consume any of the input after it.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
 	}
+	return o.r.Read(p)
 }
 
 func (r *Runner) changeDir(path string) int {
@@ -0,0 +1,185 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock sets the function used by the interpreter to get the current time,
+// time.Now by default. Together with Random and ProcessIDs, it allows running
+// scripts in a reproducible way, such as for golden file tests.
+//
+// The clock is used by the time keyword, by $SECONDS, $EPOCHSECONDS, and
+// $EPOCHREALTIME, by printf's "%(datefmt)T" format without a time argument, and
+// by JSONTrace. So that "test -nt" and "test -ot" are reproducible too, the
+// files opened for writing via redirections, such as in "echo foo >file" or
+// "exec 3>file", are given a virtual modification time from the clock when
+// they are opened. The virtual times are only seen by the Runner and its
+// subshells; the files on disk are left untouched.
+//
+// Note that the clock does not affect the programs run by the exec handler,
+// including the files they write, nor resource limits such as
+// ResourceLimits.MaxWallTime.
+func Clock(now func() time.Time) RunnerOption {
+	return func(r *Runner) error {
+		r.clock = now
+		return nil
+	}
+}
+
+// Random sets the source of random numbers used for $RANDOM and $SRANDOM, as
+// well as to name temporary files such as those for process substitutions.
+// By default, $RANDOM uses a source seeded with the current time, and $SRANDOM
+// uses crypto/rand.
+//
+// Like in Bash, assigning to $RANDOM seeds a new source, and subshells use
+// their own sources, which are seeded from their parent shell's.
+func Random(src rand.Source) RunnerOption {
+	return func(r *Runner) error {
+		r.randSource = src
+		return nil
+	}
+}
+
+// ProcessIDs sets the process IDs reported by the interpreter as $$ and $PPID,
+// which default to the ones of the current process and its parent. A zero
+// value keeps the default. The fake process IDs of subshells, as found in
+// $BASHPID, follow the one in $$ when it is set.
+//
+// The kill builtin never sends signals to real processes with these fake IDs.
+// A shell sending a signal to its own $$ or $BASHPID handles it as if it had
+// received it, and any other fake ID, like $PPID, fails with "no such process".
+func ProcessIDs(pid, ppid int) RunnerOption {
+	return func(r *Runner) error {
+		r.shellPid, r.shellPpid = pid, ppid
+		return nil
+	}
+}
+
+// now returns the current time, as given by the clock.
+func (r *Runner) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// random returns the generator of random numbers, such as for $RANDOM. It is
+// created lazily, as most shells never need it.
+func (r *Runner) random() *rand.Rand {
+	if r.rand == nil {
+		if r.randSeed == 0 && r.randSource != nil {
+			r.rand = rand.New(r.randSource)
+		} else {
+			r.rand = rand.New(rand.NewSource(r.randSeed))
+		}
+	}
+	return r.rand
+}
+
+// subshellSeed returns the seed for a new subshell's generator of random
+// numbers, derived from this shell's without having to create its generator.
+func (r *Runner) subshellSeed() int64 {
+	if r.randSeed == 0 {
+		// The main shell, using the source given to Random.
+		return r.random().Int63()
+	}
+	r.randSubshells++
+	// SplitMix64, to get well distributed seeds from sequential inputs.
+	z := uint64(r.randSeed) + r.randSubshells*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64((z ^ (z >> 31)) >> 1)
+}
+
+// mainPid returns the process ID of the main shell, as found in $$.
+func (r *Runner) mainPid() int {
+	if r.shellPid != 0 {
+		return r.shellPid
+	}
+	return os.Getpid()
+}
+
+// parentPid returns the process ID of the main shell's parent, as found in
+// $PPID.
+func (r *Runner) parentPid() int {
+	if r.shellPpid != 0 {
+		return r.shellPpid
+	}
+	return os.Getppid()
+}
+
+// bashPid returns the process ID of the current shell, as found in $BASHPID,
+// which is a fake one in subshells.
+func (r *Runner) bashPid() int {
+	if r.pid != 0 {
+		return r.pid
+	}
+	return r.mainPid()
+}
+
+// fakePidBase follows the first fake process ID given to a subshell, unless
+// ProcessIDs is used. It is the maximum process ID on Linux, so that fake ones
+// don't match real processes.
+const fakePidBase = 1 << 22
+
+// pidBase follows the first fake process ID given to a subshell.
+func (r *Runner) pidBase() int {
+	if r.shellPid != 0 {
+		return r.shellPid
+	}
+	return fakePidBase
+}
+
+// newSubshellPid returns a new fake process ID for a subshell.
+func (r *Runner) newSubshellPid() int {
+	return r.pidBase() + int(atomic.AddUint32(r.subshells, 1))
+}
+
+// fakePid reports whether pid is a process ID made up by the interpreter, such
+// as $BASHPID in a subshell, or $$ and $PPID when set via ProcessIDs. The kill
+// builtin never signals real processes with these IDs.
+func (r *Runner) fakePid(pid int) bool {
+	if pid != 0 && (pid == r.shellPid || pid == r.shellPpid) {
+		return true
+	}
+	base := r.pidBase()
+	return pid > base && pid <= base+int(atomic.LoadUint32(r.subshells))
+}
+
+// virtualMtimes holds the modification times of the files written via
+// redirections while a clock is set, keyed by absolute path. It is shared with
+// subshells, hence the lock.
+type virtualMtimes struct {
+	mu     sync.Mutex
+	mtimes map[string]time.Time
+}
+
+// wroteFile records that a file was opened for writing via a redirection.
+func (r *Runner) wroteFile(path string) {
+	if r.mtimes == nil {
+		return
+	}
+	r.mtimes.mu.Lock()
+	defer r.mtimes.mu.Unlock()
+	r.mtimes.mtimes[r.absPath(path)] = r.now()
+}
+
+// modTime returns the modification time of a file, which is the virtual one if
+// it was written via a redirection while a clock is set.
+func (r *Runner) modTime(path string, info os.FileInfo) time.Time {
+	if r.mtimes != nil {
+		r.mtimes.mu.Lock()
+		defer r.mtimes.mu.Unlock()
+		if t, ok := r.mtimes.mtimes[r.absPath(path)]; ok {
+			return t
+		}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// CoverageProfile records which statements and branches of shell scripts are
+// run. Branches are the two outcomes of each "if" and "elif" condition, the
+// patterns of each "case" plus not matching any of them, and whether the
+// right side of each "&&" and "||" is run.
+//
+// The files given to Run and the ones loaded via the source builtin are added
+// to the profile automatically, and AddFile can be used to add others. Code
+// which isn't part of a file, such as with eval or trap, is not recorded.
+//
+// A CoverageProfile is safe for concurrent use, and it can be shared by many
+// Runners.
+type CoverageProfile struct {
+	mu    sync.Mutex
+	files map[string]*fileCoverage
+}
+
+// fileCoverage holds the counters for a file. Its nodes are keyed by their
+// start and end offsets, so that sourcing a file multiple times uses the same
+// counters without keeping each parsed syntax tree around.
+type fileCoverage struct {
+	name     string
+	stmts    map[[2]uint]*coverBlock
+	branches map[[2]uint]*coverBlock
+	funcs    map[uint]*coverFunc
+}
+
+// coverBlock counts how many times a statement or each branch of a branching
+// node was run.
+type coverBlock struct {
+	pos    syntax.Pos
+	counts []int
+}
+
+type coverFunc struct {
+	name string
+	line uint
+	body *coverBlock
+}
+
+// NewCoverageProfile creates an empty coverage profile.
+func NewCoverageProfile() *CoverageProfile {
+	return &CoverageProfile{files: make(map[string]*fileCoverage)}
+}
+
+// Coverage records the coverage of the code run by the Runner in a profile.
+// A nil profile disables the recording.
+func Coverage(p *CoverageProfile) RunnerOption {
+	return func(r *Runner) error {
+		r.coverage = p
+		return nil
+	}
+}
+
+// AddFile adds a file to the profile, so that its statements which don't get
+// run are reported too. Adding a file with the same name again, such as when
+// sourcing a file multiple times, uses the same counters.
+func (p *CoverageProfile) AddFile(f *syntax.File) {
+	p.addFile(f)
+}
+
+// addFile is like AddFile, but it also returns the file's counters.
+func (p *CoverageProfile) addFile(f *syntax.File) *fileCoverage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fc := p.files[f.Name]
+	if fc == nil {
+		fc = &fileCoverage{
+			name:     f.Name,
+			stmts:    make(map[[2]uint]*coverBlock),
+			branches: make(map[[2]uint]*coverBlock),
+			funcs:    make(map[uint]*coverFunc),
+		}
+		p.files[f.Name] = fc
+	}
+	syntax.Walk(f, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.Stmt:
+			addBlock(fc.stmts, x, x.Pos(), 1)
+		case *syntax.FuncDecl:
+			body := addBlock(fc.stmts, x.Body, x.Body.Pos(), 1)
+			if fc.funcs[x.Pos().Offset()] == nil {
+				fc.funcs[x.Pos().Offset()] = &coverFunc{
+					name: x.Name.Value,
+					line: x.Pos().Line(),
+					body: body,
+				}
+			}
+		case *syntax.IfClause:
+			if len(x.Cond) > 0 { // not an "else"
+				addBlock(fc.branches, x, x.Position, 2)
+			}
+		case *syntax.CaseClause:
+			addBlock(fc.branches, x, x.Case, len(x.Items)+1)
+		case *syntax.BinaryCmd:
+			if x.Op == syntax.AndStmt || x.Op == syntax.OrStmt {
+				addBlock(fc.branches, x, x.OpPos, 2)
+			}
+		}
+		return true
+	})
+	return fc
+}
+
+func addBlock(blocks map[[2]uint]*coverBlock, node syntax.Node, pos syntax.Pos, n int) *coverBlock {
+	key := blockKey(node)
+	b := blocks[key]
+	if b == nil || len(b.counts) != n {
+		b = &coverBlock{pos: pos, counts: make([]int, n)}
+		blocks[key] = b
+	}
+	return b
+}
+
+func blockKey(node syntax.Node) [2]uint {
+	return [2]uint{node.Pos().Offset(), node.End().Offset()}
+}
+
+// hit records that a statement, or a branch of a branching node, was run in
+// a file.
+func (p *CoverageProfile) hit(fc *fileCoverage, node syntax.Node, branch int) {
+	blocks := fc.branches
+	if _, ok := node.(*syntax.Stmt); ok {
+		blocks = fc.stmts
+	}
+	p.mu.Lock()
+	if b := blocks[blockKey(node)]; b != nil && branch < len(b.counts) {
+		b.counts[branch]++
+	}
+	p.mu.Unlock()
+}
+
+// cover records that a statement, or a branch of a branching node, was run.
+// Only the code which is part of a file is recorded; see Runner.coverFile.
+func (r *Runner) cover(node syntax.Node, branch int) {
+	if r.coverage != nil && r.coverFile != nil {
+		r.coverage.hit(r.coverFile, node, branch)
+	}
+}
+
+// coverFile is the summary of a file's coverage, sorted by line.
+type coverFile struct {
+	name     string
+	lines    []coverLine
+	branches []*coverBlock
+	funcs    []*coverFunc
+}
+
+type coverLine struct {
+	line, hits uint
+}
+
+// summary returns the coverage of each file, sorted by name.
+func (p *CoverageProfile) summary() []coverFile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var files []coverFile
+	for _, fc := range p.files {
+		cf := coverFile{name: fc.name}
+		// A line's hits are the most of any statement starting at it.
+		lines := make(map[uint]uint)
+		for _, b := range fc.stmts {
+			line := b.pos.Line()
+			if hits := uint(b.counts[0]); hits >= lines[line] {
+				lines[line] = hits
+			}
+		}
+		for line, hits := range lines {
+			cf.lines = append(cf.lines, coverLine{line, hits})
+		}
+		sort.Slice(cf.lines, func(i, j int) bool { return cf.lines[i].line < cf.lines[j].line })
+		for _, b := range fc.branches {
+			cf.branches = append(cf.branches, &coverBlock{pos: b.pos, counts: append([]int(nil), b.counts...)})
+		}
+		sort.Slice(cf.branches, func(i, j int) bool {
+			return cf.branches[i].pos.Offset() < cf.branches[j].pos.Offset()
+		})
+		for _, fn := range fc.funcs {
+			cf.funcs = append(cf.funcs, &coverFunc{
+				name: fn.name,
+				line: fn.line,
+				body: &coverBlock{counts: []int{fn.body.counts[0]}},
+			})
+		}
+		sort.Slice(cf.funcs, func(i, j int) bool { return cf.funcs[i].line < cf.funcs[j].line })
+		files = append(files, cf)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files
+}
+
+// reached reports whether any of the branches of a block were taken.
+func (b *coverBlock) reached() bool {
+	for _, n := range b.counts {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteLCOV writes the profile in the LCOV tracefile format, as used by tools
+// like genhtml.
+func (p *CoverageProfile) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, cf := range p.summary() {
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", cf.name)
+
+		fnHit := 0
+		for _, fn := range cf.funcs {
+			fmt.Fprintf(bw, "FN:%d,%s\n", fn.line, fn.name)
+		}
+		for _, fn := range cf.funcs {
+			fmt.Fprintf(bw, "FNDA:%d,%s\n", fn.body.counts[0], fn.name)
+			if fn.body.counts[0] > 0 {
+				fnHit++
+			}
+		}
+		fmt.Fprintf(bw, "FNF:%d\nFNH:%d\n", len(cf.funcs), fnHit)
+
+		brFound, brHit := 0, 0
+		for i, b := range cf.branches {
+			reached := b.reached()
+			for j, n := range b.counts {
+				taken := "-"
+				if reached {
+					taken = strconv.Itoa(n)
+				}
+				fmt.Fprintf(bw, "BRDA:%d,%d,%d,%s\n", b.pos.Line(), i, j, taken)
+				brFound++
+				if n > 0 {
+					brHit++
+				}
+			}
+		}
+		fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", brFound, brHit)
+
+		lineHit := 0
+		for _, l := range cf.lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l.line, l.hits)
+			if l.hits > 0 {
+				lineHit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(cf.lines), lineHit)
+	}
+	return bw.Flush()
+}
+
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        float64            `xml:"line-rate,attr"`
+	BranchRate      float64            `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      float64            `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   float64          `xml:"line-rate,attr"`
+	BranchRate float64          `xml:"branch-rate,attr"`
+	Complexity float64          `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string            `xml:"name,attr"`
+	Filename   string            `xml:"filename,attr"`
+	LineRate   float64           `xml:"line-rate,attr"`
+	BranchRate float64           `xml:"branch-rate,attr"`
+	Complexity float64           `xml:"complexity,attr"`
+	Methods    []coberturaMethod `xml:"methods>method"`
+	Lines      []coberturaLine   `xml:"lines>line"`
+}
+
+type coberturaMethod struct {
+	Name       string          `xml:"name,attr"`
+	Signature  string          `xml:"signature,attr"`
+	LineRate   float64         `xml:"line-rate,attr"`
+	BranchRate float64         `xml:"branch-rate,attr"`
+	Complexity float64         `xml:"complexity,attr"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number            uint   `xml:"number,attr"`
+	Hits              uint   `xml:"hits,attr"`
+	Branch            bool   `xml:"branch,attr"`
+	ConditionCoverage string `xml:"condition-coverage,attr,omitempty"`
+}
+
+// coverageCounts accumulates line and branch counts into rates.
+type coverageCounts struct {
+	lines, linesHit, branches, branchesHit int
+}
+
+func (c *coverageCounts) add(c2 coverageCounts) {
+	c.lines += c2.lines
+	c.linesHit += c2.linesHit
+	c.branches += c2.branches
+	c.branchesHit += c2.branchesHit
+}
+
+func (c coverageCounts) lineRate() float64   { return rate(c.linesHit, c.lines) }
+func (c coverageCounts) branchRate() float64 { return rate(c.branchesHit, c.branches) }
+
+func rate(hit, total int) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(hit) / float64(total)
+}
+
+// WriteCobertura writes the profile in the Cobertura XML format, as used by
+// many CI systems. Each directory is a package, and each file is a class.
+func (p *CoverageProfile) WriteCobertura(w io.Writer) error {
+	cov := coberturaCoverage{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Sources:   []string{"."},
+	}
+	var total coverageCounts
+	pkgIndex := make(map[string]int)
+	var pkgCounts []coverageCounts
+	for _, cf := range p.summary() {
+		var counts coverageCounts
+		class := coberturaClass{
+			Name:     cf.name,
+			Filename: cf.name,
+			Methods:  []coberturaMethod{},
+		}
+		// The number of branches and of taken branches at each line.
+		branchesByLine := make(map[uint][2]int)
+		for _, b := range cf.branches {
+			bl := branchesByLine[b.pos.Line()]
+			for _, n := range b.counts {
+				bl[0]++
+				counts.branches++
+				if n > 0 {
+					bl[1]++
+					counts.branchesHit++
+				}
+			}
+			branchesByLine[b.pos.Line()] = bl
+		}
+		for _, l := range cf.lines {
+			line := coberturaLine{Number: l.line, Hits: l.hits}
+			if bl, ok := branchesByLine[l.line]; ok {
+				line.Branch = true
+				line.ConditionCoverage = fmt.Sprintf("%d%% (%d/%d)", bl[1]*100/bl[0], bl[1], bl[0])
+			}
+			class.Lines = append(class.Lines, line)
+			counts.lines++
+			if l.hits > 0 {
+				counts.linesHit++
+			}
+		}
+		for _, fn := range cf.funcs {
+			hits := uint(fn.body.counts[0])
+			method := coberturaMethod{
+				Name:       fn.name,
+				BranchRate: 1,
+				Lines:      []coberturaLine{{Number: fn.line, Hits: hits}},
+			}
+			if hits > 0 {
+				method.LineRate = 1
+			}
+			class.Methods = append(class.Methods, method)
+		}
+		class.LineRate = counts.lineRate()
+		class.BranchRate = counts.branchRate()
+
+		dir := filepath.Dir(cf.name)
+		i, ok := pkgIndex[dir]
+		if !ok {
+			i = len(cov.Packages)
+			pkgIndex[dir] = i
+			cov.Packages = append(cov.Packages, coberturaPackage{Name: dir})
+			pkgCounts = append(pkgCounts, coverageCounts{})
+		}
+		cov.Packages[i].Classes = append(cov.Packages[i].Classes, class)
+		pkgCounts[i].add(counts)
+		total.add(counts)
+	}
+	for i := range cov.Packages {
+		cov.Packages[i].LineRate = pkgCounts[i].lineRate()
+		cov.Packages[i].BranchRate = pkgCounts[i].branchRate()
+	}
+	cov.LineRate = total.lineRate()
+	cov.BranchRate = total.branchRate()
+	cov.LinesCovered = total.linesHit
+	cov.LinesValid = total.lines
+	cov.BranchesCovered = total.branchesHit
+	cov.BranchesValid = total.branches
+
+	if _, err := io.WriteString(w, xml.Header+
+		`<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`+"\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(cov); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
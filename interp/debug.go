@@ -0,0 +1,264 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// DebugHandlerFunc is a handler called before running each statement, which
+// can be used to implement debuggers; see Debugger for a ready to use one.
+//
+// Returning a nil error runs the statement. An error created by NewExitStatus
+// exits the shell with said status, and any other error will halt the
+// interpreter.
+//
+// Note that subshells and background jobs also call the handler, so it may be
+// called concurrently.
+type DebugHandlerFunc func(ctx context.Context, dc *DebugContext) error
+
+// DebugContext describes the statement about to be run by the interpreter.
+// Like with custom builtins, it gives access to the state of the interpreter,
+// and it must not be used once the debug handler returns.
+type DebugContext struct {
+	BuiltinContext
+
+	// Stmt is the statement about to be run.
+	Stmt *syntax.Stmt
+
+	// Stack is the call stack, starting with the innermost frame, whose
+	// position is the one of Stmt. It always has at least one frame.
+	Stack []Frame
+}
+
+// Frame is an entry in the interpreter's call stack.
+type Frame struct {
+	// Func is the name of the function being run. Like in Bash's FUNCNAME,
+	// it is "main" at the top level and "source" in a sourced file.
+	Func string
+
+	// File is the name of the file containing the code being run. It may
+	// be empty, such as when Run was not given a *syntax.File.
+	File string
+
+	// Pos is the position of the statement being run in this frame, which
+	// is the call to the next frame for all but the innermost one.
+	Pos syntax.Pos
+}
+
+// DebugHandler sets a handler to be called before running each statement. See
+// DebugHandlerFunc for more info.
+func DebugHandler(f DebugHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.debugHandler = f
+		return nil
+	}
+}
+
+// callStack returns the call stack, innermost first, when running a statement
+// at pos.
+func (r *Runner) callStack(pos syntax.Pos) []Frame {
+	stack := make([]Frame, 0, len(r.callers)+1)
+	stack = append(stack, Frame{Func: r.frameFunc, File: r.frameFile, Pos: pos})
+	for i := len(r.callers) - 1; i >= 0; i-- {
+		stack = append(stack, r.callers[i])
+	}
+	return stack
+}
+
+// callStackVar returns the value of FUNCNAME, BASH_SOURCE, or BASH_LINENO,
+// which describe the call stack like in Bash. FUNCNAME is only set within
+// functions and sourced files.
+func (r *Runner) callStackVar(name string) expand.Variable {
+	if len(r.callers) == 0 && (name == "FUNCNAME" || r.frameFile == "") {
+		return expand.Variable{}
+	}
+	stack := r.callStack(syntax.Pos{})
+	list := make([]string, len(stack))
+	for i, frame := range stack {
+		switch name {
+		case "FUNCNAME":
+			list[i] = frame.Func
+		case "BASH_SOURCE":
+			list[i] = frame.File
+		case "BASH_LINENO":
+			// The line where FUNCNAME[i] was called from.
+			if i+1 < len(stack) {
+				list[i] = strconv.FormatUint(uint64(stack[i+1].Pos.Line()), 10)
+			} else {
+				list[i] = "0"
+			}
+		}
+	}
+	return expand.Variable{Kind: expand.Indexed, List: list}
+}
+
+// pushFrame enters a function or sourced file, called at pos.
+func (r *Runner) pushFrame(pos syntax.Pos, fn, file string) {
+	r.callers = append(r.callers, Frame{Func: r.frameFunc, File: r.frameFile, Pos: pos})
+	r.frameFunc, r.frameFile = fn, file
+}
+
+// popFrame leaves the function or sourced file entered via pushFrame.
+func (r *Runner) popFrame() {
+	caller := r.callers[len(r.callers)-1]
+	r.callers = r.callers[:len(r.callers)-1]
+	r.frameFunc, r.frameFile = caller.Func, caller.File
+}
+
+func (r *Runner) debug(ctx context.Context, st *syntax.Stmt) {
+	dc := &DebugContext{
+		BuiltinContext: BuiltinContext{r: r},
+		Stmt:           st,
+		Stack:          r.callStack(st.Pos()),
+	}
+	err := r.debugHandler(r.handlerCtx(ctx), dc)
+	dc.r = nil // must not be used once the handler returns
+	if status, ok := IsExitStatus(err); ok {
+		r.exitShell(ctx, int(status))
+		return
+	}
+	if err != nil {
+		r.setErr(err)
+	}
+}
+
+// DebugAction is how a Debugger resumes running after it stops.
+type DebugAction int
+
+const (
+	// DebugContinue runs until the next breakpoint.
+	DebugContinue DebugAction = iota
+	// DebugStepIn runs until the next statement, including ones in called
+	// functions and sourced files.
+	DebugStepIn
+	// DebugStepOver runs until the next statement in the current function,
+	// or the one after it returns.
+	DebugStepOver
+	// DebugStepOut runs until the current function returns.
+	DebugStepOut
+)
+
+// Debugger implements breakpoints and stepping on top of DebugHandler. Its
+// Handle method is meant to be used as the debug handler.
+//
+// A Debugger is safe for concurrent use, and breakpoints can be added and
+// removed while the interpreter is running.
+type Debugger struct {
+	stop func(ctx context.Context, dc *DebugContext) (DebugAction, error)
+
+	mu        sync.Mutex
+	lines     map[string]map[uint]bool // keyed by file, then line
+	funcs     map[string]bool
+	action    DebugAction
+	stopDepth int
+
+	// The file, line, and stack depth of the last statement seen, to not
+	// stop at a line breakpoint multiple times in a row.
+	lastFile  string
+	lastLine  uint
+	lastDepth int
+}
+
+// NewDebugger creates a Debugger which calls stop each time the interpreter
+// stops before running a statement, such as at a breakpoint or after a step.
+// The returned action and error decide how to resume, like with the action
+// given here to start with; DebugStepIn stops at the first statement.
+//
+// An error returned by stop is returned by Handle; see DebugHandlerFunc.
+func NewDebugger(action DebugAction, stop func(ctx context.Context, dc *DebugContext) (DebugAction, error)) *Debugger {
+	return &Debugger{
+		stop:   stop,
+		action: action,
+		lines:  make(map[string]map[uint]bool),
+		funcs:  make(map[string]bool),
+	}
+}
+
+// AddBreakpoint adds a breakpoint at a line, stopping before the first
+// statement starting at it. If file has no directory, it matches any file with
+// that base name; if it is empty, it matches any file.
+func (d *Debugger) AddBreakpoint(file string, line uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lines[file] == nil {
+		d.lines[file] = make(map[uint]bool)
+	}
+	d.lines[file][line] = true
+}
+
+// RemoveBreakpoint removes a breakpoint added via AddBreakpoint.
+func (d *Debugger) RemoveBreakpoint(file string, line uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.lines[file], line)
+}
+
+// AddFuncBreakpoint adds a breakpoint at a function, stopping before the
+// first statement each time it is called.
+func (d *Debugger) AddFuncBreakpoint(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.funcs[name] = true
+}
+
+// RemoveFuncBreakpoint removes a breakpoint added via AddFuncBreakpoint.
+func (d *Debugger) RemoveFuncBreakpoint(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.funcs, name)
+}
+
+// Handle implements DebugHandlerFunc.
+//
+// The lock is not held while calling stop, so that it can add and remove
+// breakpoints.
+func (d *Debugger) Handle(ctx context.Context, dc *DebugContext) error {
+	if !d.shouldStop(dc) {
+		return nil
+	}
+	action, err := d.stop(ctx, dc)
+	d.mu.Lock()
+	d.action, d.stopDepth = action, len(dc.Stack)
+	d.mu.Unlock()
+	return err
+}
+
+func (d *Debugger) shouldStop(dc *DebugContext) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	frame := dc.Stack[0]
+	depth := len(dc.Stack)
+	line := frame.Pos.Line()
+	newLine := frame.File != d.lastFile || line != d.lastLine || depth != d.lastDepth
+	called := depth > d.lastDepth
+	d.lastFile, d.lastLine, d.lastDepth = frame.File, line, depth
+
+	stop := false
+	switch d.action {
+	case DebugStepIn:
+		stop = true
+	case DebugStepOver:
+		stop = depth <= d.stopDepth
+	case DebugStepOut:
+		stop = depth < d.stopDepth
+	}
+	if !stop && newLine {
+		stop = d.lineBreakpoint(frame.File, line)
+	}
+	if !stop && called {
+		stop = d.funcs[frame.Func]
+	}
+	return stop
+}
+
+func (d *Debugger) lineBreakpoint(file string, line uint) bool {
+	return d.lines[""][line] || d.lines[file][line] || d.lines[filepath.Base(file)][line]
+}
@@ -68,6 +68,24 @@ func ExampleExecHandler() {
 	// missing-program is not installed
 }
 
+func ExampleExecHandlers() {
+	src := "echo foo; rm -rf /tmp/build; chmod +x build.sh"
+	file, _ := syntax.NewParser().Parse(strings.NewReader(src), "")
+
+	runner, _ := interp.New(
+		interp.StdIO(nil, os.Stdout, os.Stdout),
+		interp.ExecHandlers(
+			interp.AllowExecs("rm", "cp"),
+			interp.DryRunExecs(os.Stdout),
+		),
+	)
+	runner.Run(context.TODO(), file)
+	// Output:
+	// foo
+	// rm -rf /tmp/build
+	// chmod: command not allowed
+}
+
 func ExampleOpenHandler() {
 	src := "echo foo; echo bar >/dev/null"
 	file, _ := syntax.NewParser().Parse(strings.NewReader(src), "")
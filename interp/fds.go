@@ -0,0 +1,215 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+var errBadFd = errors.New("bad file descriptor")
+
+// firstUserFd is the lowest file descriptor number which the shell hands out
+// by itself, such as for "{varname}>file" redirections, like Bash does.
+const firstUserFd = 10
+
+// fdEntry is an open file descriptor in the shell's table.
+//
+// Like with dup(2), multiple file descriptors may share the same open file,
+// which is only closed once all of them are closed.
+type fdEntry struct {
+	reader io.Reader // nil if not open for reading
+	writer io.Writer // nil if not open for writing
+
+	// file is nil if closing the file descriptor doesn't close anything,
+	// such as when it was inherited from a parent shell.
+	file *sharedFile
+}
+
+// sharedFile is an open file which may be shared by multiple fdEntry values.
+type sharedFile struct {
+	closer io.Closer
+	refs   int
+}
+
+// newFdEntry creates a file descriptor for an open file, which is closed once
+// the file descriptor is. Whether it's readable or writable depends on f.
+func newFdEntry(f io.Closer) *fdEntry {
+	e := &fdEntry{file: &sharedFile{closer: f, refs: 1}}
+	e.reader, _ = f.(io.Reader)
+	e.writer, _ = f.(io.Writer)
+	return e
+}
+
+// dup returns a new file descriptor which shares the same open file.
+func (e *fdEntry) dup() *fdEntry {
+	e2 := *e
+	if e2.file != nil {
+		e2.file.refs++
+	}
+	return &e2
+}
+
+// inherited returns a copy of the file descriptor for a subshell, which can't
+// close the open file.
+func (e *fdEntry) inherited() *fdEntry {
+	return &fdEntry{reader: e.reader, writer: e.writer}
+}
+
+func (e *fdEntry) close() {
+	if e.file == nil {
+		return
+	}
+	if e.file.refs--; e.file.refs == 0 {
+		e.file.closer.Close()
+	}
+}
+
+// closedFd is used for standard input, output, or error once closed, like
+// via ">&-", so that any reads or writes fail.
+type closedFd struct{}
+
+func (closedFd) Read([]byte) (int, error)  { return 0, errBadFd }
+func (closedFd) Write([]byte) (int, error) { return 0, errBadFd }
+
+// getFd returns the open file descriptor n, including standard input, output,
+// and error, or nil if it's not open.
+func (r *Runner) getFd(n int) *fdEntry {
+	switch n {
+	case 0:
+		return &fdEntry{reader: r.stdin}
+	case 1:
+		return &fdEntry{writer: r.stdout}
+	case 2:
+		return &fdEntry{writer: r.stderr}
+	}
+	return r.fds[n]
+}
+
+// lookupFd is like getFd, but takes a number like "3" as a string.
+func (r *Runner) lookupFd(arg string) *fdEntry {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return nil
+	}
+	return r.getFd(n)
+}
+
+// setFd opens the file descriptor n, replacing any previous one. Note that the
+// previous one is not closed, as stmtSync might need to restore it.
+func (r *Runner) setFd(n int, e *fdEntry) {
+	if n <= 2 {
+		r.stdFds[n] = nil
+		if e != nil && e.file != nil {
+			r.stdFds[n] = e
+		}
+	}
+	switch n {
+	case 0:
+		r.stdin = e.reader
+		if r.stdin == nil {
+			r.stdin = closedFd{}
+		}
+	case 1, 2:
+		w := e.writer
+		if w == nil {
+			w = closedFd{}
+		}
+		if n == 1 {
+			r.stdout = w
+		} else {
+			r.stderr = w
+		}
+	default:
+		// Copy the table, so that stmtSync can restore the old one.
+		fds := make(map[int]*fdEntry, len(r.fds)+1)
+		for n2, e2 := range r.fds {
+			fds[n2] = e2
+		}
+		if e == nil {
+			delete(fds, n)
+		} else {
+			fds[n] = e
+		}
+		r.fds = fds
+	}
+}
+
+// unsetFd closes the file descriptor n, like via ">&-". Similar to setFd, the
+// open file itself is not closed here.
+func (r *Runner) unsetFd(n int) {
+	if n <= 2 {
+		r.setFd(n, &fdEntry{})
+		return
+	}
+	r.setFd(n, nil)
+}
+
+// freeFd returns the lowest file descriptor number available for the shell to
+// hand out.
+func (r *Runner) freeFd() int {
+	n := firstUserFd
+	for r.fds[n] != nil {
+		n++
+	}
+	return n
+}
+
+// newFd adds an open file to the table of file descriptors, returning its
+// number.
+func (r *Runner) newFd(f io.Closer) int {
+	n := r.freeFd()
+	r.setFd(n, newFdEntry(f))
+	return n
+}
+
+// closeDroppedFds closes the open files of the file descriptors in fds which
+// aren't in keep.
+func closeDroppedFds(fds, keep map[int]*fdEntry) {
+	for n, e := range fds {
+		if keep[n] != e {
+			e.close()
+		}
+	}
+}
+
+// closeDroppedStdFds is like closeDroppedFds, for Runner.stdFds.
+func closeDroppedStdFds(fds, keep [3]*fdEntry) {
+	for n, e := range fds {
+		if e != nil && keep[n] != e {
+			e.close()
+		}
+	}
+}
+
+// closeFds closes all file descriptors in the table, as well as any open files
+// used as standard input, output, or error, like a shell exiting.
+func (r *Runner) closeFds() {
+	closeDroppedFds(r.fds, nil)
+	closeDroppedStdFds(r.stdFds, [3]*fdEntry{})
+	r.fds, r.stdFds = nil, [3]*fdEntry{}
+}
+
+// extraFiles returns the file descriptors beyond standard input, output, and
+// error as expected by exec.Cmd.ExtraFiles, where entry i is file descriptor
+// 3+i. File descriptors which aren't backed by an *os.File are left out.
+func (r *Runner) extraFiles() []*os.File {
+	var files []*os.File
+	for n, e := range r.fds {
+		f, _ := e.writer.(*os.File)
+		if f == nil {
+			f, _ = e.reader.(*os.File)
+		}
+		if f == nil {
+			continue
+		}
+		for len(files) <= n-3 {
+			files = append(files, nil)
+		}
+		files[n-3] = f
+	}
+	return files
+}
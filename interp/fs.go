@@ -0,0 +1,116 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileSystem is the file system used by the interpreter, such as for
+// redirections, globbing, searching PATH, and builtins like cd, test, or
+// source. The paths given to it are always absolute.
+//
+// Errors should be of type *os.PathError, such as the ones returned by the os
+// package. Like with OpenHandlerFunc, any other error from Open will halt the
+// interpreter.
+//
+// Note that programs run via DefaultExecHandler use the real file system. So do
+// process substitutions like <(cmd), as they are FIFOs created in os.TempDir,
+// which DefaultOpenHandler opens directly.
+type FileSystem interface {
+	// Open opens a file like os.OpenFile.
+	Open(path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
+	// Stat returns information about a file like os.Stat.
+	Stat(path string) (os.FileInfo, error)
+	// Lstat is like Stat, but doesn't follow a final symbolic link.
+	Lstat(path string) (os.FileInfo, error)
+	// ReadDir returns a directory's entries sorted by name, like
+	// ioutil.ReadDir.
+	ReadDir(path string) ([]os.FileInfo, error)
+	// Mkdir creates a directory like os.Mkdir.
+	Mkdir(path string, perm os.FileMode) error
+	// Readlink returns the destination of a symbolic link like os.Readlink.
+	Readlink(path string) (string, error)
+}
+
+// DefaultFileSystem returns the FileSystem used by default, which uses the os
+// package to access the real file system.
+func DefaultFileSystem() FileSystem { return osFS{} }
+
+type osFS struct{}
+
+func (osFS) Open(path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		// Avoid returning a nil *os.File as a non-nil interface.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(path string) (os.FileInfo, error)      { return os.Stat(path) }
+func (osFS) Lstat(path string) (os.FileInfo, error)     { return os.Lstat(path) }
+func (osFS) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(path) }
+func (osFS) Mkdir(path string, perm os.FileMode) error  { return os.Mkdir(path, perm) }
+func (osFS) Readlink(path string) (string, error)       { return os.Readlink(path) }
+
+// maxSymlinks is the maximum number of symbolic links followed by
+// evalSymlinksFS, like with Linux's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// evalSymlinksFS is like filepath.EvalSymlinks for an absolute path, but it
+// uses the given file system.
+func evalSymlinksFS(fsys FileSystem, path string) (string, error) {
+	if _, ok := fsys.(osFS); ok {
+		return filepath.EvalSymlinks(path)
+	}
+	sep := string(filepath.Separator)
+	vol := filepath.VolumeName(path)
+	resolved := vol + sep
+	rest := strings.TrimPrefix(path[len(vol):], sep)
+	links := 0
+	for rest != "" {
+		var part string
+		if i := strings.Index(rest, sep); i >= 0 {
+			part, rest = rest[:i], rest[i+1:]
+		} else {
+			part, rest = rest, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := fsys.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", &os.PathError{Op: "readlink", Path: path, Err: fmt.Errorf("too many levels of symbolic links")}
+		}
+		dest, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			vol = filepath.VolumeName(dest)
+			resolved = vol + sep
+			dest = dest[len(vol):]
+		}
+		rest = strings.TrimPrefix(dest, sep) + sep + rest
+	}
+	return resolved, nil
+}
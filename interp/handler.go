@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
 )
 
 // HandlerCtx returns HandlerContext value stored in ctx.
@@ -47,6 +48,32 @@ type HandlerContext struct {
 	Stdout io.Writer
 	// Stderr is the interpreter's current standard error writer.
 	Stderr io.Writer
+
+	// ExtraFiles holds the interpreter's open file descriptors beyond
+	// standard input, output, and error, such as the ones opened via
+	// "exec 3>file". Like in exec.Cmd, entry i is file descriptor 3+i, and
+	// a nil entry means that a file descriptor isn't open. Only the file
+	// descriptors backed by an *os.File are included.
+	ExtraFiles []*os.File
+
+	// Umask is the interpreter's file mode creation mask, as set via the
+	// umask builtin. It starts as the umask of the current process.
+	Umask os.FileMode
+
+	// Rlimits holds the resource limits set via the ulimit builtin, keyed
+	// by resource such as unix.RLIMIT_NOFILE. Resources which aren't
+	// included have the limits of the current process.
+	//
+	// DefaultExecHandler only applies them on Linux, right after starting
+	// each program, so a program may briefly run before they apply.
+	Rlimits map[int]Rlimit
+
+	// FS is the interpreter's file system, as set via the FS option.
+	FS FileSystem
+
+	// replaceProcess is whether DefaultExecHandler should replace the
+	// current process, for the exec builtin with RealExec.
+	replaceProcess bool
 }
 
 // ExecHandlerFunc is a handler which executes simple command. It is
@@ -73,6 +100,13 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 			fmt.Fprintln(hc.Stderr, err)
 			return NewExitStatus(127)
 		}
+		if hc.replaceProcess {
+			if files, ok := execveFiles(hc); ok {
+				err := execve(path, args, execEnv(hc.Env), hc.Dir, files, hc.Umask, hc.Rlimits)
+				fmt.Fprintf(hc.Stderr, "exec: %s: %v\n", args[0], err)
+				return NewExitStatus(126)
+			}
+		}
 		cmd := exec.Cmd{
 			Path:   path,
 			Args:   args,
@@ -82,8 +116,14 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 			Stdout: hc.Stdout,
 			Stderr: hc.Stderr,
 		}
+		if runtime.GOOS != "windows" {
+			// Windows does not support inheriting extra files.
+			cmd.ExtraFiles = hc.ExtraFiles
+		}
 
-		err = cmd.Start()
+		// Start the program with the interpreter's umask and resource
+		// limits, which is only supported on Linux.
+		err = startCommand(&cmd, hc.Umask, hc.Rlimits)
 		if err == nil {
 			if done := ctx.Done(); done != nil {
 				go func() {
@@ -132,11 +172,35 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 	}
 }
 
-func checkStat(dir, file string, checkExec bool) (string, error) {
+// execveFiles returns the files which a program replacing the current process
+// inherits, in file descriptor order. It returns false if standard input,
+// output, or error aren't nil nor *os.File values.
+func execveFiles(hc HandlerContext) ([]*os.File, bool) {
+	files := make([]*os.File, 3)
+	for i, std := range [...]interface{}{hc.Stdin, hc.Stdout, hc.Stderr} {
+		switch std := std.(type) {
+		case nil:
+			// Like exec.Cmd, use the null device.
+			f, err := os.Open(os.DevNull)
+			if err != nil {
+				return nil, false
+			}
+			files[i] = f
+		case closedFd:
+		case *os.File:
+			files[i] = std
+		default:
+			return nil, false
+		}
+	}
+	return append(files, hc.ExtraFiles...), true
+}
+
+func checkStat(fsys FileSystem, dir, file string, checkExec bool) (string, error) {
 	if !filepath.IsAbs(file) {
 		file = filepath.Join(dir, file)
 	}
-	info, err := os.Stat(file)
+	info, err := fsys.Stat(file)
 	if err != nil {
 		return "", err
 	}
@@ -159,19 +223,19 @@ func winHasExt(file string) bool {
 }
 
 // findExecutable returns the path to an existing executable file.
-func findExecutable(dir, file string, exts []string) (string, error) {
+func findExecutable(fsys FileSystem, dir, file string, exts []string) (string, error) {
 	if len(exts) == 0 {
 		// non-windows
-		return checkStat(dir, file, true)
+		return checkStat(fsys, dir, file, true)
 	}
 	if winHasExt(file) {
-		if file, err := checkStat(dir, file, true); err == nil {
+		if file, err := checkStat(fsys, dir, file, true); err == nil {
 			return file, nil
 		}
 	}
 	for _, e := range exts {
 		f := file + e
-		if f, err := checkStat(dir, f, true); err == nil {
+		if f, err := checkStat(fsys, dir, f, true); err == nil {
 			return f, nil
 		}
 	}
@@ -179,8 +243,8 @@ func findExecutable(dir, file string, exts []string) (string, error) {
 }
 
 // findFile returns the path to an existing file.
-func findFile(dir, file string, _ []string) (string, error) {
-	return checkStat(dir, file, false)
+func findFile(fsys FileSystem, dir, file string, _ []string) (string, error) {
+	return checkStat(fsys, dir, file, false)
 }
 
 // LookPath is deprecated. See LookPathDir.
@@ -194,13 +258,13 @@ func LookPath(env expand.Environ, file string) (string, error) {
 //
 // If no error is returned, the returned path must be valid.
 func LookPathDir(cwd string, env expand.Environ, file string) (string, error) {
-	return lookPathDir(cwd, env, file, findExecutable)
+	return lookPathDir(DefaultFileSystem(), cwd, env, file, findExecutable)
 }
 
 // findAny defines a function to pass to lookPathDir.
-type findAny = func(dir string, file string, exts []string) (string, error)
+type findAny = func(fsys FileSystem, dir string, file string, exts []string) (string, error)
 
-func lookPathDir(cwd string, env expand.Environ, file string, find findAny) (string, error) {
+func lookPathDir(fsys FileSystem, cwd string, env expand.Environ, file string, find findAny) (string, error) {
 	if find == nil {
 		panic("no find function found")
 	}
@@ -215,7 +279,7 @@ func lookPathDir(cwd string, env expand.Environ, file string, find findAny) (str
 	}
 	exts := pathExts(env)
 	if strings.ContainsAny(file, chars) {
-		return find(cwd, file, exts)
+		return find(fsys, cwd, file, exts)
 	}
 	for _, elem := range pathList {
 		var path string
@@ -226,17 +290,22 @@ func lookPathDir(cwd string, env expand.Environ, file string, find findAny) (str
 		default:
 			path = filepath.Join(elem, file)
 		}
-		if f, err := find(cwd, path, exts); err == nil {
+		if f, err := find(fsys, cwd, path, exts); err == nil {
 			return f, nil
 		}
 	}
 	return "", fmt.Errorf("%q: executable file not found in $PATH", file)
 }
 
+// lookPath is like LookPathDir, but it uses the interpreter's file system.
+func (r *Runner) lookPath(file string) (string, error) {
+	return lookPathDir(r.fs, r.Dir, r.writeEnv, file, findExecutable)
+}
+
 // scriptFromPathDir is similar to LookPathDir, with the difference that it looks
 // for both executable and non-executable files.
-func scriptFromPathDir(cwd string, env expand.Environ, file string) (string, error) {
-	return lookPathDir(cwd, env, file, findFile)
+func scriptFromPathDir(fsys FileSystem, cwd string, env expand.Environ, file string) (string, error) {
+	return lookPathDir(fsys, cwd, env, file, findFile)
 }
 
 func pathExts(env expand.Environ) []string {
@@ -272,13 +341,140 @@ func pathExts(env expand.Environ) []string {
 // interpreter will come to a stop.
 type OpenHandlerFunc func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
 
-// DefaultOpenHandler returns an OpenHandlerFunc used by default. It uses os.OpenFile to open files.
+// DefaultOpenHandler returns an OpenHandlerFunc used by default. It opens files
+// via the interpreter's file system, which is DefaultFileSystem by default.
+//
+// New files are created with the interpreter's umask. On platforms other than
+// Linux, the umask of the current process applies as well.
 func DefaultOpenHandler() OpenHandlerFunc {
 	return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
 		mc := HandlerCtx(ctx)
 		if !filepath.IsAbs(path) {
 			path = filepath.Join(mc.Dir, path)
 		}
-		return os.OpenFile(path, flag, perm)
+		fsys := mc.FS
+		if fsys == nil || strings.HasPrefix(path, procSubstPrefix()) {
+			// Process substitutions use FIFOs in the real file system.
+			fsys = DefaultFileSystem()
+		}
+		var f io.ReadWriteCloser
+		var err error
+		withUmask(mc.Umask, func() {
+			f, err = fsys.Open(path, flag, perm&^mc.Umask)
+		})
+		return f, err
+	}
+}
+
+// BuiltinFunc is a custom builtin command, registered via Builtins. Like
+// with ExecHandlerFunc, args[0] is the name of the command.
+//
+// Unlike programs run via an ExecHandlerFunc, builtins are part of the
+// interpreter, so they can use bc to read and modify its state, such as its
+// variables and current directory. The context also holds a HandlerContext.
+//
+// Returning nil error sets commands exit status to 0. Other exit statuses
+// can be set with NewExitStatus. Any other error will halt an interpreter.
+type BuiltinFunc func(ctx context.Context, bc *BuiltinContext, args []string) error
+
+// BuiltinContext gives a custom builtin access to the state of the interpreter
+// running it. It must not be used once the builtin returns.
+type BuiltinContext struct {
+	r *Runner
+}
+
+// Stdin returns the interpreter's current standard input reader.
+func (bc *BuiltinContext) Stdin() io.Reader { return bc.r.stdin }
+
+// Stdout returns the interpreter's current standard output writer.
+func (bc *BuiltinContext) Stdout() io.Writer { return bc.r.stdout }
+
+// Stderr returns the interpreter's current standard error writer.
+func (bc *BuiltinContext) Stderr() io.Writer { return bc.r.stderr }
+
+// Fd returns the reader and writer for the open file descriptor n, such as one
+// opened via "exec 3<file". Either is nil if the file descriptor isn't open
+// for reading or writing, respectively.
+func (bc *BuiltinContext) Fd(n int) (io.Reader, io.Writer) {
+	e := bc.r.getFd(n)
+	if e == nil {
+		return nil, nil
+	}
+	return e.reader, e.writer
+}
+
+// Params returns the current positional parameters, like "$@".
+func (bc *BuiltinContext) Params() []string { return bc.r.Params }
+
+// Dir returns the interpreter's current directory.
+func (bc *BuiltinContext) Dir() string { return bc.r.Dir }
+
+// Chdir changes the interpreter's current directory, like the cd builtin.
+// A relative path is joined with the current directory.
+func (bc *BuiltinContext) Chdir(path string) error {
+	r := bc.r
+	path = r.absPath(path)
+	info, err := r.stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "chdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	if r.changeDir(path) != 0 {
+		return &os.PathError{Op: "chdir", Path: path, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+// Var returns a variable, which may be unset. Variables are looked up like in
+// the shell, including local variables in the function being run.
+func (bc *BuiltinContext) Var(name string) expand.Variable {
+	return bc.r.lookupVar(name)
+}
+
+// SetVar sets a variable, replacing its previous value, which may be of any
+// kind such as an indexed array. Like an assignment in the shell, a variable
+// with no attributes keeps the ones of the previous variable, such as whether
+// it's exported or local to the function being run. An error is returned if
+// the variable can't be set, such as when it's readonly or when its value
+// doesn't satisfy its attributes.
+func (bc *BuiltinContext) SetVar(name string, vr expand.Variable) error {
+	r := bc.r
+	if !syntax.ValidName(name) {
+		return fmt.Errorf("invalid variable name: %q", name)
+	}
+	cur := r.lookupVar(name)
+	if name2, var2 := cur.Resolve(r.writeEnv); name2 != "" {
+		name, cur = name2, var2
+	}
+	if cur.ReadOnly {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	return r.setVarInternal(name, vr)
+}
+
+// UnsetVar unsets a variable, like the unset builtin.
+func (bc *BuiltinContext) UnsetVar(name string) error {
+	r := bc.r
+	if cur := r.lookupVar(name); cur.ReadOnly {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	r.delVar(name)
+	return nil
+}
+
+// Func returns the body of a declared function, or nil if there is none.
+func (bc *BuiltinContext) Func(name string) *syntax.Stmt {
+	return bc.r.Funcs[name]
+}
+
+// Option reports whether a shell option is enabled, given its long name as
+// used with "set -o" or "shopt", such as "errexit" or "globstar".
+// Unknown options are never enabled.
+func (bc *BuiltinContext) Option(name string) bool {
+	if opt := bc.r.optByName(name, true); opt != nil {
+		return *opt
 	}
+	return false
 }
@@ -53,6 +53,18 @@ func execBuiltin(ctx context.Context, args []string) error {
 	return nil
 }
 
+func printExtraFiles(ctx context.Context, args []string) error {
+	hc := HandlerCtx(ctx)
+	var fds []string
+	for i, f := range hc.ExtraFiles {
+		if f != nil {
+			fds = append(fds, strconv.Itoa(3+i))
+		}
+	}
+	fmt.Fprintln(hc.Stdout, strings.Join(fds, " "))
+	return nil
+}
+
 var modCases = []struct {
 	name string
 	exec ExecHandlerFunc
@@ -102,6 +114,12 @@ var modCases = []struct {
 		src:  "exec /bin/sh",
 		want: "exec builtin: /bin/sh",
 	},
+	{
+		name: "ExecExtraFiles",
+		exec: printExtraFiles,
+		src:  "exec 3>/dev/null 5</dev/null; extra; extra 6>/dev/null; exec 3>&-; extra",
+		want: "3 5\n3 5 6\n5\n",
+	},
 	{
 		name: "OpenForbidNonDev",
 		open: blacklistNondevOpen,
@@ -140,6 +158,114 @@ func TestRunnerHandlers(t *testing.T) {
 	}
 }
 
+// tagExec returns an exec middleware which prints its name and the command
+// before calling the next handler.
+func tagExec(name string) func(next ExecHandlerFunc) ExecHandlerFunc {
+	return func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			fmt.Fprintf(HandlerCtx(ctx).Stdout, "%s: %s\n", name, args[0])
+			return next(ctx, args)
+		}
+	}
+}
+
+// okExec succeeds for the "ok" command, and fails for any other.
+func okExec(ctx context.Context, args []string) error {
+	if args[0] == "ok" {
+		return nil
+	}
+	return NewExitStatus(3)
+}
+
+// blockExec blocks until the context is cancelled.
+func blockExec(ctx context.Context, args []string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+var middlewareCases = []struct {
+	name string
+	opts func(w io.Writer) []RunnerOption
+	src  string
+	want string
+}{
+	{
+		name: "Order",
+		opts: func(w io.Writer) []RunnerOption {
+			return []RunnerOption{
+				ExecHandlers(tagExec("a"), tagExec("b")),
+				ExecHandlers(tagExec("c")),
+				ExecHandler(blacklistAllExec),
+			}
+		},
+		src:  "foo",
+		want: "a: foo\nb: foo\nc: foo\nblacklisted: foo",
+	},
+	{
+		name: "LogExecs",
+		opts: func(w io.Writer) []RunnerOption {
+			return []RunnerOption{ExecHandler(okExec), ExecHandlers(LogExecs(w))}
+		},
+		src:  "ok 'a b'; fail x",
+		want: "exec: ok 'a b'\nexec: fail x\nexec: fail x: exit status 3\nexit status 3",
+	},
+	{
+		name: "AllowExecs",
+		opts: func(w io.Writer) []RunnerOption {
+			return []RunnerOption{ExecHandler(okExec), ExecHandlers(AllowExecs("ok"))}
+		},
+		src:  "ok; echo $?; fail; echo $?",
+		want: "0\nfail: command not allowed\n126\n",
+	},
+	{
+		name: "DryRunExecs",
+		opts: func(w io.Writer) []RunnerOption {
+			return []RunnerOption{ExecHandler(blacklistAllExec), ExecHandlers(DryRunExecs(w))}
+		},
+		src:  "rm -rf \"a b\"/'*'; echo $?",
+		want: "rm -rf 'a b/*'\n0\n",
+	},
+	{
+		name: "TimeoutExecs",
+		opts: func(w io.Writer) []RunnerOption {
+			return []RunnerOption{ExecHandler(blockExec), ExecHandlers(TimeoutExecs(10 * time.Millisecond))}
+		},
+		src:  "block; echo $?",
+		want: "block: timed out after 10ms\n124\n",
+	},
+	{
+		name: "LogOpens",
+		opts: func(w io.Writer) []RunnerOption {
+			return []RunnerOption{OpenHandler(blacklistNondevOpen), OpenHandlers(LogOpens(w))}
+		},
+		src:  "echo >/dev/null; : </dev/null; echo >>/dev/null; : <>/dev/null; echo >x",
+		want: "open: > /dev/null\nopen: < /dev/null\nopen: >> /dev/null\nopen: <> /dev/null\nopen: > x\nnon-dev: x",
+	},
+}
+
+func TestRunnerMiddlewares(t *testing.T) {
+	t.Parallel()
+
+	p := syntax.NewParser()
+	for _, tc := range middlewareCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			file := parse(t, p, tc.src)
+			var cb concBuffer
+			r, err := New(append(tc.opts(&cb), StdIO(nil, &cb, &cb))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
 type readyBuffer struct {
 	buf       bytes.Buffer
 	seenReady sync.WaitGroup
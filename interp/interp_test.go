@@ -5,13 +5,19 @@ package interp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"math/bits"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"sort"
@@ -111,6 +117,7 @@ func TestMain(m *testing.M) {
 			StdIO(os.Stdin, os.Stdout, os.Stderr),
 			OpenHandler(testOpenHandler),
 			ExecHandler(testExecHandler),
+			RealExec(os.Getenv("GOSH_CMD") == "real_exec"),
 		)
 		ctx := context.Background()
 		if err := runner.Run(ctx, file); err != nil {
@@ -244,7 +251,7 @@ var runTests = []runTest{
 	{"false; exit", "exit status 1"},
 	{"exit; echo foo", ""},
 	{"exit 0; echo foo", ""},
-	{"printf", "usage: printf format [arguments]\nexit status 2 #JUSTERR"},
+	{"printf", "usage: printf [-v var] format [arguments]\nexit status 2 #JUSTERR"},
 	{"break", "break is only useful in a loop #JUSTERR"},
 	{"continue", "continue is only useful in a loop #JUSTERR"},
 	{"cd a b", "usage: cd [dir]\nexit status 2 #JUSTERR"},
@@ -303,6 +310,46 @@ var runTests = []runTest{
 	{"printf 'nofmt' 1 2 3", "nofmt"},
 	{"printf '%d_' 1 2 3", "1_2_3_"},
 	{"printf '%02d %02d\n' 1 2 3", "01 02\n03 00\n"},
+	{"printf %.2s abc", "ab"},
+	{"printf %5.2s abc", "   ab"},
+	{"printf %.3d 7", "007"},
+	{"printf '%*s|' 4 a", "   a|"},
+	{"printf '%-*s|' 4 a", "a   |"},
+	{"printf '%*s|' -4 a", "a   |"},
+	{"printf '%.*s|' 2 abc", "ab|"},
+	{"printf '%.*s|' -2 abc", "abc|"},
+	{"printf '%*.*s|' 4 1 abc", "   a|"},
+	{"printf '%*d|%d' 3 1 2", "  1|2"},
+	{"a=$(printf '%-*d|' 1000003 -5); echo ${#a} ${a:0:3}", "1000004 -5\n"},
+	{"a=$(printf '%0*d' 1000003 -5); echo ${#a} ${a:0:3} ${a: -2}", "1000003 -00 05\n"},
+	{"a=$(printf '%*.*s' 1000003 2 abc); echo ${#a} ${a: -3}", "1000003 ab\n"},
+	{"printf '%*s' 3000000000 x", "invalid field width: 3000000000\nexit status 1 #JUSTERR"},
+	{"printf %q foo", "foo"},
+	{"printf '%q\n' 'a b' '' \"'\" $'a\\nb'", "'a b'\n''\n\"'\"\n$'a\\nb'\n #IGNORE bash quotes with backslashes"},
+	{"printf '[%6q]' a", "[     a]"},
+	{"printf 'a\\0'", "a\x00"},
+	{"printf 'a\\x4'", "a\x04"},
+	{"TZ=UTC printf '%(%Y-%m-%d %H:%M:%S)T\n' 86400", "1970-01-02 00:00:00\n"},
+	{"TZ=UTC printf '%(%a %b %e %j %s)T\n' 1000000000", "Sun Sep  9 252 1000000000\n"},
+	{"TZ=UTC printf '%(%I %p %y %D %%)T\n' 1000000000", "01 AM 01 09/09/01 %\n"},
+	{"TZ=UTC printf '[%12(%F)T]' 0", "[  1970-01-01]"},
+	{"TZ=UTC printf '%()T\n' 3661", "01:01:01\n"},
+	{"x=$(printf '%(%Y)T'); echo ${#x}", "4\n"},
+	{"printf '%(%Y' 0", "missing time format char\nexit status 1 #JUSTERR"},
+	{"printf '%(%Y)T' foo", "foo: invalid number\nexit status 1 #JUSTERR"},
+	{"printf -v x '%s-%d' a 3; echo \"$x\"", "a-3\n"},
+	{"printf -v x '%s,' a b c; echo \"$x\"", "a,b,c,\n"},
+	{"printf -vx %s foo; echo \"$x\"", "foo\n"},
+	{"x=old; printf -v x ''; echo \"[$x]\"", "[]\n"},
+	{"printf -- '%s\n' -v", "-v\n"},
+	{"printf -v", "printf: -v: option requires an argument\nexit status 2 #JUSTERR"},
+	{"printf -v x", "usage: printf [-v var] format [arguments]\nexit status 2 #JUSTERR"},
+	{"printf -v 0x foo", "printf: invalid identifier \"0x\"\nexit status 2 #JUSTERR"},
+	{"printf -v '' foo", "printf: invalid identifier \"\"\nexit status 2 #JUSTERR"},
+	{"i=0; printf -v 'a[i+1]' %s x; printf -v 'a[0]' %s y; declare -p a", "declare -a a=([0]=\"y\" [1]=\"x\")\n"},
+	{"declare -A m; printf -v 'm[a b]' %s x; k='a b'; echo \"${m[$k]}\"", "x\n"},
+	{"printf -v 'a[' foo", "printf: invalid identifier \"a[\"\nexit status 2 #JUSTERR"},
+	{"printf -v 'a[]' foo", "printf: invalid identifier \"a[]\"\nexit status 2 #JUSTERR"},
 
 	// words and quotes
 	{"echo  foo ", "foo\n"},
@@ -445,8 +492,43 @@ var runTests = []runTest{
 	// special vars
 	{"echo $?; false; echo $?", "0\n1\n"},
 	{"for i in 1 2; do\necho $LINENO\necho $LINENO\ndone", "2\n3\n2\n3\n"},
+	{"echo $LINENO \\\n $LINENO", "1 1\n"},
+	{"for i in $LINENO\ndo echo $((LINENO)) $i; done", "2 1\n"},
+	{"f() {\n\techo $LINENO\n}\n\nf", "2\n"},
+	{"LINENO=50\necho $LINENO", "2\n"},
+	{`echo "[${FUNCNAME[*]}] [${BASH_SOURCE[*]}] [${BASH_LINENO[*]}] ${FUNCNAME+set}"`, "[] [] [] \n"},
+	{"f() { echo $FUNCNAME ${FUNCNAME[0]}; g; }; g() { echo ${FUNCNAME[1]}; }; f", "f f\nf\n"},
+	{"f() {\n\tg\n}\ng() { echo ${BASH_LINENO[0]}; }\nf", "2\n"},
+	{`FUNCNAME=x; echo "[$FUNCNAME]"`, "[]\n"},
+	{"caller; echo $?", "1\n"},
+	{"caller x; echo $?", "1\n"},
 	{"[[ -n $$ && $$ -gt 0 ]]", ""},
 	{"[[ $$ -eq $PPID ]]", "exit status 1"},
+	{"[[ $BASHPID -eq $$ ]]", ""},
+	{"[[ $(echo $BASHPID) -ne $$ ]]", ""},
+	{"(a=$BASHPID; [[ $a -ne $$ && $(echo $BASHPID) -ne $a ]])", ""},
+	{"BASHPID=1; [[ $BASHPID -eq $$ ]]", ""},
+	{"(kill $BASHPID; echo unreachable); echo $?", "143\n #IGNORE bash prints Terminated"},
+	{"(trap 'echo trapped' TERM; kill $BASHPID; echo after); echo $?", "trapped\nafter\n0\n"},
+	{"(trap '' TERM; kill $BASHPID; echo ignored)", "ignored\n"},
+	{"(kill -0 $BASHPID && echo exists)", "exists\n"},
+	{"a=$(echo $BASHPID); kill $a 2>/dev/null || echo refused", "refused\n"},
+	{"[[ $RANDOM -ge 0 && $RANDOM -lt 32768 ]]", ""},
+	{"echo $((RANDOM < 32768))", "1\n"},
+	{"RANDOM=7; a=$RANDOM$RANDOM; RANDOM=7; [[ $a == $RANDOM$RANDOM ]]", ""},
+	{"RANDOM=7; a=$(echo $RANDOM); [[ $a != $(echo $RANDOM) ]]", ""},
+	{"[[ $SRANDOM -ge 0 && $SRANDOM -lt 4294967296 ]]", ""},
+	{"echo $SECONDS", "0\n"},
+	{"SECONDS=100; echo $SECONDS", "100\n"},
+	{"SECONDS=100; echo $(echo $SECONDS)", "100\n"},
+	{"[[ $EPOCHSECONDS -gt 1600000000 ]]", ""},
+	{"[[ $EPOCHREALTIME =~ ^[0-9]+\\.[0-9]{6}$ ]]", ""},
+	{"EPOCHSECONDS=1; [[ $EPOCHSECONDS -gt 1 ]]", ""},
+	{"readonly SECONDS; SECONDS=5", "SECONDS: readonly variable\nexit status 1 #JUSTERR"},
+	{"declare -r RANDOM; RANDOM=7", "RANDOM: readonly variable\nexit status 1 #JUSTERR"},
+	{"SECONDS=100; readonly SECONDS; echo $SECONDS", "100\n"},
+	{"export RANDOM; RANDOM=7; a=$RANDOM; RANDOM=7; [[ $a == $RANDOM ]]", ""},
+	{`[[ $SHLVL -gt 0 && $(declare -p SHLVL) == "declare -x "* ]]`, ""},
 
 	// var manipulation
 	{"echo ${#a} ${#a[@]}", "0 0\n"},
@@ -685,6 +767,10 @@ var runTests = []runTest{
 		"while true; do exit 1; done",
 		"exit status 1",
 	},
+	{
+		"while exit 5; do true; done",
+		"exit status 5",
+	},
 	{
 		"while true; do break; done",
 		"",
@@ -1293,6 +1379,25 @@ var runTests = []runTest{
 		"mkdir a && cd a && echo foo >b && cd .. && cat a/b",
 		"foo\n",
 	},
+	{"exec 3>a; echo one >&3; echo two 1>&3; exec 3>&-; cat a", "one\ntwo\n"},
+	{"echo foo >&3", "3: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"echo foo 3>&4", "4: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"echo foo 3>&bar", "bar: ambiguous redirect\nexit status 1 #JUSTERR"},
+	{"echo foo 3>a; echo bar >&3", "foo\n3: bad file descriptor\nexit status 1"},
+	{"printf 'a\\nb\\n' >a; exec 4<a; read -u 4 x; read y <&4; echo $x $y", "a b\n"},
+	{"exec {fd}>a; echo $fd; echo foo >&$fd; exec {fd}>&-; cat a", "10\nfoo\n"},
+	{"exec {fd}>&-", "fd: ambiguous redirect\nexit status 1 #JUSTERR"},
+	{"exec 3<>a; echo foo >&3; exec 3>&-; cat a", "foo\n"},
+	{"echo foo >a; echo bar >|a; cat a", "bar\n"},
+	{"exec 3>&1; echo foo >&3; exec 3>&-; echo bar >&3", "foo\n3: bad file descriptor\nexit status 1"},
+	{"exec 3>a; exec 4>&3; exec 3>&-; echo foo >&4; exec 4>&-; cat a", "foo\n"},
+	{"if true; then exec >a; fi; echo foo; exec >&2; cat a", "foo\n"},
+	{"{ exec >a; } >b; echo foo; cat a b", "foo\n"},
+	{"(exec 3>a; echo foo >&3); cat a; echo bar >&3", "foo\n3: bad file descriptor\nexit status 1"},
+	{"exec 3>a; (exec 3>&-); echo foo >&3; cat a", "foo\n"},
+	{"exec 3>a; sh -c 'echo foo >&3'; cat a", "foo\n"},
+	{"echo foo >&a; cat a", "foo\n"},
+	{"exec 3<<<foo; read -u 3 x; echo $x", "foo\n"},
 
 	// background/wait
 	{"wait", ""},
@@ -1311,6 +1416,96 @@ var runTests = []runTest{
 		"f() { echo 1; }; { sleep 0.01s; f; } & f() { echo 2; }; wait",
 		"1\n",
 	},
+	{"echo \"[$!]\"; true & [[ -n $! ]]", "[]\n"},
+	{"{ exit 3; } & wait $!; echo $?", "3\n"},
+	{"{ exit 3; } & pid=$!; { exit 4; } & wait $pid; echo $?; wait %2; echo $?", "3\n4\n"},
+	{"{ exit 3; } & wait $! $!; echo $?; wait $!; echo $?", "3\n3\n"},
+	{
+		"{ exit 3; } & first=$!; for ((i = 0; i < 4096; i++)); do true & wait; done; wait $!; echo $?; wait $first",
+		"0\nwait: pid g1 is not a child of this shell\nexit status 127 #IGNORE bash remembers more statuses",
+	},
+	{"{ exit 5; } & wait -n; echo $?", "5\n"},
+	{"{ exit 5; } & wait -n %1; wait -n; echo $?", "127\n"},
+	{"{ exit 2; } & wait -n -p v; echo $?; [[ $v == $! ]]", "2\n"},
+	{"wait -n", "exit status 127"},
+	{"wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"wait 123456789", "wait: pid 123456789 is not a child of this shell\nexit status 127 #JUSTERR"},
+	{"wait -p", "wait: -p: invalid identifier \"\"\nexit status 2 #JUSTERR"},
+	{"wait -x", "wait: invalid option \"-x\"\nwait: usage: wait [-fn] [-p var] [id ...]\nexit status 2 #JUSTERR"},
+	{"true & wait; jobs; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{
+		"while true; do true; done & jobs; jobs -l %1; jobs -p; kill %1",
+		"[1]+  Running                 while true; do true; done &\n[1]+  g1 Running                 while true; do true; done &\ng1\n #IGNORE",
+	},
+	{
+		"while true; do true; done & true & jobs %1; kill %while; wait %1; echo $?",
+		"[1]-  Running                 while true; do true; done &\n143\n",
+	},
+	{
+		"{ exit 3; } & wait; jobs; jobs %1",
+		"jobs: %1: no such job\nexit status 1 #JUSTERR",
+	},
+	{"{ exit 3; } & fg; echo $?", "{ exit 3; }\n3\n"},
+	{"fg", "fg: current: no such job\nexit status 1 #JUSTERR"},
+	{"bg %2", "bg: %2: no such job\nexit status 1 #JUSTERR"},
+	{"while true; do true; done & bg; kill %1", "bg: job 1 already in background\n"},
+	{"true & disown; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"disown", "disown: current: no such job\nexit status 1 #JUSTERR"},
+	{"while true; do true; done & kill -s KILL %%; wait $!; echo $?", "137\n"},
+	{"while true; do true; done & kill -INT %1; wait; jobs", ""},
+	{"while true; do true; done & kill -0 %1; echo $?; kill -9 $!", "0\n"},
+	{"kill -l 9; kill -l 143; kill -l TERM; kill -l SIGHUP", "KILL\nTERM\n15\n1\n"},
+	{"kill -l FOO", "kill: FOO: invalid signal specification\nexit status 1 #JUSTERR"},
+	{"kill -FOO %1", "kill: FOO: invalid signal specification\nexit status 1 #JUSTERR"},
+	{"kill %1", "kill: %1: no such job\nexit status 1 #JUSTERR"},
+	{"kill foo", "kill: foo: arguments must be process or job IDs\nexit status 1 #JUSTERR"},
+	{
+		"kill",
+		"kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\nexit status 2 #JUSTERR",
+	},
+
+	// select
+	{
+		`select x in a b c; do echo "got $x $REPLY"; break; done <<< 2`,
+		"1) a\n2) b\n3) c\n#? got b 2\n",
+	},
+	{
+		`PS3="pick: "; select x in a b; do echo "[$x] $REPLY"; done < /dev/null; echo $?`,
+		"1) a\n2) b\npick: \n1\n",
+	},
+	{
+		"select x in a b; do echo \"[$x]\"; break; done <<< \"\n1\"",
+		"1) a\n2) b\n#? 1) a\n2) b\n#? [a]\n",
+	},
+	{
+		`select x in a; do echo "[$x] $REPLY"; break; done <<< foo`,
+		"1) a\n#? [] foo\n",
+	},
+	{
+		"COLUMNS=20; select x in aaaa bbbb cccc dddd eeee; do break; done <<< 1",
+		"1) aaaa\t 4) dddd\n2) bbbb\t 5) eeee\n3) cccc\n#? ",
+	},
+	{"select x in; do echo foo; done", ""},
+	{"set -- p q; select x; do echo $x; break; done <<< 2", "1) p\n2) q\n#? q\n"},
+
+	// coproc
+	{"coproc cat; echo hi >&${COPROC[1]}; read -u ${COPROC[0]} line; echo $line", "hi\n"},
+	{
+		"coproc mycat { cat; }; echo hi >&${mycat[1]}; read -u ${mycat[0]} x; echo $x; [[ $mycat_PID == $! ]] && echo same",
+		"hi\nsame\n",
+	},
+	{"coproc { echo one; echo two; }; read -u ${COPROC[0]} a; read -u ${COPROC[0]} b; echo $a $b", "one two\n"},
+	{"coproc { exit 3; }; wait $COPROC_PID; echo $?", "3\n"},
+	{"coproc { echo a; }; cat <&${COPROC[0]}", "a\n"},
+	{
+		// The ">&$fd" redirection must not keep the pipe open.
+		"coproc cat; fd=${COPROC[1]}; echo hi >&$fd; exec {fd}>&-; cat <&${COPROC[0]}; echo ok2",
+		"hi\nok2\n",
+	},
+	{"exec 3>f; echo a 2>&3 >&3; exec 4>&1 >f2; echo b; exec >&4 3>&-; echo c >>f; cat f f2", "a\nc\nb\n"},
+	{"echo hi >&7", "7: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"cat <&7", "7: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"read -u 7 x", "read: 7: invalid file descriptor: bad file descriptor\nexit status 1 #JUSTERR"},
 
 	// bash test
 	{
@@ -1796,6 +1991,14 @@ var runTests = []runTest{
 		"set -e; false; echo foo",
 		"exit status 1",
 	},
+	{
+		"set -e; (false); echo foo",
+		"exit status 1",
+	},
+	{
+		"set -e; (false) || echo foo",
+		"foo\n",
+	},
 	{
 		"set -e; shouldnotexist; echo foo",
 		"\"shouldnotexist\": executable file not found in $PATH\nexit status 127 #JUSTERR",
@@ -1952,6 +2155,8 @@ var runTests = []runTest{
 		"set -a; set +o",
 		`set -o allexport
 set +o errexit
+set +o errtrace
+set +o functrace
 set +o noexec
 set +o noglob
 set +o nounset
@@ -2071,6 +2276,47 @@ set +o pipefail
 	// TODO: our builtin appears to not receive the piped bytes?
 	// {"trap 'echo on_err' ERR; trap | grep -q '.*echo on_err.*'", "trap -- \"echo on_err\" ERR\n"},
 	{"trap 'false' ERR EXIT; false", "exit status 1"},
+	{
+		`trap 'echo at_exit' EXIT; trap "echo 'x'" INT; trap '' TERM; trap`,
+		`trap -- 'echo at_exit' EXIT` + "\n" +
+			`trap -- 'echo '\''x'\''' SIGINT` + "\n" +
+			`trap -- '' SIGTERM` + "\nat_exit\n",
+	},
+	{"trap 'echo a' INT SIGTERM; trap -p sigterm", "trap -- 'echo a' SIGTERM\n"},
+	{"trap 'echo a' INT; trap 2; trap -p", ""},
+	{"trap 'echo a' INT; trap - SIGINT; trap -p", ""},
+	{"trap 'echo a' INT TERM; trap INT; trap", "trap -- 'echo a' SIGTERM\n"},
+	{"trap -p FOO", "trap: FOO: invalid signal specification\nexit status 2 #JUSTERR"},
+	{`[[ "$(trap -l)" == "$(kill -l)" ]] && echo same`, "same\n"},
+	{
+		"{ trap 'echo got; exit 5' TERM; touch ready; while true; do true; done; } & until [[ -e ready ]]; do true; done; kill $!; wait $!; echo $?",
+		"got\n5\n",
+	},
+	{
+		"trap 'echo dbg' DEBUG; echo a; x=1; [[ 1 ]]; ((1)); trap - DEBUG; echo b",
+		"dbg\na\ndbg\ndbg\ndbg\ndbg\nb\n",
+	},
+	{"trap 'echo dbg $?' DEBUG; false; true", "dbg 0\ndbg 1\n"},
+	{"f() { echo in f; }; trap 'echo dbg' DEBUG; f; trap - DEBUG", "dbg\nin f\ndbg\n"},
+	{"f() { echo in f; }; trap 'echo ret' RETURN; f; set -T; f", "in f\nin f\nret\n"},
+	{"f() { trap 'echo ret' RETURN; }; f; g() { :; }; g; f", "ret\nret\n"},
+	{"g() { return 3; }; trap 'echo ret' RETURN; set -o functrace; g; echo $?", "ret\n3\n"},
+	{
+		"echo 'echo sourced; return 4' >a; trap 'echo ret' RETURN; source ./a; echo $?",
+		"sourced\nret\n4\n",
+	},
+	{"trap 'echo err' ERR; f() { false; echo after; }; f; echo end", "after\nend\n"},
+	{"set -E; trap 'echo err' ERR; f() { false; echo after; }; f; echo end", "err\nafter\nend\n"},
+	{"trap 'echo err' ERR; (false; echo after); echo end", "after\nend\n"},
+	{"set -o errtrace; trap 'echo err' ERR; (false; echo after); echo end", "err\nafter\nend\n"},
+	{"set -E; trap 'echo err' ERR; h() { false; }; h; echo \"rc=$?\"", "err\nerr\nrc=1\n"},
+	{"trap 'echo err; true' ERR; false; echo \"rc=$?\"", "err\nrc=1\n"},
+	{
+		"trap 'echo r' RETURN; trap 'echo e' ERR; trap 'echo d' debug; trap x INT; trap",
+		"d\nd\ntrap -- 'x' SIGINT\ntrap -- 'echo d' DEBUG\ntrap -- 'echo e' ERR\ntrap -- 'echo r' RETURN\n",
+	},
+	{"trap '' TERM; { sleep 0.01s; echo done; } & kill $!; wait $!; echo $?", "done\n0\n"},
+	{"trap 'echo got' TERM; { sleep 0.01s; echo done; } & kill $!; wait $!; echo $?", "143\n"},
 
 	// eval
 	{"eval", ""},
@@ -2305,6 +2551,47 @@ set +o pipefail
 	{"a='x=b y=c'; declare $a; echo $x $y", "b c\n"},
 	{"declare =bar", "declare: invalid name \"\"\nexit status 1 #JUSTERR"},
 	{"declare $unset=$unset", "declare: invalid name \"\"\nexit status 1 #JUSTERR"},
+	{"declare -i a=3+4; echo $a; a=a*2; echo $a; a+=1; echo $a", "7\n14\n15\n"},
+	{"declare -i a; a=x; x=5; echo $a; a=x; echo $a", "0\n5\n"},
+	{"declare -i a=; echo \"[$a]\"", "[0]\n"},
+	{"declare -i a; read a <<< '2*3'; echo $a", "6\n"},
+	{"declare -i a; ((a = 1 + 1)); echo $a", "2\n"},
+	{"a=3+4; declare -i a; echo $a; a=$a; echo $a", "3+4\n7\n"},
+	{"declare -i a=(1+1 2*3); echo ${a[@]}", "2 6\n"},
+	{"declare -i a; a='1 +'", "1 +: 1:3: + must be followed by an expression\nexit status 1 #JUSTERR"},
+	{"declare -i a; a='foo bar'", "foo bar: syntax error in expression (error token is \"bar\")\nexit status 1 #JUSTERR"},
+	{"declare -i a; a=' 1 + 2 '; echo $a", "3\n"},
+	{"declare -l a=FoO; echo $a; a+=BaR; echo $a", "foo\nfoobar\n"},
+	{"declare -u a; : ${a:=x}; echo $a; unset a; : ${a:=x}; echo $a", "X\nx\n"},
+	{"declare -l a=X; declare -u a; echo $a; a=y; echo $a", "x\nY\n"},
+	{"declare -ul a=X; echo $a", "x\n"},
+	{"declare -l a; declare +l a; a=X; echo $a", "X\n"},
+	{"declare -i a; declare +i a; a=1+1; echo $a", "1+1\n"},
+	{"declare -x a=b; declare +x a; $ENV_PROG | grep '^a='", "exit status 1"},
+	{"typeset -i a=2*2; echo $a", "4\n"},
+	{"f() { typeset a=b; }; a=c; f; echo $a", "c\n"},
+	{"declare a=b; declare -p a", "declare -- a=\"b\"\n"},
+	{"declare -irx a=1; declare -p a", "declare -irx a=\"1\"\n"},
+	{"declare -l a=B; declare -u b=c; declare -p a b", "declare -l a=\"b\"\ndeclare -u b=\"C\"\n"},
+	{"a='x\"$`\\y'; declare -p a", "declare -- a=\"x\\\"\\$\\`\\\\y\"\n"},
+	{"a=$'x\\ny'; declare -p a", "declare -- a=$'x\\ny'\n"},
+	{"a=(x 'y z'); declare -p a", "declare -a a=([0]=\"x\" [1]=\"y z\")\n"},
+	{"declare -A a=([y]=2 [x]=1); declare -p a", "declare -A a=([x]=\"1\" [y]=\"2\" )\n #IGNORE bash doesn't sort keys"},
+	{"declare -n a=b; declare -p a", "declare -n a=\"b\"\n"},
+	{"declare -i a; declare -p a", "declare -i a\n"},
+	{"declare -p a", "declare: a: not found\nexit status 1 #JUSTERR"},
+	{"declare -p ''", "declare: : not found\nexit status 1 #JUSTERR"},
+	{"a=b; eval \"$(declare -p a)\"; declare -p a", "declare -- a=\"b\"\n"},
+	{"a=(x y); s=$(declare -p a); unset a; eval \"$s\"; echo ${a[1]}", "y\n"},
+	{"a=b c=d; declare -p | grep -E '^declare -- (a|c)='", "declare -- a=\"b\"\ndeclare -- c=\"d\"\n"},
+	{"f() { local a=b; declare -p a; }; f", "declare -- a=\"b\"\n"},
+	{"f() { echo foo; }; declare -f f", "f() { echo foo; }\n #IGNORE bash formats functions differently"},
+	{"f() { :; }; g() { :; }; declare -f", "f() { :; }\ng() { :; }\n #IGNORE bash formats functions differently"},
+	{"f() { :; }; g() { :; }; declare -F", "declare -f f\ndeclare -f g\n"},
+	{"f() { :; }; declare -F f", "f\n"},
+	{"declare -f f", "exit status 1"},
+	{"declare -F f", "exit status 1"},
+	{"trap 'echo ret' RETURN; f() { echo f; }; f; declare -ft f; f", "f\nf\nret\n"},
 
 	// export
 	{"declare foo=bar; $ENV_PROG | grep '^foo='", "exit status 1"},
@@ -2469,6 +2756,40 @@ set +o pipefail
 		"declare -r -x foo=bar; foo=x",
 		"foo: readonly variable\nexit status 1 #JUSTERR",
 	},
+	{
+		"readonly a=1; b=2; declare +r a b; echo $? $a; b=3; echo $b",
+		"declare: a: readonly variable\n1 1\n3\n #JUSTERR",
+	},
+
+	// restricted mode
+	{"set -r; cd /", "1:9: cd: restricted\nexit status 1 #JUSTERR"},
+	{"set -r; f() { cd /; }; (f); echo $?", "1:15: cd: restricted\n1\n #IGNORE"},
+	{"set -r; pushd /", "1:9: pushd: restricted\nexit status 1 #JUSTERR"},
+	{
+		"set -r; /bin/sh -c true",
+		"1:9: /bin/sh: restricted: cannot specify `/' in command names\nexit status 1 #JUSTERR",
+	},
+	{
+		"set -r; command ./foo",
+		"1:9: ./foo: restricted: cannot specify `/' in command names\nexit status 1 #JUSTERR",
+	},
+	{"set -r; echo foo >f; echo $?", "1:18: f: restricted: cannot redirect output\n1\n #JUSTERR"},
+	{"set -r; echo foo >>f", "1:18: f: restricted: cannot redirect output\nexit status 1 #JUSTERR"},
+	{"set -r; echo foo &>f", "1:18: f: restricted: cannot redirect output\nexit status 1 #JUSTERR"},
+	{"set -r; echo foo >&f", "1:18: f: restricted: cannot redirect output\nexit status 1 #JUSTERR"},
+	{"set -r; true 3<>f", "1:14: f: restricted: cannot redirect output\nexit status 1 #JUSTERR"},
+	{"set -r; echo foo 2>&1; echo bar >&2; read x </dev/null; echo $?", "foo\nbar\n1\n"},
+	{"set -r; exec true", "1:9: exec: restricted\nexit status 1 #JUSTERR"},
+	{"set -r; exec 3</dev/null; echo ok", "ok\n"},
+	{"set -r; . ./foo", "1:9: .: ./foo: restricted\nexit status 1 #JUSTERR"},
+	{"set -r; set +r; echo $?", "set: invalid option: \"+r\"\n2\n #JUSTERR"},
+	{"set +r; set -r; set -r; echo ok", "ok\n"},
+	{"set -r; PATH=/foo; echo $?", "PATH: readonly variable\n1\n #IGNORE bash only restricts them at startup"},
+	{
+		"set -r; unset ENV; ENV=foo; echo ${ENV-unset}",
+		"ENV: readonly variable\nunset\n #IGNORE",
+	},
+	{"set -r; declare -p ENV", "declare -r ENV\n #IGNORE"},
 
 	// globbing
 	{"echo .", ".\n"},
@@ -2715,6 +3036,172 @@ set +o pipefail
 		"read -r -p 'Prompt and raw flag together: ' a <<< '\\a\\b\\c'; echo $a",
 		"Prompt and raw flag together: \\a\\b\\c\n #IGNORE bash requires a terminal",
 	},
+	{
+		"x=foo; read x </dev/null; echo \"[$x] $?\"",
+		"[] 1\n",
+	},
+	{
+		"printf 'a b' >f; read x y <f; echo \"[$x] [$y] $?\"",
+		"[a] [b] 1\n",
+	},
+	{
+		"read -r -d : a b <<< 'x y:z'; echo \"[$a] [$b] $?\"",
+		"[x] [y] 0\n",
+	},
+	{
+		"read -d : a <<< 'x\\:y:z'; echo \"[$a]\"",
+		"[x:y]\n",
+	},
+	{
+		"printf 'a\\0b c\\0\\n' >f; while IFS= read -r -d '' x; do echo \"[$x]\"; done <f",
+		"[a]\n[b c]\n",
+	},
+	{
+		"read -n 3 a b <<< 'x y z'; echo \"[$a] [$b] $?\"",
+		"[x] [y] 0\n",
+	},
+	{
+		"read -n 5 a <<< 'xy'; echo \"[$a] $?\"",
+		"[xy] 0\n",
+	},
+	{
+		"read -n 2 a <<< 'x\\ yz'; echo \"[$a]\"",
+		"[x ]\n",
+	},
+	{
+		"read -N 5 a b <<< 'x y'; echo \"[$a] [$b] $?\"",
+		"[x y\n] [] 1\n",
+	},
+	{
+		"printf 'x y\\nz w' >f; read -N 5 a <f; echo \"[$a] $?\"",
+		"[x y\nz] 0\n",
+	},
+	{
+		"read -N 3 a <<< 'x\\yzw'; echo \"[$a]\"",
+		"[xyz]\n",
+	},
+	{
+		"a=foo; read -n 0 a <<< 'x'; echo \"[$a] $?\"",
+		"[] 0\n",
+	},
+	{
+		"read -n x a",
+		"read: x: invalid number\nexit status 1 #JUSTERR",
+	},
+	{
+		"read -a arr <<< ' x  y z '; echo ${#arr[@]} \"[${arr[0]}]\" \"[${arr[2]}]\"",
+		"3 [x] [z]\n",
+	},
+	{
+		"arr=(a b c d); read -a arr <<< 'x y'; echo ${#arr[@]} ${arr[@]}",
+		"2 x y\n",
+	},
+	{
+		"read -a",
+		"read: -a: option requires an argument\nexit status 2 #JUSTERR",
+	},
+	{
+		"read -t 0 </dev/null; echo $?",
+		"0\n",
+	},
+	{
+		"a=foo; read -t 0 a <<< 'x'; echo \"[$a] $?\"",
+		"[foo] 0\n",
+	},
+	{
+		"read -t 1 a <<< 'x'; echo \"[$a] $?\"",
+		"[x] 0\n",
+	},
+	{
+		"read -t -1 a",
+		"read: -1: invalid timeout specification\nexit status 1 #JUSTERR",
+	},
+	{
+		"exec 3<<<'x y'; read -u 3 a b; echo \"[$a] [$b]\"",
+		"[x] [y]\n",
+	},
+	{
+		"read -s a <<< 'x'; echo \"[$a]\"",
+		"[x]\n",
+	},
+	{
+		"read -e -i foo a <<< 'x'; echo \"[$a]\"",
+		"[x]\n",
+	},
+
+	// mapfile
+	{
+		"printf 'a\\nb c\\n' >f; mapfile <f; echo ${#MAPFILE[@]}; printf '[%s]' \"${MAPFILE[@]}\"",
+		"2\n[a\n][b c\n]",
+	},
+	{
+		"printf 'a\\nb' >f; mapfile -t arr <f; printf '[%s]' \"${arr[@]}\"",
+		"[a][b]",
+	},
+	{
+		"arr=(x y); mapfile arr </dev/null; echo ${#arr[@]}",
+		"0\n",
+	},
+	{
+		"printf 'a:b:' >f; mapfile -d : arr <f; printf '[%s]' \"${arr[@]}\"",
+		"[a:][b:]",
+	},
+	{
+		"printf 'a\\0b\\0c' >f; readarray -t -d '' arr <f; printf '[%s]' \"${arr[@]}\"",
+		"[a][b][c]",
+	},
+	{
+		"printf '1\\n2\\n3\\n4\\n' >f; mapfile -t -s 1 -n 2 arr <f; printf '[%s]' \"${arr[@]}\"",
+		"[2][3]",
+	},
+	{
+		"arr=(w x y z); printf '1\\n2\\n' >f; mapfile -t -O 1 arr <f; printf '[%s]' \"${arr[@]}\"",
+		"[w][1][2][z]",
+	},
+	{
+		"arr=(w); printf '1\\n' >f; mapfile -t -O 3 arr <f; echo ${arr[3]}",
+		"1\n",
+	},
+	{
+		"printf '1\\n2\\n3\\n' >f; mapfile -t -C 'echo cb' -c 2 arr <f; printf '[%s]' \"${arr[@]}\"",
+		"cb 1 2\n[1][2][3]",
+	},
+	{
+		"printf 'a b\\n' >f; f() { echo \"$#:$2:${#arr[@]}\"; }; mapfile -C f -c 1 arr <f",
+		"2:a b\n:0\n",
+	},
+	{
+		"exec 3<<<'a'; mapfile -t -u 3 arr; echo ${arr[0]}",
+		"a\n",
+	},
+	{
+		"mapfile -u 7",
+		"mapfile: 7: invalid file descriptor: bad file descriptor\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -n x",
+		"mapfile: x: invalid line count\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -O -1",
+		"mapfile: -1: invalid array origin\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -c 0",
+		"mapfile: 0: invalid callback quantum\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -C",
+		"mapfile: -C: option requires an argument\nexit status 2 #JUSTERR",
+	},
+	{
+		"readarray -X",
+		"readarray: invalid option \"-X\"\nexit status 2 #JUSTERR",
+	},
+	{
+		"mapfile 0x </dev/null",
+		"mapfile: invalid identifier \"0x\"\nexit status 1 #JUSTERR",
+	},
 
 	// getopts
 	{
@@ -2781,6 +3268,62 @@ set +o pipefail
 
 var runTestsUnix = []runTest{
 	{"[[ -n $PPID && $PPID -gt 0 ]]", ""},
+
+	// umask
+	{"umask 0077; umask", "0077\n"},
+	{"umask 022; umask -S", "u=rwx,g=rx,o=rx\n"},
+	{"umask u=rwx,g=rx,o=; umask", "0027\n"},
+	{"umask 022; umask g-x,o+w; umask", "0030\n"},
+	{"umask 022; umask +x; umask", "0022\n"},
+	{"umask 022; umask -p; umask -p -S", "umask 0022\numask -S u=rwx,g=rx,o=rx\n"},
+	{"umask -S 027", "u=rwx,g=rx,o=\n"},
+	{"umask 022; (umask 077; umask); umask", "0077\n0022\n"},
+	{"umask 077; >f; set -- $(ls -l f); echo $1", "-rw-------\n"},
+	{
+		"umask 8",
+		"umask: 8: octal number out of range\nexit status 1 #JUSTERR",
+	},
+	{
+		"umask ''",
+		"umask: invalid symbolic mode\nexit status 1 #JUSTERR",
+	},
+	{
+		"umask u=z",
+		"umask: `z': invalid symbolic mode character\nexit status 1 #JUSTERR",
+	},
+	{
+		"umask -q",
+		"umask: invalid option \"-q\"\nexit status 2 #JUSTERR",
+	},
+
+	// ulimit
+	{"ulimit -Sn 50; ulimit -Sn; ulimit -n", "50\n50\n"},
+	{"(ulimit -Sn 40); ulimit -Sn 30; ulimit -Sn", "30\n"},
+	{"ulimit -n 40; ulimit -Hn; ulimit -Sn 20; ulimit -n", "40\n20\n"},
+	{
+		"ulimit -n 40; ulimit -n 50",
+		"ulimit: open files: cannot modify limit: operation not permitted\nexit status 1 #JUSTERR",
+	},
+	{
+		"ulimit -n 40; ulimit -n unlimited",
+		"ulimit: open files: cannot modify limit: operation not permitted\nexit status 1 #JUSTERR",
+	},
+	{
+		"ulimit -n 40; ulimit -Sn 41",
+		"ulimit: open files: cannot modify limit: invalid argument\nexit status 1 #JUSTERR",
+	},
+	{
+		"ulimit -n x",
+		"ulimit: x: invalid number\nexit status 1 #JUSTERR",
+	},
+	{
+		"ulimit -n 1 2",
+		"ulimit: too many arguments\nexit status 2 #JUSTERR",
+	},
+	{
+		"ulimit -y",
+		"ulimit: invalid option \"-y\"\nexit status 2 #JUSTERR",
+	},
 	{
 		// no root user on windows
 		"[[ ~root == '~root' ]]",
@@ -3117,6 +3660,17 @@ hello, world
 hello, world
 `,
 	},
+	// trace prefix and output
+	{"echo $PS4", "+\n"},
+	{`PS4='+$LINENO: '; set -x; echo a`, "+1: echo a\na\n"},
+	{"PS4='L$LINENO '\nset -x\necho a\n\necho b", "L3 echo a\na\nL5 echo b\nb\n"},
+	{`PS4='$(echo X) '; set -x; echo a`, "X echo a\na\n"},
+	{"unset PS4; set -x; echo a", "echo a\na\n"},
+	{"set -x; x=$(echo $(echo b))", "+++ echo b\n++ echo b\n+ x=b\n"},
+	{"set -x; echo a 2>/dev/null; { echo b; } 2>/dev/null", "+ echo a\na\nb\n"},
+	{"exec 7>&1; BASH_XTRACEFD=7; set -x; echo a 7>/dev/null 2>/dev/null", "+ echo a\na\n"},
+	{"exec 7>&1; BASH_XTRACEFD=7; set -x; { echo a; } 7>/dev/null", "a\n"},
+	{"BASH_XTRACEFD=7; set -x; echo a 2>/dev/null", "+ echo a\na\n #IGNORE bash errors on invalid fds"},
 }
 
 var runTestsWindows = []runTest{
@@ -3625,81 +4179,916 @@ func TestRunnerOpts(t *testing.T) {
 	}
 }
 
-func TestRunnerContext(t *testing.T) {
+func TestRunnerBuiltins(t *testing.T) {
 	t.Parallel()
 
-	cases := []string{
-		"",
-		"while true; do true; done",
-		"until false; do true; done",
-		"sleep 1000",
-		"while true; do true; done & wait",
-		"sleep 1000 & wait",
-		"(while true; do true; done)",
-		"$(while true; do true; done)",
-		"while true; do true; done | while true; do true; done",
+	builtins := map[string]BuiltinFunc{
+		"set_output": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			if len(args) != 3 {
+				fmt.Fprintf(bc.Stderr(), "usage: %s KEY VALUE\n", args[0])
+				return NewExitStatus(2)
+			}
+			vr := expand.Variable{Kind: expand.String, Str: args[2]}
+			if err := bc.SetVar(args[1], vr); err != nil {
+				fmt.Fprintf(bc.Stderr(), "%s: %v\n", args[0], err)
+				return NewExitStatus(1)
+			}
+			return nil
+		},
+		"set_list": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			return bc.SetVar("LIST", expand.Variable{Kind: expand.Indexed, List: args[1:]})
+		},
+		"get": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			vr := bc.Var(args[1])
+			fmt.Fprintf(bc.Stdout(), "%v %q\n", vr.IsSet(), vr.String())
+			return nil
+		},
+		"opt": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			fmt.Fprintln(bc.Stdout(), bc.Option(args[1]))
+			return nil
+		},
+		"goto": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			if err := bc.Chdir(args[1]); err != nil {
+				fmt.Fprintln(bc.Stderr(), "goto: no such directory")
+				return NewExitStatus(1)
+			}
+			return nil
+		},
+		"write_fd": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			n, _ := strconv.Atoi(args[1])
+			_, w := bc.Fd(n)
+			if w == nil {
+				return NewExitStatus(1)
+			}
+			_, err := fmt.Fprintln(w, args[2])
+			return err
+		},
+		"params": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			fmt.Fprintln(bc.Stdout(), bc.Params(), bc.Func("f") != nil)
+			return nil
+		},
+		"fatal": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			return fmt.Errorf("fatal error")
+		},
+		"true": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+			fmt.Fprintln(bc.Stdout(), "custom true")
+			return nil
+		},
 	}
-	p := syntax.NewParser()
-	for _, in := range cases {
+	tests := []struct {
+		in, want string
+	}{
+		{"set_output KEY value; echo $KEY", "value\n"},
+		{"set_output KEY; echo $?", "usage: set_output KEY VALUE\n2\n"},
+		{"set_output 1KEY value", "set_output: invalid variable name: \"1KEY\"\nexit status 1"},
+		{"readonly KEY=x; set_output KEY y", "set_output: KEY: readonly variable\nexit status 1"},
+		{"declare -i KEY; set_output KEY '1 +'; echo $?", "1 +: 1:3: + must be followed by an expression\nset_output: KEY: invalid value\n1\n"},
+		{
+			"f() { local KEY=old; set_output KEY new; echo $KEY; }; f; echo \"[$KEY]\"",
+			"new\n[]\n",
+		},
+		{"export KEY=old; set_output KEY new; $ENV_PROG | grep '^KEY='", "KEY=new\n"},
+		{"declare -n ref=KEY; set_output ref value; echo $KEY", "value\n"},
+		{"set_list a 'b c'; echo ${#LIST[@]} \"${LIST[1]}\"", "2 b c\n"},
+		{"KEY=value; get KEY; get UNSET", "true \"value\"\nfalse \"\"\n"},
+		{"opt errexit; set -e; opt errexit; shopt -s globstar; opt globstar; opt bogus", "false\ntrue\ntrue\nfalse\n"},
+		{"mkdir d; goto d; echo ${PWD##*/}; goto missing", "d\ngoto: no such directory\nexit status 1"},
+		{"exec 3>f; write_fd 3 hello; exec 3>&-; read x <f; echo $x", "hello\n"},
+		{"write_fd 4 hello", "exit status 1"},
+		{"f() { :; }; set -- a b; params", "[a b] true\n"},
+		{"fatal; echo unreachable", "fatal error"},
+		{"true", "custom true\n"},
+		{"true() { echo func; }; true", "func\n"},
+		{"echo $(set_output KEY value; echo $KEY) \"[$KEY]\"", "value []\n"},
+		{
+			"type set_output; type -t set_output; command -v set_output",
+			"set_output is a shell builtin\nbuiltin\nset_output\n",
+		},
+		{
+			"set_output() { echo func; }; builtin set_output KEY value; command set_output KEY2 value2; echo $KEY $KEY2",
+			"value value2\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
 		t.Run("", func(t *testing.T) {
-			file := parse(t, p, in)
-			ctx, cancel := context.WithCancel(context.Background())
-			cancel()
-			r, _ := New()
-			errChan := make(chan error)
-			go func() {
-				errChan <- r.Run(ctx, file)
-			}()
-
-			timeout := 500 * time.Millisecond
-			select {
-			case err := <-errChan:
-				if err != nil && err != ctx.Err() {
-					t.Fatal("Runner did not use ctx.Err()")
-				}
-			case <-time.After(timeout):
-				t.Fatalf("program was not killed in %s", timeout)
+			t.Parallel()
+			file := parse(t, nil, test.in)
+			var cb concBuffer
+			r, err := New(Dir(t.TempDir()), StdIO(nil, &cb, &cb),
+				Builtins(builtins),
+				ExecHandler(testExecHandler),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
 			}
 		})
 	}
-}
-
-func TestRunnerAltNodes(t *testing.T) {
-	t.Parallel()
 
-	in := "echo foo"
-	file := parse(t, nil, in)
-	want := "foo\n"
-	nodes := []syntax.Node{
-		file,
-		file.Stmts[0],
-		file.Stmts[0].Cmd,
-	}
-	for _, node := range nodes {
-		var cb concBuffer
-		r, _ := New(StdIO(nil, &cb, &cb))
-		ctx, cancel := context.WithTimeout(context.Background(), runnerRunTimeout)
-		defer cancel()
-		if err := r.Run(ctx, node); err != nil {
-			cb.WriteString(err.Error())
-		}
-		if got := cb.String(); got != want {
-			t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
-				in, want, got)
-		}
+	if _, err := New(Builtins(map[string]BuiltinFunc{"a/b": builtins["true"]})); err == nil {
+		t.Fatal("expected an error for an invalid builtin name")
 	}
 }
 
-func TestElapsedString(t *testing.T) {
+func TestRunnerRestricted(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		in    time.Duration
-		posix bool
-		want  string
+		in, want string
 	}{
-		{time.Nanosecond, false, "0m0.000s"},
-		{time.Millisecond, false, "0m0.001s"},
+		{"echo foo", "foo\n"},
+		{"PATH=/foo", "PATH: readonly variable\nexit status 1"},
+		{"SHELL=/bin/sh; echo $?", "SHELL: readonly variable\n1\n"},
+		{"f() { local BASH_ENV=foo; }; f", "BASH_ENV: readonly variable\nexit status 1"},
+		{"enable -n echo", "1:1: enable: restricted\nexit status 1"},
+		{"set +r", "set: invalid option: \"+r\"\nexit status 2"},
+		{"set +o | while read _ _ name; do [[ -n $name ]] || echo empty; done; echo ok", "ok\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			file := parse(t, nil, test.in)
+			var cb concBuffer
+			r, err := New(StdIO(nil, &cb, &cb),
+				Restricted(true),
+				Env(expand.ListEnviron("PATH="+os.Getenv("PATH"))),
+				Builtins(map[string]BuiltinFunc{
+					"enable": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+						return nil
+					},
+				}),
+				ExecHandler(testExecHandler),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Restricted mode stays enabled after a Reset.
+			r.Reset()
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerCallStack(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	lib := `echo "lib: ${FUNCNAME[*]} | ${BASH_SOURCE[*]} | ${BASH_LINENO[*]}"
+g() {
+	echo "g: ${FUNCNAME[*]} | ${BASH_SOURCE[*]} | ${BASH_LINENO[*]}"
+	caller; caller 0; caller 1; caller 2; echo $? $LINENO
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(lib), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := `echo "top: ${FUNCNAME+set} | ${BASH_SOURCE[*]} | ${BASH_LINENO[*]}"
+caller
+f() {
+	source ./lib.sh
+	g
+}
+
+f
+`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	r, _ := New(Dir(dir), StdIO(nil, &buf, &buf))
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	// Output taken from Bash 5.2 running "bash main.sh".
+	want := `top:  | main.sh | 0
+0 NULL
+lib: source f main | ./lib.sh main.sh main.sh | 4 8 0
+g: g f main | ./lib.sh main.sh main.sh | 5 8 0
+5 main.sh
+5 f main.sh
+8 main main.sh
+1 4
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestRunnerExitError(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	lib := "install_pkg() {\n\techo installing\n\tfalse $1\n\techo unreachable\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(lib), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		src   string
+		args  []string
+		trace string
+	}{
+		{
+			"set -e\nsource lib.sh\ntrue\ninstall_pkg foo\n",
+			[]string{"false", "foo"},
+			"lib.sh:3 in install_pkg <- main: false exited 1",
+		},
+		{
+			"f() {\n\t(exit 3)\n}\nf || exit\n",
+			[]string{"f"},
+			"main.sh:4 in main: f exited 3",
+		},
+		{
+			"set -e\n(false x)\necho unreachable\n",
+			[]string{"false", "x"},
+			"main.sh:2 in main: false exited 1",
+		},
+		{
+			"trap 'true' EXIT\nfalse x || exit\n",
+			[]string{"false", "x"},
+			"main.sh:2 in main: false exited 1",
+		},
+		{"false\n", nil, ""},
+		{"exit 3\n", nil, ""},
+		{"false\nexit 3\n", nil, ""},
+		{"f() {\n\texit 4\n}\nfalse || f\n", nil, ""},
+		{"set -e\n(exit 3)\n", nil, ""},
+		{"false\ntrue\n", nil, ""},
+		{"false || true\n", nil, ""},
+		{"f() { false; }\nf; ! true\n", nil, ""},
+	}
+	for _, tc := range tests {
+		file, err := syntax.NewParser().Parse(strings.NewReader(tc.src), "main.sh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := New(Dir(dir), StdIO(nil, io.Discard, io.Discard))
+		err = r.Run(context.Background(), file)
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			if tc.args != nil {
+				t.Errorf("%q: got %#v, want an ExitError", tc.src, err)
+			}
+			continue
+		}
+		if tc.args == nil {
+			t.Errorf("%q: got unexpected ExitError %q", tc.src, exitErr.StackTrace())
+			continue
+		}
+		if _, ok := IsExitStatus(err); !ok {
+			t.Errorf("%q: IsExitStatus does not support ExitError", tc.src)
+		}
+		if !reflect.DeepEqual(exitErr.Args, tc.args) {
+			t.Errorf("%q: got args %q, want %q", tc.src, exitErr.Args, tc.args)
+		}
+		if got := exitErr.StackTrace(); got != tc.trace {
+			t.Errorf("%q: got trace %q, want %q", tc.src, got, tc.trace)
+		}
+	}
+}
+
+func TestRunnerDebugHandler(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "lib.sh"), []byte("g() {\n\techo g\n}\ng\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := "f() {\n\tsource lib.sh\n}\nf\necho $x\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cb concBuffer
+	r, err := New(Dir(dir), StdIO(nil, &cb, &cb),
+		DebugHandler(func(ctx context.Context, dc *DebugContext) error {
+			var frames []string
+			for _, frame := range dc.Stack {
+				frames = append(frames, fmt.Sprintf("%s@%s:%d", frame.Func, frame.File, frame.Pos.Line()))
+			}
+			fmt.Fprintf(&cb, "[%s]\n", strings.Join(frames, " "))
+			if dc.Func("g") != nil && dc.Var("x").String() == "" {
+				dc.SetVar("x", expand.Variable{Kind: expand.String, Str: "set by the handler"})
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	want := `[main@main.sh:1]
+[main@main.sh:4]
+[f@main.sh:1 main@main.sh:4]
+[f@main.sh:2 main@main.sh:4]
+[source@lib.sh:1 f@main.sh:2 main@main.sh:4]
+[source@lib.sh:4 f@main.sh:2 main@main.sh:4]
+[g@lib.sh:1 source@lib.sh:4 f@main.sh:2 main@main.sh:4]
+[g@lib.sh:2 source@lib.sh:4 f@main.sh:2 main@main.sh:4]
+g
+[main@main.sh:5]
+set by the handler
+`
+	if got := cb.String(); got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+
+	// Returning an exit status exits the shell.
+	r, _ = New(DebugHandler(func(ctx context.Context, dc *DebugContext) error {
+		if dc.Stmt.Pos().Line() == 2 {
+			return NewExitStatus(3)
+		}
+		return nil
+	}))
+	file = parse(t, nil, "true\nfalse\ntrue")
+	if err := r.Run(context.Background(), file); err == nil || err.Error() != "exit status 3" {
+		t.Fatalf("want exit status 3, got %v", err)
+	}
+}
+
+var debuggerTests = []struct {
+	setup   func(d *Debugger)
+	actions []DebugAction
+	want    string
+}{
+	{
+		func(d *Debugger) {},
+		[]DebugAction{DebugStepIn, DebugStepIn, DebugStepIn, DebugStepIn, DebugStepIn, DebugContinue},
+		"stop main:1\nstop main:6\nstop main:7\nstop f:1\nstop f:2\nf1\nstop f:3\nf2\nf3\nb\n",
+	},
+	{
+		func(d *Debugger) {},
+		[]DebugAction{DebugStepOver, DebugStepOver, DebugStepOver, DebugContinue},
+		"stop main:1\nstop main:6\nstop main:7\nf1\nf2\nf3\nstop main:8\nb\n",
+	},
+	{
+		func(d *Debugger) {},
+		[]DebugAction{DebugStepIn, DebugStepIn, DebugStepIn, DebugStepIn, DebugStepOut, DebugContinue},
+		"stop main:1\nstop main:6\nstop main:7\nstop f:1\nstop f:2\nf1\nf2\nf3\nstop main:8\nb\n",
+	},
+	{
+		func(d *Debugger) { d.AddBreakpoint("main.sh", 3) },
+		[]DebugAction{DebugContinue, DebugStepOver, DebugContinue},
+		"stop main:1\nf1\nstop f:3\nf2\nstop f:4\nf3\nb\n",
+	},
+	{
+		func(d *Debugger) {
+			d.AddBreakpoint("", 4)
+			d.RemoveBreakpoint("", 4)
+			d.AddFuncBreakpoint("f")
+		},
+		[]DebugAction{DebugContinue, DebugContinue},
+		"stop main:1\nstop f:1\nf1\nf2\nf3\nb\n",
+	},
+	{
+		func(d *Debugger) { d.AddBreakpoint("/other/main.sh", 3) },
+		[]DebugAction{DebugContinue},
+		"stop main:1\nf1\nf2\nf3\nb\n",
+	},
+}
+
+func TestDebugger(t *testing.T) {
+	t.Parallel()
+
+	src := "f() {\n\techo f1\n\techo f2\n\techo f3\n}\n: a\nf\necho b\n"
+	for _, test := range debuggerTests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cb concBuffer
+			actions := test.actions
+			d := NewDebugger(DebugStepIn, func(ctx context.Context, dc *DebugContext) (DebugAction, error) {
+				fmt.Fprintf(&cb, "stop %s:%d\n", dc.Stack[0].Func, dc.Stmt.Pos().Line())
+				if len(actions) == 0 {
+					return 0, fmt.Errorf("ran out of actions")
+				}
+				action := actions[0]
+				actions = actions[1:]
+				return action, nil
+			})
+			test.setup(d)
+			r, _ := New(StdIO(nil, &cb, &cb), DebugHandler(d.Handle))
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Fatal(err)
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output:\nwant: %q\ngot:  %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerCoverage(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	lib := "f() {\n\tcase $1 in\n\ta) echo a ;;\n\tb) echo b ;;\n\tesac\n}\ng() {\n\techo g\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(lib), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := "source lib.sh\nif [[ $1 ]]; then\n\tf $1\nelse\n\techo none\nfi\ntrue && f c || echo x\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coverage := NewCoverageProfile()
+	for _, arg := range []string{"a", "a"} {
+		r, _ := New(Dir(dir), Params(arg), StdIO(nil, io.Discard, io.Discard), Coverage(coverage))
+		if err := r.Run(context.Background(), file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := coverage.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:lib.sh
+FN:1,f
+FN:7,g
+FNDA:4,f
+FNDA:0,g
+FNF:2
+FNH:1
+BRDA:2,0,0,2
+BRDA:2,0,1,0
+BRDA:2,0,2,2
+BRF:3
+BRH:2
+DA:1,4
+DA:2,4
+DA:3,2
+DA:4,0
+DA:7,2
+DA:8,0
+LF:6
+LH:4
+end_of_record
+TN:
+SF:main.sh
+FNF:0
+FNH:0
+BRDA:2,0,0,2
+BRDA:2,0,1,0
+BRDA:7,1,0,2
+BRDA:7,1,1,0
+BRDA:7,2,0,0
+BRDA:7,2,1,2
+BRF:6
+BRH:3
+DA:1,2
+DA:2,2
+DA:3,2
+DA:5,0
+DA:7,2
+LF:5
+LH:4
+end_of_record
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong LCOV output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	buf.Reset()
+	if err := coverage.WriteCobertura(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var cov coberturaCoverage
+	if err := xml.Unmarshal(buf.Bytes(), &cov); err != nil {
+		t.Fatal(err)
+	}
+	if cov.LinesCovered != 8 || cov.LinesValid != 11 || cov.BranchesCovered != 5 || cov.BranchesValid != 9 {
+		t.Fatalf("wrong Cobertura totals: %d/%d lines, %d/%d branches",
+			cov.LinesCovered, cov.LinesValid, cov.BranchesCovered, cov.BranchesValid)
+	}
+	if len(cov.Packages) != 1 || len(cov.Packages[0].Classes) != 2 {
+		t.Fatalf("want one Cobertura package with two classes, got %#v", cov.Packages)
+	}
+
+	// Code which isn't part of a file must not be counted for one, even
+	// when its offsets match those of the file's statements.
+	file, err = syntax.NewParser().Parse(strings.NewReader("true\neval true\ntrap true EXIT\n"), "eval.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coverage = NewCoverageProfile()
+	r, _ := New(StdIO(nil, io.Discard, io.Discard), Coverage(coverage))
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := coverage.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "DA:1,1\n"; !strings.Contains(got, want) {
+		t.Fatalf("LCOV output lacks %q:\n%s", want, got)
+	}
+}
+
+func TestRunnerProfile(t *testing.T) {
+	t.Parallel()
+
+	src := "f() {\n\tfor i in 1 2 3; do\n\t\ttrue\n\tdone\n}\nf\nf\necho foo | cat\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiler := NewProfiler()
+	r, _ := New(StdIO(nil, io.Discard, io.Discard), Profile(profiler), ExecHandler(testExecHandler))
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, s := range profiler.samples {
+		var frames []string
+		for _, frame := range s.stack {
+			frames = append(frames, fmt.Sprintf("%s:%d", frame.Func, frame.Pos.Line()))
+		}
+		got = append(got, fmt.Sprintf("%s %d", strings.Join(frames, " "), s.calls))
+	}
+	sort.Strings(got)
+	want := []string{
+		"builtin echo:0 main:8 1",
+		"builtin true:0 f:3 main:6 3",
+		"builtin true:0 f:3 main:7 3",
+		"exec cat:0 main:8 1",
+		"f:1 main:6 1",
+		"f:1 main:7 1",
+		"f:2 main:6 1",
+		"f:2 main:7 1",
+		"f:3 main:6 3",
+		"f:3 main:7 3",
+		"main:1 1",
+		"main:6 1",
+		"main:7 1",
+		"main:8 3",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("wrong samples:\nwant:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	var buf bytes.Buffer
+	if err := profiler.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"calls", "wall", "nanoseconds", "builtin true", "main.sh"} {
+		if !bytes.Contains(pb, []byte(s)) {
+			t.Errorf("profile is missing the string %q", s)
+		}
+	}
+}
+
+func TestRunnerDeterministic(t *testing.T) {
+	t.Parallel()
+
+	src := `echo $$ $PPID $BASHPID $(echo $BASHPID) $(echo $BASHPID)
+echo $RANDOM $SRANDOM $(echo $RANDOM)
+echo $EPOCHSECONDS $EPOCHREALTIME $SECONDS
+SECONDS=5; echo $SECONDS
+TZ=UTC printf '%(%F %T)T\n'
+echo foo >written; exec 3>opened
+[[ existing -nt written && written -ot existing && existing -nt opened ]] && echo virtual
+time true
+kill -HUP $PPID 2>/dev/null || echo refused
+(kill $$ 2>/dev/null || echo refused)
+trap 'echo got USR1' USR1; kill -USR1 $$
+`
+	run := func() string {
+		t.Helper()
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "existing"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+		file := parse(t, nil, src)
+		var buf bytes.Buffer
+		r, err := New(Dir(dir), StdIO(nil, &buf, &buf),
+			Clock(func() time.Time { return now }),
+			Random(rand.NewSource(1)),
+			ProcessIDs(100, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Run(context.Background(), file); err != nil {
+			t.Fatal(err)
+		}
+		// The virtual modification times must not be written to disk.
+		info, err := os.Stat(filepath.Join(dir, "written"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ModTime().Before(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("modification time was changed to %v", info.ModTime())
+		}
+		return buf.String()
+	}
+	got := run()
+	if got2 := run(); got2 != got {
+		t.Fatalf("output is not reproducible:\n%s\nvs:\n%s", got, got2)
+	}
+	lines := strings.Split(got, "\n")
+	want := []string{
+		"100 1 100 101 102",
+		"", // random, but reproducible
+		"1577934245 1577934245.000006 0",
+		"5",
+		"2020-01-02 03:04:05",
+		"virtual",
+		"",
+		"real\t0m0.000s",
+		"user\t0m0.000s",
+		"sys\t0m0.000s",
+		"refused",
+		"refused",
+		"got USR1",
+	}
+	for i, wantLine := range want {
+		if wantLine != "" && lines[i] != wantLine {
+			t.Errorf("line %d: want %q, got %q", i+1, wantLine, lines[i])
+		}
+	}
+}
+
+func TestRunnerJSONTrace(t *testing.T) {
+	t.Parallel()
+
+	src := "x=foo\nf() {\n\techo $1\n\treturn 3\n}\nf $x\n(false)\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	r, _ := New(StdIO(nil, io.Discard, io.Discard), JSONTrace(&buf))
+	if err := r.Run(context.Background(), file); err == nil {
+		t.Fatal("want an exit status error")
+	}
+
+	var got []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev TraceEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.File != "main.sh" {
+			t.Errorf("wrong file in %#v", ev)
+		}
+		if ev.Duration < 0 || (ev.Duration > 0) != (ev.Kind != "assign" && ev.Kind != "enter") {
+			t.Errorf("wrong duration in %#v", ev)
+		}
+		got = append(got, fmt.Sprintf("%s %d:%d %q %d %d", ev.Kind, ev.Line, ev.Col, ev.Args, ev.Exit, ev.Depth))
+	}
+	want := []string{
+		`assign 1:1 ["x=foo"] 0 0`,
+		`enter 6:1 ["f" "foo"] 0 0`,
+		`command 3:2 ["echo" "foo"] 0 1`,
+		`command 4:2 ["return" "3"] 3 1`,
+		`return 6:1 ["f" "foo"] 3 0`,
+		`command 6:1 ["f" "foo"] 3 0`,
+		`command 7:2 ["false"] 1 1`,
+		`subshell 7:1 [] 1 0`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("wrong events:\nwant:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestRunnerContext(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"",
+		"while true; do true; done",
+		"until false; do true; done",
+		"for ((;;)); do true; done",
+		"sleep 1000",
+		"while true; do true; done & wait",
+		"sleep 1000 & wait",
+		"(while true; do true; done)",
+		"$(while true; do true; done)",
+		"while true; do true; done | while true; do true; done",
+	}
+	p := syntax.NewParser()
+	for _, in := range cases {
+		t.Run("", func(t *testing.T) {
+			file := parse(t, p, in)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r, _ := New()
+			errChan := make(chan error)
+			go func() {
+				errChan <- r.Run(ctx, file)
+			}()
+
+			timeout := 500 * time.Millisecond
+			select {
+			case err := <-errChan:
+				if err != nil && err != ctx.Err() {
+					t.Fatal("Runner did not use ctx.Err()")
+				}
+			case <-time.After(timeout):
+				t.Fatalf("program was not killed in %s", timeout)
+			}
+		})
+	}
+}
+
+func TestRunnerSignals(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in, want string
+	}{
+		{"trap 'echo got; exit 3' INT; sendsig INT; while true; do true; done", "got\nexit status 3"},
+		{"sendsig TERM; while true; do true; done", "exit status 143"},
+		{"trap 'echo bye' EXIT; sendsig TERM; while true; do true; done", "bye\nexit status 143"},
+		{"trap '' TERM; sendsig TERM; sendsig INT; while true; do true; done", "exit status 130"},
+		{"trap 'echo got' INT; sendsig INT; sleep 0.01s; echo $?", "got\n0\n"},
+		{
+			"trap 'echo got' INT; while true; do true; done & sendsig INT; wait $!; echo $?; kill $!",
+			"got\n130\n",
+		},
+		{"sendsig HUP; while true; do true; done & wait", "exit status 129"},
+	}
+	p := syntax.NewParser()
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			file := parse(t, p, test.in)
+			signals := make(chan os.Signal, 1)
+			var cb concBuffer
+			r, err := New(
+				StdIO(nil, &cb, &cb),
+				Signals(signals),
+				ExecHandler(func(ctx context.Context, args []string) error {
+					if args[0] == "sendsig" {
+						sig, _ := parseSignal(args[1])
+						signals <- sig
+						return nil
+					}
+					return testExecHandler(ctx, args)
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := r.Run(ctx, file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerSelect(t *testing.T) {
+	t.Parallel()
+
+	file := parse(t, nil, `PS3="> "; select x in foo bar; do echo "$x"; done`)
+	var stdout, stderr bytes.Buffer
+	r, _ := New(StdIO(strings.NewReader("2\n\n1\n"), &stdout, &stderr))
+	if err := r.Run(context.Background(), file); err == nil {
+		t.Fatal("expected select to fail on EOF")
+	}
+	if want := "bar\nfoo\n\n"; stdout.String() != want {
+		t.Fatalf("wrong stdout:\nwant: %q\ngot:  %q", want, stdout.String())
+	}
+	if want := "1) foo\n2) bar\n> > 1) foo\n2) bar\n> > "; stderr.String() != want {
+		t.Fatalf("wrong stderr:\nwant: %q\ngot:  %q", want, stderr.String())
+	}
+}
+
+func TestRunnerReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("par"))
+		time.Sleep(200 * time.Millisecond)
+		pw.Write([]byte("tial\n"))
+	}()
+	file := parse(t, nil, `read -t 0.05 x; echo "[$x] $?"; read -t 5 x; echo "[$x] $?"`)
+	var cb concBuffer
+	r, _ := New(StdIO(pr, &cb, &cb))
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	// The byte being read when the first read timed out must not be lost.
+	if want := "[par] 142\n[tial] 0\n"; cb.String() != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, cb.String())
+	}
+
+	// Cancelling the context must interrupt a read which is blocked.
+	pr, _ = io.Pipe()
+	file = parse(t, nil, `read x`)
+	r, _ = New(StdIO(pr, &cb, &cb))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx, file) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected read to fail when cancelled")
+		}
+	case <-time.After(runnerRunTimeout):
+		t.Fatal("read was not interrupted by the cancelled context")
+	}
+
+	// Readers which can't be compared via == must not cause panics.
+	pr, pw = io.Pipe()
+	go func() {
+		pw.Write([]byte("par"))
+		time.Sleep(200 * time.Millisecond)
+		pw.Write([]byte("tial\n"))
+	}()
+	var cb2 concBuffer
+	file = parse(t, nil, `read -t 0.05 x; echo "[$x] $?"; read -t 5 x; echo "[$x] $?"`)
+	r, _ = New(StdIO(uncomparableReader{[]io.Reader{pr}}, &cb2, &cb2))
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	// Such readers are never the same, so the pending byte is dropped.
+	if want := "[par] 142\n[ial] 0\n"; cb2.String() != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, cb2.String())
+	}
+}
+
+// uncomparableReader is a reader which panics if compared via ==.
+type uncomparableReader struct {
+	readers []io.Reader
+}
+
+func (r uncomparableReader) Read(p []byte) (int, error) { return r.readers[0].Read(p) }
+
+func TestRunnerAltNodes(t *testing.T) {
+	t.Parallel()
+
+	in := "echo foo"
+	file := parse(t, nil, in)
+	want := "foo\n"
+	nodes := []syntax.Node{
+		file,
+		file.Stmts[0],
+		file.Stmts[0].Cmd,
+	}
+	for _, node := range nodes {
+		var cb concBuffer
+		r, _ := New(StdIO(nil, &cb, &cb))
+		ctx, cancel := context.WithTimeout(context.Background(), runnerRunTimeout)
+		defer cancel()
+		if err := r.Run(ctx, node); err != nil {
+			cb.WriteString(err.Error())
+		}
+		if got := cb.String(); got != want {
+			t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+				in, want, got)
+		}
+	}
+}
+
+func TestElapsedString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in    time.Duration
+		posix bool
+		want  string
+	}{
+		{time.Nanosecond, false, "0m0.000s"},
+		{time.Millisecond, false, "0m0.001s"},
 		{time.Millisecond, true, "0.00"},
 		{2500 * time.Millisecond, false, "0m2.500s"},
 		{2500 * time.Millisecond, true, "2.50"},
@@ -3819,6 +5208,339 @@ func TestRunnerDir(t *testing.T) {
 	})
 }
 
+// memFS is a minimal in-memory FileSystem, to test that the interpreter
+// doesn't use the real file system directly.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name string
+	mode os.FileMode
+	data []byte
+	link string // for symlinks
+}
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) Mode() os.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return time.Time{} }
+func (f *memFile) IsDir() bool        { return f.mode.IsDir() }
+func (f *memFile) Sys() interface{}   { return nil }
+
+// memHandle is an open file in a memFS. If opened for writing, its contents
+// are saved on close.
+type memHandle struct {
+	bytes.Buffer
+	fs    *memFS
+	path  string
+	write bool
+}
+
+func (h *memHandle) Close() error {
+	if h.write {
+		h.fs.mu.Lock()
+		defer h.fs.mu.Unlock()
+		h.fs.files[h.path].data = h.Bytes()
+	}
+	return nil
+}
+
+func newMemFS(files map[string]string) *memFS {
+	fsys := &memFS{files: map[string]*memFile{"/": {name: "/", mode: os.ModeDir | 0o755}}}
+	for path, data := range files {
+		dir := filepath.Dir(path)
+		for dir != "/" && fsys.files[dir] == nil {
+			fsys.files[dir] = &memFile{name: filepath.Base(dir), mode: os.ModeDir | 0o755}
+			dir = filepath.Dir(dir)
+		}
+		f := &memFile{name: filepath.Base(path), mode: 0o644, data: []byte(data)}
+		switch {
+		case strings.HasPrefix(data, "#!"):
+			f.mode = 0o755
+		case strings.HasPrefix(data, "->"):
+			f.mode = os.ModeSymlink | 0o777
+			f.link = data[2:]
+		}
+		fsys.files[path] = f
+	}
+	return fsys
+}
+
+func (fsys *memFS) resolve(path string) (*memFile, string, error) {
+	f := fsys.files[path]
+	for i := 0; f != nil && f.link != ""; i++ {
+		path = f.link
+		f = fsys.files[path]
+	}
+	if f == nil {
+		return nil, "", &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return f, path, nil
+}
+
+func (fsys *memFS) Open(path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	f, rpath, err := fsys.resolve(path)
+	if err != nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		f = &memFile{name: filepath.Base(path), mode: perm}
+		rpath = path
+		fsys.files[path] = f
+	}
+	if f.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("is a directory")}
+	}
+	h := &memHandle{fs: fsys, path: rpath, write: flag&(os.O_WRONLY|os.O_RDWR) != 0}
+	if flag&os.O_TRUNC == 0 {
+		h.Write(f.data)
+	}
+	return h, nil
+}
+
+func (fsys *memFS) Stat(path string) (os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	f, _, err := fsys.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fsys *memFS) Lstat(path string) (os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if f := fsys.files[path]; f != nil {
+		return f, nil
+	}
+	return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+}
+
+func (fsys *memFS) ReadDir(path string) ([]os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if _, _, err := fsys.resolve(path); err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for name, f := range fsys.files {
+		if name != "/" && filepath.Dir(name) == path {
+			infos = append(infos, f)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fsys *memFS) Mkdir(path string, perm os.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.files[path] != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+	fsys.files[path] = &memFile{name: filepath.Base(path), mode: os.ModeDir | perm}
+	return nil
+}
+
+func (fsys *memFS) Readlink(path string) (string, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if f := fsys.files[path]; f != nil && f.link != "" {
+		return f.link, nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: path, Err: os.ErrInvalid}
+}
+
+func TestRunnerFS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the in-memory file system uses Unix-like paths")
+	}
+	t.Parallel()
+
+	tests := []struct {
+		in, want string
+	}{
+		{"echo foo >/tmp/a.txt; read x </tmp/a.txt; echo $x; echo \"$(</tmp/a.txt)\"", "foo\nfoo\n"},
+		{"echo foo >>/tmp/a.txt; echo bar >>/tmp/a.txt; mapfile -t l </tmp/a.txt; echo ${l[@]}", "foo bar\n"},
+		{"read x </missing", "open /missing: file does not exist\nexit status 1"},
+		{"read x < <(echo foo); echo $x", "foo\n"},
+		{
+			"echo /data/*.txt; cd /data; echo *; cd /; echo d*/b* data/bin/p*",
+			"/data/a.txt /data/b.txt\na.txt b.txt bin\ndata/b.txt data/bin data/bin/prog\n",
+		},
+		{"cd /data/bin; pwd; cd ..; echo $PWD; cd /missing", "/data/bin\n/data\nexit status 1"},
+		{"[[ -e /data/a.txt && -f /data/a.txt && -d /data && ! -d /data/a.txt ]] && echo ok", "ok\n"},
+		{"[[ -s /data/a.txt ]]; echo $?; [[ -s /tmp/empty ]]; echo $?", "0\n1\n"},
+		{"[[ -x /data/bin/prog ]] && [[ ! -x /data/a.txt ]] && echo ok", "ok\n"},
+		{"[[ -L /link && ! -L /data ]] && echo ok; cd /link; pwd; pwd -P", "ok\n/link\n/data/bin\n"},
+		{"PATH=/data/bin; type prog; command -v prog; prog", "prog is /data/bin/prog\n/data/bin/prog\nexec: prog"},
+		{"PATH=/data/bin; source script.sh; . /data/bin/script.sh", "sourced\nsourced\n"},
+		{"newdir /tmp/new; [[ -d /tmp/new ]] && echo ok; cd /tmp/new; pwd", "ok\n/tmp/new\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			fsys := newMemFS(map[string]string{
+				"/tmp/empty":          "",
+				"/data/a.txt":         "a",
+				"/data/b.txt":         "b",
+				"/data/bin/prog":      "#!/bin/sh",
+				"/data/bin/script.sh": "echo sourced",
+				"/link":               "->/data/bin",
+			})
+			file := parse(t, nil, test.in)
+			var cb concBuffer
+			r, err := New(Dir("/tmp"), FS(fsys), StdIO(nil, &cb, &cb),
+				ExecHandler(func(ctx context.Context, args []string) error {
+					return fmt.Errorf("exec: %s", args[0])
+				}),
+				Builtins(map[string]BuiltinFunc{
+					"newdir": func(ctx context.Context, bc *BuiltinContext, args []string) error {
+						return HandlerCtx(ctx).FS.Mkdir(args[1], 0o755)
+					},
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+
+	if _, err := New(Dir("/missing"), FS(newMemFS(nil))); err == nil {
+		t.Fatal("expected New to error when Dir is missing in the file system")
+	}
+}
+
+func TestRunnerLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		limits ResourceLimits
+		in     string
+		want   string
+	}{
+		{
+			ResourceLimits{MaxStatements: 5},
+			"for i in 1 2 3; do echo $i; done",
+			"1\n2\n3\n",
+		},
+		{
+			ResourceLimits{MaxStatements: 5},
+			"for i in 1 2 3 4 5; do echo $i; done; echo after",
+			"1\n2\n3\n4\n1:24: MaxStatements limit of 5 exceeded",
+		},
+		{
+			ResourceLimits{MaxStatements: 5},
+			"trap 'echo exit' EXIT; (while true; do true; done); echo after",
+			"1:31: MaxStatements limit of 5 exceeded",
+		},
+		{
+			ResourceLimits{MaxWallTime: 10 * time.Millisecond},
+			"for ((;;)); do\n\ttrue\ndone",
+			"2:2: MaxWallTime limit of 10ms exceeded",
+		},
+		{
+			ResourceLimits{MaxFuncDepth: 3},
+			"f() { echo $1; f $(($1 + 1)); }; f 1",
+			"1\n2\n3\n1:16: MaxFuncDepth limit of 3 exceeded",
+		},
+		{
+			ResourceLimits{MaxVarSize: 10},
+			"a=0123456789; b=(01234 56789); declare -A c=([k]=01234567); echo ok",
+			"ok\n",
+		},
+		{
+			ResourceLimits{MaxVarSize: 10},
+			"a=0123456789; a+=x; echo $a",
+			"1:15: MaxVarSize limit of 10 exceeded",
+		},
+		{
+			ResourceLimits{MaxVarSize: 10},
+			"b=(01234 56789 x)",
+			"1:1: MaxVarSize limit of 10 exceeded",
+		},
+		{
+			ResourceLimits{MaxVarSize: 10},
+			"echo go; echo {1..100000000000}",
+			"go\n1:10: MaxVarSize limit of 10 exceeded",
+		},
+		{
+			ResourceLimits{MaxVarSize: 10},
+			"a=$(while true; do echo 01; done)",
+			"1:20: MaxVarSize limit of 10 exceeded",
+		},
+		{
+			ResourceLimits{MaxVarSize: 10},
+			"printf -v a '%s%s' 012345 6789ab",
+			"1:1: MaxVarSize limit of 10 exceeded",
+		},
+		{
+			ResourceLimits{MaxOutputBytes: 8},
+			"echo 1234; echo 5678; echo after",
+			"1234\n5671:12: MaxOutputBytes limit of 8 exceeded",
+		},
+		{
+			ResourceLimits{MaxBackgroundJobs: 2},
+			"true & true & wait; true & true & wait; echo ok",
+			"ok\n",
+		},
+		{
+			ResourceLimits{MaxBackgroundJobs: 2},
+			"read & read & read & echo after",
+			"1:15: MaxBackgroundJobs limit of 2 exceeded",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			file := parse(t, nil, test.in)
+			var cb concBuffer
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			r, err := New(StdIO(pr, &cb, &cb), Limits(test.limits))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), runnerRunTimeout)
+			defer cancel()
+			err = r.Run(ctx, file)
+			if _, ok := err.(*LimitError); ok {
+				cb.WriteString(err.Error())
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+
+	// Each Run call has its own limits.
+	r, _ := New(Limits(ResourceLimits{MaxStatements: 2}))
+	for i := 0; i < 3; i++ {
+		if err := r.Run(context.Background(), parse(t, nil, "true; true")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := New(Limits(ResourceLimits{MaxStatements: -1})); err == nil {
+		t.Fatal("expected an error for negative limits")
+	}
+}
+
 func TestRunnerIncremental(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,380 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// bgJob is a background job, such as one started via "sleep 1 &".
+//
+// Background jobs run in a subshell in a separate goroutine, so they don't have
+// a real process ID. Instead, they get a fake one like "g1", which can be used
+// in place of a PID in builtins such as wait and kill.
+type bgJob struct {
+	id   int    // job number, as used in job specs like "%1"
+	pid  string // fake process ID, as found in "$!"
+	stmt *syntax.Stmt
+
+	// signals is used to send signals to the job via kill.
+	signals chan<- os.Signal
+
+	// done is closed when the job finishes,
+	// after which point the result fields below are set.
+	done chan struct{}
+	exit int
+	err  error
+
+	// signal is the signal which terminated the job, if any.
+	signal syscall.Signal
+}
+
+func (j *bgJob) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// text returns the job's source code, as printed by jobs or fg.
+func (j *bgJob) text() string {
+	var buf bytes.Buffer
+	syntax.NewPrinter(syntax.SingleLine(true)).Print(&buf, j.stmt)
+	return buf.String()
+}
+
+// state returns the job's state as shown by jobs, such as "Running" or "Exit 1".
+func (j *bgJob) state() string {
+	if !j.finished() {
+		return "Running"
+	}
+	if j.signal != 0 {
+		return signalDesc(j.signal)
+	}
+	if j.exit != 0 {
+		return fmt.Sprintf("Exit %d", j.exit)
+	}
+	return "Done"
+}
+
+// startJob runs a statement in the background in r2, a subshell of r, adding
+// it to the job table. Any closers are closed once the job finishes.
+func (r *Runner) startJob(ctx context.Context, r2 *Runner, st *syntax.Stmt, closers ...io.Closer) *bgJob {
+	st2 := *st
+	st2.Background = false
+	st2.Coprocess = false
+	signals := make(chan os.Signal, 8)
+	r2.signals = signals
+
+	r.bgCount++
+	id := 1
+	if n := len(r.jobs); n > 0 {
+		id = r.jobs[n-1].id + 1
+	}
+	job := &bgJob{
+		id:      id,
+		pid:     fmt.Sprintf("g%d", r.bgCount),
+		stmt:    &st2,
+		signals: signals,
+		done:    make(chan struct{}),
+	}
+	r.jobs = append(r.jobs, job)
+	r.lastBgPid = job.pid
+	go func() {
+		err := r2.Run(ctx, &st2)
+		if status, ok := IsExitStatus(err); ok {
+			job.exit = int(status)
+		} else if err != nil {
+			job.exit = 1
+			job.err = err
+		}
+		if r2.exitSig != 0 {
+			// Note that r2 is no longer running, so there's no need
+			// to use its sigMu.
+			job.signal = r2.exitSig
+		}
+		r2.closeFds()
+		for _, closer := range closers {
+			closer.Close()
+		}
+		if r.limits != nil && r.limits.MaxBackgroundJobs > 0 {
+			// Acquired by limitStmt.
+			atomic.AddInt64(&r.limits.jobs, -1)
+		}
+		close(job.done)
+	}()
+	return job
+}
+
+// coproc starts a statement as a coprocess, a background job whose standard
+// input and output are connected to the shell via pipes. The file descriptors
+// to read from and write to the coprocess are stored in the indexed array name,
+// and the job's PID in name_PID.
+func (r *Runner) coproc(ctx context.Context, name string, st *syntax.Stmt) {
+	if !syntax.ValidName(name) {
+		r.errf("coproc: %s: invalid identifier\n", name)
+		r.exit = 1
+		return
+	}
+	inReader, inWriter, err := os.Pipe()
+	if err != nil {
+		r.setErr(err)
+		return
+	}
+	outReader, outWriter, err := os.Pipe()
+	if err != nil {
+		inReader.Close()
+		inWriter.Close()
+		r.setErr(err)
+		return
+	}
+	r2 := r.Subshell()
+	r2.stdin = inReader
+	r2.stdout = outWriter
+	job := r.startJob(ctx, r2, st, inReader, outWriter)
+
+	readFd := r.newFd(outReader)
+	writeFd := r.newFd(inWriter)
+	r.setVar(name, nil, expand.Variable{
+		Kind: expand.Indexed,
+		List: []string{strconv.Itoa(readFd), strconv.Itoa(writeFd)},
+	})
+	r.setVarString(name+"_PID", job.pid)
+}
+
+// collectJob removes a finished job from the job table once wait has collected
+// its exit status, which is returned. Fatal errors from the job are propagated.
+//
+// Like in Bash, the exit status can still be collected again via the job's PID.
+func (r *Runner) collectJob(job *bgJob) int {
+	if job.err != nil {
+		r.setErr(job.err)
+	}
+	r.forgetJob(job)
+	return job.exit
+}
+
+// maxDoneJobs is the number of finished jobs whose exit status is remembered
+// once they leave the job table, like CHILD_MAX in Bash.
+const maxDoneJobs = 4096
+
+// forgetJob removes a finished job from the job table. Its exit status is
+// still remembered, unless too many finished jobs are, in which case the
+// oldest is dropped.
+func (r *Runner) forgetJob(job *bgJob) {
+	r.jobs = removeJob(r.jobs, job)
+	r.doneJobs = append(removeJob(r.doneJobs, job), job)
+	if n := len(r.doneJobs); n > maxDoneJobs {
+		copy(r.doneJobs, r.doneJobs[1:])
+		r.doneJobs[n-1] = nil
+		r.doneJobs = r.doneJobs[:n-1]
+	}
+}
+
+func removeJob(jobs []*bgJob, job *bgJob) []*bgJob {
+	for i, j := range jobs {
+		if j == job {
+			return append(jobs[:i], jobs[i+1:]...)
+		}
+	}
+	return jobs
+}
+
+// waitJobs blocks until one of the given jobs finishes, returning it.
+// If ctx is cancelled or interrupt receives a value first, nil is returned.
+func waitJobs(ctx context.Context, jobs []*bgJob, interrupt <-chan struct{}) *bgJob {
+	for _, job := range jobs {
+		if job.finished() {
+			return job
+		}
+	}
+	cases := make([]reflect.SelectCase, 0, len(jobs)+1)
+	for _, job := range jobs {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(job.done),
+		})
+	}
+	cases = append(cases, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(ctx.Done()),
+	}, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(interrupt),
+	})
+	chosen, _, _ := reflect.Select(cases)
+	if chosen >= len(jobs) {
+		return nil
+	}
+	return jobs[chosen]
+}
+
+// currentJobs returns the jobs marked as "+" and "-" by the jobs builtin; the
+// most recent and the previous job.
+func (r *Runner) currentJobs() (cur, prev *bgJob) {
+	if n := len(r.jobs); n > 0 {
+		cur = r.jobs[n-1]
+		if n > 1 {
+			prev = r.jobs[n-2]
+		}
+	}
+	return cur, prev
+}
+
+// findJob looks up a job by its job spec, like "%1" or "%+", or by its PID.
+// Jobs which were already removed from the table can only be found by PID.
+func (r *Runner) findJob(spec string) (*bgJob, error) {
+	if !strings.HasPrefix(spec, "%") {
+		for _, job := range r.jobs {
+			if job.pid == spec {
+				return job, nil
+			}
+		}
+		for _, job := range r.doneJobs {
+			if job.pid == spec {
+				return job, nil
+			}
+		}
+		return nil, fmt.Errorf("pid %s is not a child of this shell", spec)
+	}
+	noJob := fmt.Errorf("%s: no such job", spec)
+	cur, prev := r.currentJobs()
+	switch s := spec[1:]; s {
+	case "", "%", "+":
+		if cur == nil {
+			return nil, noJob
+		}
+		return cur, nil
+	case "-":
+		if prev == nil {
+			// Like Bash, fall back to the current job.
+			prev = cur
+		}
+		if prev == nil {
+			return nil, noJob
+		}
+		return prev, nil
+	default:
+		if n, err := strconv.Atoi(s); err == nil {
+			for _, job := range r.jobs {
+				if job.id == n {
+					return job, nil
+				}
+			}
+			return nil, noJob
+		}
+		var found *bgJob
+		for _, job := range r.jobs {
+			text := job.text()
+			if strings.HasPrefix(s, "?") {
+				if !strings.Contains(text, s[1:]) {
+					continue
+				}
+			} else if !strings.HasPrefix(text, s) {
+				continue
+			}
+			if found != nil {
+				return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+			}
+			found = job
+		}
+		if found == nil {
+			return nil, noJob
+		}
+		return found, nil
+	}
+}
+
+// printJob prints a job in the format used by the jobs builtin.
+func (r *Runner) printJob(job *bgJob, long bool) {
+	mark := ' '
+	switch cur, prev := r.currentJobs(); job {
+	case cur:
+		mark = '+'
+	case prev:
+		mark = '-'
+	}
+	text := job.text()
+	if !job.finished() {
+		text += " &"
+	}
+	if long {
+		r.outf("[%d]%c  %s %-24s%s\n", job.id, mark, job.pid, job.state(), text)
+	} else {
+		r.outf("[%d]%c  %-24s%s\n", job.id, mark, job.state(), text)
+	}
+}
+
+// killJob sends a signal to a background job, which handles it like a shell
+// would; see the Signals option.
+func (r *Runner) killJob(job *bgJob, sig syscall.Signal) {
+	if sig == 0 || job.finished() {
+		return // just checking that the job exists
+	}
+	select {
+	case job.signals <- sig:
+	default:
+		// Like pending signals of the same kind in a real process,
+		// signals may be dropped if too many haven't been handled yet.
+	}
+}
+
+// parseSignal parses a signal spec, such as "TERM", "SIGTERM", or "15".
+func parseSignal(spec string) (syscall.Signal, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n == 0 {
+			return 0, true
+		}
+		sig := syscall.Signal(n)
+		return sig, signalName(sig) != ""
+	}
+	spec = strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	sig := signalNum(spec)
+	return sig, sig != 0
+}
+
+// signalDesc returns a signal's description, such as "Terminated".
+func signalDesc(sig syscall.Signal) string {
+	desc := sig.String()
+	if desc == "" {
+		return desc
+	}
+	return strings.ToUpper(desc[:1]) + desc[1:]
+}
+
+// printSignalList prints all signals in the format used by "kill -l".
+func (r *Runner) printSignalList() {
+	col := 0
+	for sig := syscall.Signal(1); sig <= maxSignal; sig++ {
+		name := signalName(sig)
+		if name == "" {
+			continue
+		}
+		if col > 0 {
+			r.out("\t")
+		}
+		r.outf("%2d) SIG%s", int(sig), name)
+		if col++; col == 5 {
+			r.out("\n")
+			col = 0
+		}
+	}
+	if col > 0 {
+		r.out("\n")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// ResourceLimits bounds the resources that a Runner may use in each Run call,
+// which is useful to run untrusted scripts. A zero field means no limit.
+//
+// Subshells and background jobs share the limits of the Runner they were
+// started from. Note that the limits don't apply to the programs run by the
+// exec handler, other than the output they write; see the ulimit builtin and
+// TimeoutExecs for those.
+type ResourceLimits struct {
+	// MaxStatements is the maximum number of statements to run, including
+	// the ones in loops, functions, subshells, and traps.
+	MaxStatements int
+
+	// MaxWallTime is the maximum time that Run may take.
+	MaxWallTime time.Duration
+
+	// MaxFuncDepth is the maximum number of nested function calls.
+	MaxFuncDepth int
+
+	// MaxVarSize is the maximum size in bytes of a variable's value, such
+	// as the sum of an array's elements. It also limits the size of any
+	// expansion, such as a command's arguments or a command substitution's
+	// output; see expand.Config.MaxSize.
+	MaxVarSize int
+
+	// MaxOutputBytes is the maximum number of bytes written to each of
+	// the standard output and standard error streams given to StdIO.
+	MaxOutputBytes int64
+
+	// MaxBackgroundJobs is the maximum number of background jobs and
+	// coprocesses which can be running at once.
+	MaxBackgroundJobs int
+}
+
+// Limits sets the resource limits for each Run call. Once a limit is exceeded,
+// Run stops and returns a *LimitError.
+func Limits(limits ResourceLimits) RunnerOption {
+	return func(r *Runner) error {
+		if limits == (ResourceLimits{}) {
+			r.limits = nil
+			return nil
+		}
+		if limits.MaxStatements < 0 || limits.MaxWallTime < 0 || limits.MaxFuncDepth < 0 ||
+			limits.MaxVarSize < 0 || limits.MaxOutputBytes < 0 || limits.MaxBackgroundJobs < 0 {
+			return fmt.Errorf("resource limits cannot be negative")
+		}
+		r.limits = &limitState{ResourceLimits: limits, owner: r}
+		return nil
+	}
+}
+
+// LimitError is returned by Runner.Run when a resource limit is exceeded.
+type LimitError struct {
+	// Limit is the name of the ResourceLimits field which was exceeded,
+	// such as "MaxStatements".
+	Limit string
+
+	// Max is the value of said field, such as 1000 or 5*time.Second.
+	Max interface{}
+
+	// Pos is the position of the innermost statement which was running
+	// when the limit was exceeded. It may be invalid, such as when Run is
+	// given a Command which isn't part of a statement.
+	Pos syntax.Pos
+}
+
+func (e *LimitError) Error() string {
+	if !e.Pos.IsValid() {
+		return fmt.Sprintf("%s limit of %v exceeded", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("%s: %s limit of %v exceeded", e.Pos, e.Limit, e.Max)
+}
+
+// limitState tracks the resources used by a Runner and its subshells.
+type limitState struct {
+	// Accessed atomically, and kept first for alignment.
+	stmts  int64
+	jobs   int64
+	output [2]int64 // stdout and stderr
+
+	ResourceLimits
+
+	// owner is the Runner that the limits were set up for, whose Run calls
+	// reset them.
+	owner *Runner
+
+	deadline time.Time
+
+	mu  sync.Mutex
+	err *LimitError
+}
+
+// reset is called at the start of each Run call by the owner.
+func (l *limitState) reset() {
+	atomic.StoreInt64(&l.stmts, 0)
+	atomic.StoreInt64(&l.output[0], 0)
+	atomic.StoreInt64(&l.output[1], 0)
+	l.deadline = time.Time{}
+	if l.MaxWallTime > 0 {
+		l.deadline = time.Now().Add(l.MaxWallTime)
+	}
+	l.mu.Lock()
+	l.err = nil
+	l.mu.Unlock()
+}
+
+// exceed records that a limit was exceeded, unless another one already was.
+func (l *limitState) exceed(limit string, max interface{}) {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = &LimitError{Limit: limit, Max: max}
+	}
+	l.mu.Unlock()
+}
+
+// exceeded returns the error for the limit which was exceeded, if any. The
+// error's position is set to pos if it didn't have one yet.
+func (l *limitState) exceeded(pos syntax.Pos) *LimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil && !l.err.Pos.IsValid() {
+		l.err.Pos = pos
+	}
+	return l.err
+}
+
+// checkLimits stops the runner if any limit was exceeded, such as by a
+// subshell, in which case it returns false. pos is the position of the
+// statement being run, if any.
+func (r *Runner) checkLimits(pos syntax.Pos) bool {
+	l := r.limits
+	if !l.deadline.IsZero() && !time.Now().Before(l.deadline) {
+		l.exceed("MaxWallTime", l.MaxWallTime)
+	}
+	if err := l.exceeded(pos); err != nil {
+		r.setErr(err)
+		return false
+	}
+	return true
+}
+
+// limitStmt is called before running each statement, and reports whether it
+// can run.
+func (r *Runner) limitStmt(st *syntax.Stmt) bool {
+	l := r.limits
+	if l.MaxStatements > 0 && atomic.AddInt64(&l.stmts, 1) > int64(l.MaxStatements) {
+		l.exceed("MaxStatements", l.MaxStatements)
+	}
+	if (st.Background || st.Coprocess) && l.MaxBackgroundJobs > 0 {
+		// Released by startJob once the job is done.
+		if atomic.AddInt64(&l.jobs, 1) > int64(l.MaxBackgroundJobs) {
+			atomic.AddInt64(&l.jobs, -1)
+			l.exceed("MaxBackgroundJobs", l.MaxBackgroundJobs)
+		}
+	}
+	return r.checkLimits(st.Pos())
+}
+
+// limitVar reports whether a variable's value is within the size limit. If it
+// isn't, the runner is stopped.
+func (r *Runner) limitVar(vr expand.Variable) bool {
+	max := r.limits.MaxVarSize
+	if max <= 0 {
+		return true
+	}
+	size := len(vr.Str)
+	for _, s := range vr.List {
+		size += len(s)
+	}
+	for k, v := range vr.Map {
+		size += len(k) + len(v)
+	}
+	if size <= max {
+		return true
+	}
+	r.limits.exceed("MaxVarSize", max)
+	r.checkLimits(syntax.Pos{})
+	return false
+}
+
+// limitExpandErr reports whether an expansion error is due to a limit being
+// exceeded, such as the size limit or any limit within a command substitution,
+// in which case the runner is stopped.
+func (r *Runner) limitExpandErr(err error) bool {
+	if err == nil || r.limits == nil {
+		return false
+	}
+	if _, ok := err.(expand.SizeLimitError); ok {
+		r.limits.exceed("MaxVarSize", r.limits.MaxVarSize)
+	}
+	return !r.checkLimits(syntax.Pos{})
+}
+
+// limitWriter counts the bytes written to one of the standard streams, and
+// fails once the output limit is exceeded.
+type limitWriter struct {
+	w      io.Writer
+	limits *limitState
+	n      *int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	max := lw.limits.MaxOutputBytes
+	total := atomic.AddInt64(lw.n, int64(len(p)))
+	if total <= max {
+		return lw.w.Write(p)
+	}
+	n := 0
+	if allowed := max - (total - int64(len(p))); allowed > 0 {
+		n, _ = lw.w.Write(p[:allowed])
+	}
+	lw.limits.exceed("MaxOutputBytes", max)
+	return n, fmt.Errorf("output limit of %d bytes exceeded", max)
+}
+
+// substWriter stops a command substitution once its output exceeds the size
+// limit, which is enforced by the expand package.
+type substWriter struct {
+	w      io.Writer
+	limits *limitState
+}
+
+func (sw substWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if _, ok := err.(expand.SizeLimitError); ok {
+		sw.limits.exceed("MaxVarSize", sw.limits.MaxVarSize)
+	}
+	return n, err
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// LogExecs returns an exec middleware which writes a line to w for each
+// command before running it, such as "exec: ls -l". If the command fails, a
+// second line is written with the error, such as "exec: ls -l: exit status 2".
+// See ExecHandlers.
+func LogExecs(w io.Writer) func(next ExecHandlerFunc) ExecHandlerFunc {
+	var mu sync.Mutex
+	logf := func(format string, a ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, format, a...)
+	}
+	return func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			cmd := quoteArgs(args)
+			logf("exec: %s\n", cmd)
+			err := next(ctx, args)
+			if err != nil {
+				logf("exec: %s: %v\n", cmd, err)
+			}
+			return err
+		}
+	}
+}
+
+// LogOpens returns an open middleware which writes a line to w for each file
+// before opening it, with the kind of redirection it is used for, such as
+// "open: >> file.log". See OpenHandlers.
+func LogOpens(w io.Writer) func(next OpenHandlerFunc) OpenHandlerFunc {
+	var mu sync.Mutex
+	return func(next OpenHandlerFunc) OpenHandlerFunc {
+		return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			op := "<"
+			switch {
+			case flag&os.O_RDWR != 0:
+				op = "<>"
+			case flag&os.O_APPEND != 0:
+				op = ">>"
+			case flag&os.O_WRONLY != 0:
+				op = ">"
+			}
+			mu.Lock()
+			fmt.Fprintf(w, "open: %s %s\n", op, quoteArgs([]string{path}))
+			mu.Unlock()
+			return next(ctx, path, flag, perm)
+		}
+	}
+}
+
+// AllowExecs returns an exec middleware which only runs the commands whose
+// name, as given in the first argument, is one of names. Any other command
+// fails with an error message and an exit status of 126. See ExecHandlers.
+func AllowExecs(names ...string) func(next ExecHandlerFunc) ExecHandlerFunc {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			if !allowed[args[0]] {
+				fmt.Fprintf(HandlerCtx(ctx).Stderr, "%s: command not allowed\n", args[0])
+				return NewExitStatus(126)
+			}
+			return next(ctx, args)
+		}
+	}
+}
+
+// DryRunExecs returns an exec middleware which writes each command to w as a
+// line instead of running it, and always succeeds. See ExecHandlers.
+//
+// Note that builtins and functions still run, as they aren't run via the exec
+// handler.
+func DryRunExecs(w io.Writer) func(next ExecHandlerFunc) ExecHandlerFunc {
+	var mu sync.Mutex
+	return func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err := fmt.Fprintf(w, "%s\n", quoteArgs(args))
+			return err
+		}
+	}
+}
+
+// TimeoutExecs returns an exec middleware which stops each command if it
+// takes longer than d to run, by cancelling the context given to the next
+// handler. A command which times out fails with an error message and an exit
+// status of 124, like timeout(1). See ExecHandlers.
+func TimeoutExecs(d time.Duration) func(next ExecHandlerFunc) ExecHandlerFunc {
+	return func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			tctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			err := next(tctx, args)
+			if tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				fmt.Fprintf(HandlerCtx(ctx).Stderr, "%s: timed out after %v\n", args[0], d)
+				return NewExitStatus(124)
+			}
+			return err
+		}
+	}
+}
+
+// quoteArgs joins arguments with spaces, quoting them as needed so that they
+// can be read back by a shell.
+func quoteArgs(args []string) string {
+	var sb strings.Builder
+	for i, arg := range args {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		quoted, err := syntax.Quote(arg, syntax.LangBash)
+		if err != nil { // not representable, such as with null bytes
+			quoted = strconv.Quote(arg)
+		}
+		sb.WriteString(quoted)
+	}
+	return sb.String()
+}
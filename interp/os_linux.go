@@ -0,0 +1,101 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readUmask returns the umask of the current process. On Linux, it can be
+// read without changing it, unlike with umask(2).
+//
+// Note that we read the status of the current thread, as the main thread may
+// have been used by withUmask, after which it's never used again.
+func readUmask() os.FileMode {
+	f, err := os.Open("/proc/thread-self/status")
+	if err != nil {
+		return umaskSyscall()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if s := strings.TrimPrefix(scanner.Text(), "Umask:"); s != scanner.Text() {
+			if n, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32); err == nil {
+				return os.FileMode(n)
+			}
+		}
+	}
+	return umaskSyscall() // older kernels lack the field
+}
+
+// withUmask runs fn with the umask set to mask, without changing the umask of
+// the rest of the process. It does so on a new OS thread which doesn't share
+// its file system attributes, and which is thrown away afterwards.
+// Any processes started by fn inherit the umask as well.
+func withUmask(mask os.FileMode, fn func()) {
+	if mask == processUmask() {
+		fn()
+		return
+	}
+	onThread(mask, fn)
+}
+
+// onThread runs fn on a new locked OS thread, with the umask set to mask.
+func onThread(mask os.FileMode, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Never unlocked, so that the thread exits with the goroutine.
+		runtime.LockOSThread()
+		if mask != processUmask() {
+			if err := unix.Unshare(unix.CLONE_FS); err == nil {
+				unix.Umask(int(mask))
+			}
+		}
+		fn()
+	}()
+	<-done
+}
+
+// startCommand starts cmd with the given umask and resource limits, without
+// changing those of the current process.
+//
+// Since os/exec can't run code in the new process before the program starts,
+// the limits are set via prlimit right after it starts. This means that the
+// program may run for a brief moment before its limits apply. If the limits
+// can't be set, such as for a setuid program, the program is killed and the
+// error is returned.
+func startCommand(cmd *exec.Cmd, umask os.FileMode, limits map[int]Rlimit) error {
+	var err error
+	withUmask(umask, func() { err = cmd.Start() })
+	if err != nil || len(limits) == 0 {
+		return err
+	}
+	if err := setRlimits(cmd.Process.Pid, limits); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("cannot set resource limits: %w", err)
+	}
+	return nil
+}
+
+// setRlimits sets the resource limits of a process, where zero means the
+// current process.
+func setRlimits(pid int, limits map[int]Rlimit) error {
+	for resource, lim := range limits {
+		ulim := unix.Rlimit{Cur: lim.Cur, Max: lim.Max}
+		if err := unix.Prlimit(pid, resource, &ulim, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
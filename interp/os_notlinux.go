@@ -0,0 +1,32 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package interp
+
+import (
+	"os"
+	"os/exec"
+)
+
+// readUmask returns the umask of the current process.
+func readUmask() os.FileMode {
+	return umaskSyscall()
+}
+
+// withUmask runs fn. Unlike on Linux, the umask can't be set without changing
+// it for the entire process, so callers must apply the mask themselves.
+func withUmask(mask os.FileMode, fn func()) {
+	fn()
+}
+
+// startCommand starts cmd. The umask and resource limits are ignored, as
+// setting them for another process is only supported on Linux.
+func startCommand(cmd *exec.Cmd, umask os.FileMode, limits map[int]Rlimit) error {
+	return cmd.Start()
+}
+
+// setRlimits is a no-op, as setting resource limits is only supported on Linux.
+func setRlimits(pid int, limits map[int]Rlimit) error { return nil }
@@ -0,0 +1,8 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+// OpenBSD has no limit on the address space, so the ulimit builtin only keeps
+// track of it.
+const rlimitAS = -1
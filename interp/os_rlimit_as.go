@@ -0,0 +1,11 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !windows && !openbsd
+// +build !windows,!openbsd
+
+package interp
+
+import "golang.org/x/sys/unix"
+
+const rlimitAS = unix.RLIMIT_AS
@@ -0,0 +1,14 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !windows,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package interp
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
@@ -10,6 +10,8 @@ import (
 	"os"
 	"os/user"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -19,6 +21,25 @@ func mkfifo(path string, mode uint32) error {
 	return unix.Mkfifo(path, mode)
 }
 
+// maxSignal is the highest signal number which may have a name.
+const maxSignal = 64
+
+// signalName returns the name of a signal without its "SIG" prefix, such as
+// "TERM", or an empty string if the signal is unknown.
+func signalName(sig syscall.Signal) string {
+	return strings.TrimPrefix(unix.SignalName(sig), "SIG")
+}
+
+// signalProcess sends a signal to an operating system process.
+func signalProcess(pid int, sig syscall.Signal) error {
+	return unix.Kill(pid, sig)
+}
+
+// signalNum is the reverse of signalName. Zero is returned for unknown names.
+func signalNum(name string) syscall.Signal {
+	return unix.SignalNum("SIG" + name)
+}
+
 // hasPermissionToDir returns if the OS current user has execute permission
 // to the given directory
 func hasPermissionToDir(info os.FileInfo) bool {
@@ -54,3 +75,120 @@ func hasPermissionToDir(info os.FileInfo) bool {
 
 	return false
 }
+
+// fileReady reports whether a file has input available to read without
+// blocking, which includes having reached the end of the input.
+func fileReady(f *os.File) bool {
+	fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err == nil && n > 0
+}
+
+// disableEcho turns off echoing of input if f is a terminal, like for
+// "read -s". The returned func restores the previous terminal settings.
+func disableEcho(f *os.File) (restore func()) {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return func() {} // not a terminal
+	}
+	old := *termios
+	termios.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, termios); err != nil {
+		return func() {}
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, &old) }
+}
+
+var (
+	processUmaskOnce sync.Once
+	processUmaskVal  os.FileMode
+)
+
+// processUmask returns the umask of the current process, as it was when first
+// called.
+func processUmask() os.FileMode {
+	processUmaskOnce.Do(func() { processUmaskVal = readUmask() })
+	return processUmaskVal
+}
+
+// umaskSyscall returns the umask of the current process via umask(2), which
+// can only do so by briefly setting it.
+func umaskSyscall() os.FileMode {
+	mask := unix.Umask(0o22)
+	unix.Umask(mask)
+	return os.FileMode(mask)
+}
+
+const (
+	rlimitCore   = unix.RLIMIT_CORE
+	rlimitData   = unix.RLIMIT_DATA
+	rlimitFsize  = unix.RLIMIT_FSIZE
+	rlimitNofile = unix.RLIMIT_NOFILE
+	rlimitStack  = unix.RLIMIT_STACK
+	rlimitCPU    = unix.RLIMIT_CPU
+)
+
+// getRlimit returns the current process's limit for a resource.
+func getRlimit(resource int) Rlimit {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(resource, &lim); err != nil {
+		return Rlimit{RlimInfinity, RlimInfinity}
+	}
+	return Rlimit{rlimValue(uint64(lim.Cur)), rlimValue(uint64(lim.Max))}
+}
+
+// rlimValue normalizes a limit value, as some platforms represent unlimited
+// resources with the maximum signed integer.
+func rlimValue(v uint64) uint64 {
+	if v >= 1<<63-1 {
+		return RlimInfinity
+	}
+	return v
+}
+
+// execve replaces the current process with a program, like execve(2).
+//
+// files are the file descriptors which the program inherits, starting at zero.
+// A nil entry for standard input, output, or error closes it; other nil
+// entries are left alone, as the rest of the files opened by a Go program are
+// closed on exec anyway. The umask and resource limits are set as well,
+// although the latter only on Linux.
+//
+// This function only returns if the program can't be executed, by which time
+// the current process will likely have been modified.
+func execve(path string, args, env []string, dir string, files []*os.File, umask os.FileMode, limits map[int]Rlimit) error {
+	// Duplicate the files above all the target file descriptors first, so
+	// that moving them into place can't clobber one another.
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = -1
+		if f == nil {
+			continue
+		}
+		fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, len(files))
+		if err != nil {
+			return err
+		}
+		fds[i] = fd
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	for i, fd := range fds {
+		switch {
+		case fd >= 0:
+			// The new file descriptor isn't closed on exec.
+			if err := unix.Dup2(fd, i); err != nil {
+				return err
+			}
+		case i <= 2:
+			unix.Close(i)
+		}
+	}
+	unix.Umask(int(umask))
+	if err := setRlimits(0, limits); err != nil {
+		return err
+	}
+	return unix.Exec(path, args, env)
+}
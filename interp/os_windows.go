@@ -6,13 +6,114 @@ package interp
 import (
 	"fmt"
 	"os"
+	"os/exec"
+	"syscall"
 )
 
 func mkfifo(path string, mode uint32) error {
 	return fmt.Errorf("unsupported")
 }
 
+// maxSignal is the highest signal number which may have a name.
+const maxSignal = 15
+
+// Windows doesn't have signals, but Go invents some of them for portability.
+var signalNames = [...]string{
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGINT:  "INT",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGTRAP: "TRAP",
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGBUS:  "BUS",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGTERM: "TERM",
+}
+
+// signalName returns the name of a signal without its "SIG" prefix, such as
+// "TERM", or an empty string if the signal is unknown.
+func signalName(sig syscall.Signal) string {
+	if sig < 0 || int(sig) >= len(signalNames) {
+		return ""
+	}
+	return signalNames[sig]
+}
+
+// signalProcess sends a signal to an operating system process.
+// Only SIGKILL is supported on Windows.
+func signalProcess(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if sig == 0 {
+		return nil // the process exists
+	}
+	return p.Signal(sig)
+}
+
+// signalNum is the reverse of signalName. Zero is returned for unknown names.
+func signalNum(name string) syscall.Signal {
+	for i, n := range signalNames {
+		if n != "" && n == name {
+			return syscall.Signal(i)
+		}
+	}
+	return 0
+}
+
 // hasPermissionToDir is a no-op on Windows.
 func hasPermissionToDir(info os.FileInfo) bool {
 	return true
 }
+
+// fileReady is a no-op on Windows, where files are always considered ready.
+func fileReady(f *os.File) bool {
+	return true
+}
+
+// disableEcho is a no-op on Windows.
+func disableEcho(f *os.File) (restore func()) {
+	return func() {}
+}
+
+// processUmask returns zero, as Windows doesn't have a umask.
+func processUmask() os.FileMode {
+	return 0
+}
+
+// withUmask runs fn, as Windows doesn't have a umask.
+func withUmask(mask os.FileMode, fn func()) {
+	fn()
+}
+
+// startCommand starts cmd, as Windows has neither a umask nor resource limits.
+func startCommand(cmd *exec.Cmd, umask os.FileMode, limits map[int]Rlimit) error {
+	return cmd.Start()
+}
+
+// Windows doesn't have resource limits, so the ulimit builtin only keeps track
+// of them.
+const (
+	rlimitCore = iota
+	rlimitData
+	rlimitFsize
+	rlimitNofile
+	rlimitStack
+	rlimitCPU
+	rlimitAS
+)
+
+// getRlimit returns no limit, as Windows doesn't have resource limits.
+func getRlimit(resource int) Rlimit {
+	return Rlimit{RlimInfinity, RlimInfinity}
+}
+
+// execve is never called, as Windows can't replace the current process.
+func execve(path string, args, env []string, dir string, files []*os.File, umask os.FileMode, limits map[int]Rlimit) error {
+	return fmt.Errorf("unsupported")
+}
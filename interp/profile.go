@@ -0,0 +1,263 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Profiler records the wall time spent and the number of calls in each
+// statement, function, and command run by a Runner, which can be written in the
+// pprof format to be used with tools like "go tool pprof".
+//
+// Each sample's stack is the shell's call stack, as described by Frame, where
+// each frame's line is the one of the statement being run. The time spent
+// running builtins and programs via the exec handler is attributed to an extra
+// frame named like "builtin echo" or "exec sleep", so that the rest of a
+// statement's time is what the interpreter spent on it, such as expanding
+// words. Time spent in nested statements, such as the ones in a loop's body or
+// a called function, is not included in the outer statement's time.
+//
+// A Profiler is safe for concurrent use, and it can be shared by many Runners.
+type Profiler struct {
+	mu      sync.Mutex
+	start   time.Time
+	samples map[string]*profSample
+}
+
+type profSample struct {
+	stack []Frame // innermost first
+	calls int64
+	wall  time.Duration
+}
+
+// profEntry is a statement or command being profiled.
+type profEntry struct {
+	start time.Time
+	// child is the time spent in nested statements and commands.
+	child time.Duration
+}
+
+// NewProfiler creates an empty profiler, whose profile starts now.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		start:   time.Now(),
+		samples: make(map[string]*profSample),
+	}
+}
+
+// Profile records a profile of the code run by the Runner in a Profiler. A nil
+// profiler disables the profiling.
+func Profile(p *Profiler) RunnerOption {
+	return func(r *Runner) error {
+		r.profiler = p
+		return nil
+	}
+}
+
+// profStart starts profiling a statement or command, which must be followed by
+// a call to profEnd.
+func (r *Runner) profStart() {
+	r.profStack = append(r.profStack, &profEntry{start: time.Now()})
+}
+
+// profEnd finishes profiling the statement or command started by the last call
+// to profStart. The statement is at pos, and command is the name of the extra
+// frame for a command, if any.
+func (r *Runner) profEnd(pos syntax.Pos, command string) {
+	p := r.profiler
+	entry := r.profStack[len(r.profStack)-1]
+	r.profStack = r.profStack[:len(r.profStack)-1]
+	elapsed := time.Since(entry.start)
+
+	stack := r.callStack(pos)
+	if command != "" {
+		stack = append([]Frame{{Func: command}}, stack...)
+	}
+	var key strings.Builder
+	for _, frame := range stack {
+		key.WriteString(frame.Func)
+		key.WriteByte(0)
+		key.WriteString(frame.File)
+		key.WriteByte(0)
+		key.WriteString(strconv.FormatUint(uint64(frame.Pos.Line()), 10))
+		key.WriteByte(0)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	self := elapsed - entry.child
+	if self < 0 {
+		// Nested statements ran concurrently, such as in a pipeline.
+		self = 0
+	}
+	s := p.samples[key.String()]
+	if s == nil {
+		s = &profSample{stack: stack}
+		p.samples[key.String()] = s
+	}
+	s.calls++
+	s.wall += self
+	if len(r.profStack) > 0 {
+		// Shared with subshells, hence the lock.
+		r.profStack[len(r.profStack)-1].child += elapsed
+	}
+}
+
+// WritePprof writes the profile as a gzip-compressed protocol buffer in the
+// pprof format. Its sample types are "calls" and "wall", the latter being the
+// default one.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var b protobuf
+	strs := map[string]int{"": 0}
+	strTable := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(strTable)
+			strs[s] = i
+			strTable = append(strTable, s)
+		}
+		return uint64(i)
+	}
+	valueType := func(tag int, typ, unit string) {
+		var vt protobuf
+		vt.uint64(1, str(typ))
+		vt.uint64(2, str(unit))
+		b.message(tag, vt)
+	}
+	valueType(1, "calls", "count") // sample_type
+	valueType(1, "wall", "nanoseconds")
+
+	type funcKey struct{ name, file string }
+	type locKey struct {
+		fn   uint64
+		line uint
+	}
+	funcs := make(map[funcKey]uint64)
+	locs := make(map[locKey]uint64)
+	var funcMsgs, locMsgs []protobuf
+
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := p.samples[key]
+		locIDs := make([]uint64, len(s.stack))
+		for i, frame := range s.stack {
+			fk := funcKey{frame.Func, frame.File}
+			fnID, ok := funcs[fk]
+			if !ok {
+				fnID = uint64(len(funcs) + 1)
+				funcs[fk] = fnID
+				var fn protobuf
+				fn.uint64(1, fnID)            // id
+				fn.uint64(2, str(frame.Func)) // name
+				fn.uint64(3, str(frame.Func)) // system_name
+				fn.uint64(4, str(frame.File)) // filename
+				funcMsgs = append(funcMsgs, fn)
+			}
+			lk := locKey{fnID, frame.Pos.Line()}
+			locID, ok := locs[lk]
+			if !ok {
+				locID = uint64(len(locs) + 1)
+				locs[lk] = locID
+				var line protobuf
+				line.uint64(1, fnID)            // function_id
+				line.uint64(2, uint64(lk.line)) // line
+				var loc protobuf
+				loc.uint64(1, locID) // id
+				loc.message(4, line) // line
+				locMsgs = append(locMsgs, loc)
+			}
+			locIDs[i] = locID
+		}
+		var sample protobuf
+		sample.packed(1, locIDs)                                    // location_id
+		sample.packed(2, []uint64{uint64(s.calls), uint64(s.wall)}) // value
+		b.message(2, sample)
+	}
+	for _, loc := range locMsgs {
+		b.message(4, loc) // location
+	}
+	for _, fn := range funcMsgs {
+		b.message(5, fn) // function
+	}
+	b.uint64(9, uint64(p.start.UnixNano()))   // time_nanos
+	b.uint64(10, uint64(time.Since(p.start))) // duration_nanos
+	var period protobuf
+	period.uint64(1, str("wall"))
+	period.uint64(2, str("nanoseconds"))
+	b.message(11, period)     // period_type
+	b.uint64(12, 1)           // period
+	b.uint64(14, str("wall")) // default_sample_type
+	// The string table goes last, as the fields above add strings to it.
+	for _, s := range strTable {
+		b.bytes(6, []byte(s)) // string_table
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protobuf is a minimal protocol buffer encoder, enough to write pprof
+// profiles.
+type protobuf []byte
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *protobuf) key(tag, wireType int) {
+	b.varint(uint64(tag)<<3 | uint64(wireType))
+}
+
+// uint64 writes a varint field, omitting zero values like proto3.
+func (b *protobuf) uint64(tag int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(tag, 0)
+	b.varint(x)
+}
+
+// bytes writes a length-delimited field, which is never omitted.
+func (b *protobuf) bytes(tag int, p []byte) {
+	b.key(tag, 2)
+	b.varint(uint64(len(p)))
+	*b = append(*b, p...)
+}
+
+func (b *protobuf) message(tag int, msg protobuf) {
+	b.bytes(tag, msg)
+}
+
+// packed writes a packed repeated varint field.
+func (b *protobuf) packed(tag int, xs []uint64) {
+	var p protobuf
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(tag, p)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"errors"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Restricted enables restricted mode, like Bash's restricted shell started via
+// "bash -r". It can also be enabled from within the shell via "set -r", and
+// once enabled it can't be disabled from within the shell. The following are
+// not allowed in restricted mode:
+//
+//   - changing directories with cd, pushd, or popd
+//   - setting or unsetting PATH, SHELL, ENV, BASH_ENV, or HISTFILE, which
+//     become read-only
+//   - running commands whose names contain a slash
+//   - sourcing files whose names contain a slash
+//   - redirecting output to files, such as with ">", ">>", "<>", or "&>"
+//   - replacing the shell with the exec builtin
+//   - the enable builtin, if one was added via Builtins
+//   - disabling restricted mode with "set +r"
+//
+// Note that restricted mode does not limit what the programs run by the exec
+// handler may do; see AllowExecs for that.
+func Restricted(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		if enabled {
+			r.restrict()
+		} else {
+			r.opts[optRestricted] = false
+		}
+		return nil
+	}
+}
+
+// restrictedVars are the variables which become read-only in restricted mode.
+var restrictedVars = [...]string{"BASH_ENV", "ENV", "HISTFILE", "PATH", "SHELL"}
+
+var errRestricted = errors.New("restricted")
+
+// restrict enables restricted mode.
+func (r *Runner) restrict() {
+	r.opts[optRestricted] = true
+	if r.writeEnv == nil {
+		return // Reset will call us again
+	}
+	for _, name := range restrictedVars {
+		vr := r.writeEnv.Get(name)
+		if !vr.ReadOnly {
+			vr.ReadOnly = true
+			r.writeEnv.Set(name, vr)
+		}
+	}
+}
+
+// restrictedCommand reports whether running a command by name is not allowed
+// in restricted mode, in which case an error is printed.
+func (r *Runner) restrictedCommand(pos syntax.Pos, name string) bool {
+	if !r.opts[optRestricted] || !strings.Contains(name, "/") {
+		return false
+	}
+	r.errf("%v: %s: restricted: cannot specify `/' in command names\n", pos, name)
+	return true
+}
+
+// restrictedBuiltin reports whether running a builtin with the given arguments
+// is not allowed in restricted mode, in which case an error is printed.
+func (r *Runner) restrictedBuiltin(pos syntax.Pos, name string, args []string) bool {
+	if !r.opts[optRestricted] {
+		return false
+	}
+	switch name {
+	case "cd", "enable":
+	case "pushd", "popd":
+		if len(args) > 0 && args[0] == "-n" {
+			return false // the directory doesn't change
+		}
+	case "exec":
+		if len(args) == 0 {
+			return false // only redirections
+		}
+	case "source", ".":
+		if len(args) == 0 || !strings.Contains(args[0], "/") {
+			return false
+		}
+		r.errf("%v: %s: %s: restricted\n", pos, name, args[0])
+		return true
+	default:
+		return false
+	}
+	r.errf("%v: %s: restricted\n", pos, name)
+	return true
+}
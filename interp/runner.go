@@ -8,15 +8,15 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math"
-	"math/rand"
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/pattern"
@@ -27,6 +27,7 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 	r.ectx = ctx
 	r.ecfg = &expand.Config{
 		Env: expandEnv{r},
+		Now: r.now,
 		CmdSubst: func(w io.Writer, cs *syntax.CmdSubst) error {
 			switch len(cs.Stmts) {
 			case 0: // nothing to do
@@ -47,6 +48,11 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 			}
 			r2 := r.Subshell()
 			r2.stdout = w
+			r2.substLevel++
+			r2.subshellLevel++
+			if r.limits != nil {
+				r2.stdout = substWriter{w, r.limits}
+			}
 			r2.stmts(ctx, cs.Stmts)
 			return r2.err
 		},
@@ -58,11 +64,6 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 				return os.DevNull, nil
 			}
 
-			if r.rand == nil {
-				r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
-			}
-			dir := os.TempDir()
-
 			// We can't atomically create a random unused temporary FIFO.
 			// Similar to os.CreateTemp,
 			// keep trying new random paths until one does not exist.
@@ -70,7 +71,7 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 			var path string
 			try := 0
 			for {
-				path = fmt.Sprintf("%s/sh-interp-%x", dir, r.rand.Uint64())
+				path = fmt.Sprintf("%s%x", procSubstPrefix(), r.random().Uint64())
 				err := mkfifo(path, 0o666)
 				if err == nil {
 					break
@@ -144,14 +145,22 @@ func (r *Runner) updateExpandOpts() {
 	if r.opts[optNoGlob] {
 		r.ecfg.ReadDir = nil
 	} else {
-		r.ecfg.ReadDir = ioutil.ReadDir
+		r.ecfg.ReadDir = r.fs.ReadDir
 	}
+	r.ecfg.Stat = r.fs.Stat
 	r.ecfg.GlobStar = r.opts[optGlobStar]
 	r.ecfg.NullGlob = r.opts[optNullGlob]
 	r.ecfg.NoUnset = r.opts[optNoUnset]
+	if r.limits != nil {
+		r.ecfg.MaxSize = r.limits.MaxVarSize
+	}
 }
 
 func (r *Runner) expandErr(err error) {
+	if r.limitExpandErr(err) {
+		r.exitShell(context.TODO(), 1)
+		return
+	}
 	if err != nil {
 		r.errf("%v\n", err)
 		r.exitShell(context.TODO(), 1)
@@ -215,10 +224,25 @@ func (r *Runner) handlerCtx(ctx context.Context) context.Context {
 		Stdin:  r.stdin,
 		Stdout: r.stdout,
 		Stderr: r.stderr,
+
+		ExtraFiles: r.extraFiles(),
+
+		Umask:   r.umask,
+		Rlimits: r.rlimits,
+
+		FS: r.fs,
+
+		replaceProcess: r.replacingProcess,
 	}
 	return context.WithValue(ctx, handlerCtxKey{}, hc)
 }
 
+// procSubstPrefix returns the path prefix of the FIFOs created for process
+// substitutions, which are always in the real file system.
+func procSubstPrefix() string {
+	return os.TempDir() + "/sh-interp-"
+}
+
 func (r *Runner) setErr(err error) {
 	if r.err == nil {
 		r.err = err
@@ -252,42 +276,57 @@ func (r *Runner) stop(ctx context.Context) bool {
 }
 
 func (r *Runner) stmt(ctx context.Context, st *syntax.Stmt) {
+	if r.limits != nil && !r.limitStmt(st) {
+		return
+	}
 	if r.stop(ctx) {
 		return
 	}
+	if r.debugHandler != nil {
+		if r.debug(ctx, st); r.stop(ctx) {
+			return
+		}
+	}
+	r.cover(st, 0)
+	r.lineno = st.Pos().Line()
+	if r.profiler != nil {
+		r.profStart()
+		defer r.profEnd(st.Pos(), "")
+	}
 	r.exit = 0
 	if st.Background {
-		r2 := r.Subshell()
-		st2 := *st
-		st2.Background = false
-		r.bgShells.Go(func() error {
-			return r2.Run(ctx, &st2)
-		})
+		r.startJob(ctx, r.Subshell(), st)
+	} else if st.Coprocess {
+		r.coproc(ctx, "COPROC", st)
 	} else {
 		r.stmtSync(ctx, st)
 	}
 	r.lastExit = r.exit
+	if r.exit == 0 && !r.shellExited {
+		r.failure = nil
+	}
+	r.runPendingTraps(ctx)
+	if r.limits != nil {
+		r.checkLimits(st.Pos())
+	}
 }
 
 func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
 	defer r.wgProcSubsts.Wait()
-	oldIn, oldOut, oldErr := r.stdin, r.stdout, r.stderr
+	oldIn, oldOut, oldErr, oldFds, oldStdFds := r.stdin, r.stdout, r.stderr, r.fds, r.stdFds
+	r.traceStdout, r.traceStderr, r.traceFds = r.stdout, r.stderr, r.fds
 	for _, rd := range st.Redirs {
-		cls, err := r.redir(ctx, rd)
-		if err != nil {
+		if err := r.redir(ctx, rd); err != nil {
 			r.exit = 1
 			break
 		}
-		if cls != nil {
-			defer cls.Close()
-		}
 	}
 	if r.exit == 0 && st.Cmd != nil {
 		r.cmd(ctx, st.Cmd)
 	}
 	if st.Negated {
 		r.exit = oneIf(r.exit == 0)
-	} else if _, ok := st.Cmd.(*syntax.CallExpr); !ok {
+	} else if !errExitCmd(st.Cmd) {
 	} else if r.exit != 0 && !r.noErrExit && r.opts[optErrExit] {
 		// If the "errexit" option is set and a simple command failed,
 		// exit the shell. Exceptions:
@@ -297,10 +336,25 @@ func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
 		//   preceded by !
 		r.exitShell(ctx, r.exit)
 	} else if r.exit != 0 {
-		r.trapCallback(ctx, r.callbackErr, "error")
+		callback, _ := r.getTrap("ERR")
+		// Like with runTrap, the trap must not replace the failed status.
+		oldExit, oldLastExit := r.exit, r.lastExit
+		r.trapCallback(ctx, callback, "error")
+		if !r.shellExited {
+			r.exit, r.lastExit = oldExit, oldLastExit
+		}
 	}
-	if !r.keepRedirs {
+	switch {
+	case r.keepRedirs:
+		// "exec" without a command makes its redirections permanent.
+		r.keepRedirs = false
+		closeDroppedFds(oldFds, r.fds)
+		closeDroppedStdFds(oldStdFds, r.stdFds)
+	case len(st.Redirs) > 0:
 		r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+		closeDroppedFds(r.fds, oldFds)
+		closeDroppedStdFds(r.stdFds, oldStdFds)
+		r.fds, r.stdFds = oldFds, oldStdFds
 	}
 }
 
@@ -309,6 +363,16 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		return
 	}
 
+	switch cm.(type) {
+	case *syntax.CallExpr, *syntax.DeclClause, *syntax.LetClause,
+		*syntax.ArithmCmd, *syntax.TestClause:
+		// Like Bash, run the DEBUG trap before every simple command.
+		r.runTrap(ctx, "DEBUG")
+		if r.stop(ctx) {
+			return
+		}
+	}
+
 	tracingEnabled := r.opts[optXTrace]
 	trace := r.tracer()
 
@@ -316,10 +380,17 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 	case *syntax.Block:
 		r.stmts(ctx, x.Stmts)
 	case *syntax.Subshell:
+		start := r.now()
 		r2 := r.Subshell()
+		r2.subshellLevel++
 		r2.stmts(ctx, x.Stmts)
+		r2.closeFds()
 		r.exit = r2.exit
+		r.failure = r2.failure
 		r.setErr(r2.err)
+		if r.jsonTrace != nil {
+			r.traceEvent("subshell", x.Pos(), nil, start)
+		}
 	case *syntax.CallExpr:
 		// Use a new slice, to not modify the slice in the alias map.
 		var args []*syntax.Word
@@ -341,6 +412,9 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			for _, as := range x.Assigns {
 				vr := r.assignVal(as, "")
 				r.setVar(as.Name.Value, as.Index, vr)
+				if r.jsonTrace != nil {
+					r.traceEvent("assign", as.Pos(), []string{as.Name.Value + "=" + vr.String()}, time.Time{})
+				}
 
 				if !tracingEnabled {
 					continue
@@ -385,7 +459,32 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		trace.call(fields[0], fields[1:]...)
 		trace.newLineFlush()
 
+		start := r.now()
+		failure, exited := r.failure, r.shellExited
 		r.call(ctx, x.Args[0].Pos(), fields)
+		switch {
+		case r.exit == 0:
+			r.failure = nil
+		case r.shellExited && !exited && r.failure != failure:
+			// Keep the command which made the shell exit, such as
+			// with "set -e" within a function.
+		case r.shellExited && !exited && failure != nil && int(failure.Status) == r.exit:
+			// Like "cmd || exit"; keep the command which failed.
+		case r.shellExited && !exited:
+			// Like "exit 3", directly or within a function; the exit
+			// builtin is never the command which failed.
+			r.failure = nil
+		default:
+			r.failure = &ExitError{
+				Status: uint8(r.exit),
+				Args:   fields,
+				Pos:    x.Args[0].Pos(),
+				Stack:  r.callStack(x.Args[0].Pos()),
+			}
+		}
+		if r.jsonTrace != nil {
+			r.traceEvent("command", x.Pos(), fields, start)
+		}
 		for _, restore := range restores {
 			r.setVarInternal(restore.name, restore.vr)
 		}
@@ -397,7 +496,10 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			r.stmt(ctx, x.X)
 			r.noErrExit = oldNoErrExit
 			if (r.exit == 0) == (x.Op == syntax.AndStmt) {
+				r.cover(x, 0)
 				r.stmt(ctx, x.Y)
+			} else {
+				r.cover(x, 1)
 			}
 		case syntax.Pipe, syntax.PipeAll:
 			pr, pw, err := os.Pipe()
@@ -412,6 +514,7 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			} else {
 				r2.stderr = r.stderr
 			}
+			oldIn := r.stdin
 			r.stdin = pr
 			var wg sync.WaitGroup
 			wg.Add(1)
@@ -421,6 +524,7 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				wg.Done()
 			}()
 			r.stmt(ctx, x.Y)
+			r.stdin = oldIn
 			pr.Close()
 			wg.Wait()
 			if r.opts[optPipeFail] && r2.exit != 0 && r.exit == 0 {
@@ -435,9 +539,11 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		r.noErrExit = oldNoErrExit
 
 		if r.exit == 0 {
+			r.cover(x, 0)
 			r.stmts(ctx, x.Then)
 			break
 		}
+		r.cover(x, 1)
 		r.exit = 0
 		if x.Else != nil {
 			r.cmd(ctx, x.Else)
@@ -448,6 +554,9 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			r.noErrExit = true
 			r.stmts(ctx, x.Cond)
 			r.noErrExit = oldNoErrExit
+			if r.shellExited {
+				break // keep the exit status
+			}
 
 			stop := (r.exit == 0) == x.Until
 			r.exit = 0
@@ -466,6 +575,10 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				items = r.fields(y.Items...) // for i in ...; do ...
 			}
 
+			if x.Select {
+				r.selectLoop(ctx, name, items, x.Do)
+				break
+			}
 			for _, field := range items {
 				r.setVarString(name, field)
 				trace.stringf("for %s in", y.Name.Value)
@@ -487,7 +600,7 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				r.arithm(y.Init)
 			}
 			for y.Cond == nil || r.arithm(y.Cond) != 0 {
-				if r.exit != 0 || r.loopStmtsBroken(ctx, x.Do) {
+				if r.exit != 0 || r.stop(ctx) || r.loopStmtsBroken(ctx, x.Do) {
 					break
 				}
 				if y.Post != nil {
@@ -530,94 +643,26 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		trace.string(" in")
 		trace.newLineFlush()
 		str := r.literal(x.Word)
-		for _, ci := range x.Items {
+		for i, ci := range x.Items {
 			for _, word := range ci.Patterns {
 				pattern := r.pattern(word)
 				if match(pattern, str) {
+					r.cover(x, i)
 					r.stmts(ctx, ci.Stmts)
 					return
 				}
 			}
 		}
+		r.cover(x, len(x.Items))
 	case *syntax.TestClause:
 		if r.bashTest(ctx, x.X, false) == "" && r.exit == 0 {
 			// to preserve exit status code 2 for regex errors, etc
 			r.exit = 1
 		}
 	case *syntax.DeclClause:
-		local, global := false, false
-		var modes []string
-		valType := ""
-		switch x.Variant.Value {
-		case "declare":
-			// When used in a function, "declare" acts as "local"
-			// unless the "-g" option is used.
-			local = r.inFunc
-		case "local":
-			if !r.inFunc {
-				r.errf("local: can only be used in a function\n")
-				r.exit = 1
-				return
-			}
-			local = true
-		case "export":
-			modes = append(modes, "-x")
-		case "readonly":
-			modes = append(modes, "-r")
-		case "nameref":
-			valType = "-n"
-		}
-		for _, as := range x.Args {
-			for _, as := range r.flattenAssign(as) {
-				name := as.Name.Value
-				if strings.HasPrefix(name, "-") {
-					switch name {
-					case "-x", "-r":
-						modes = append(modes, name)
-					case "-a", "-A", "-n":
-						valType = name
-					case "-g":
-						global = true
-					default:
-						r.errf("declare: invalid option %q\n", name)
-						r.exit = 2
-						return
-					}
-					continue
-				}
-				if !syntax.ValidName(name) {
-					r.errf("declare: invalid name %q\n", name)
-					r.exit = 1
-					return
-				}
-				var vr expand.Variable
-				if !as.Naked {
-					vr = r.assignVal(as, valType)
-				}
-				if global {
-					vr.Local = false
-				} else if local {
-					vr.Local = true
-				}
-				for _, mode := range modes {
-					switch mode {
-					case "-x":
-						vr.Exported = true
-					case "-r":
-						vr.ReadOnly = true
-					}
-				}
-				if as.Naked {
-					if vr.Exported || vr.Local || vr.ReadOnly {
-						r.setVarInternal(name, vr)
-					}
-				} else {
-					r.setVar(name, as.Index, vr)
-				}
-			}
-		}
+		r.declClause(x)
 	case *syntax.TimeClause:
-		start := time.Now()
+		start := r.now()
 		if x.Stmt != nil {
 			r.stmt(ctx, x.Stmt)
 		}
@@ -627,11 +672,17 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		} else {
 			r.outf("\n")
 		}
-		real := time.Since(start)
+		real := r.now().Sub(start)
 		r.outf(format, "real", elapsedString(real, x.PosixFormat))
 		// TODO: can we do these?
 		r.outf(format, "user", elapsedString(0, x.PosixFormat))
 		r.outf(format, "sys", elapsedString(0, x.PosixFormat))
+	case *syntax.CoprocClause:
+		name := "COPROC"
+		if x.Name != nil {
+			name = r.literal(x.Name)
+		}
+		r.coproc(ctx, name, x.Stmt)
 	default:
 		panic(fmt.Sprintf("unhandled command node: %T", x))
 	}
@@ -646,25 +697,40 @@ func (r *Runner) trapCallback(ctx context.Context, callback, name string) {
 	}
 	r.handlingTrap = true
 
+	defer func() { r.handlingTrap = false }()
+
 	p := syntax.NewParser()
 	// TODO: do this parsing when "trap" is called?
 	file, err := p.Parse(strings.NewReader(callback), name+" trap")
 	if err != nil {
-		r.errf(name+"trap: %v\n", err)
+		r.errf(name+" trap: %v\n", err)
 		// ignore errors in the callback
 		return
 	}
-	r.stmts(ctx, file.Stmts)
-
-	r.handlingTrap = false
+	r.stmtsNotCovered(ctx, file.Stmts)
 }
 
 // setExit call this function to exit the shell with status
+// errExitCmd reports whether a failure of cmd triggers "set -e" and the ERR
+// trap, which is the case for simple commands and subshells.
+func errExitCmd(cmd syntax.Command) bool {
+	switch cmd.(type) {
+	case *syntax.CallExpr, *syntax.Subshell:
+		return true
+	}
+	return false
+}
+
 func (r *Runner) exitShell(ctx context.Context, status int) {
+	// The traps must not replace the command which failed.
+	failure := r.failure
+	defer func() { r.failure = failure }()
 	if status != 0 {
-		r.trapCallback(ctx, r.callbackErr, "error")
+		callback, _ := r.getTrap("ERR")
+		r.trapCallback(ctx, callback, "error")
 	}
-	r.trapCallback(ctx, r.callbackExit, "exit")
+	callback, _ := r.getTrap("EXIT")
+	r.trapCallback(ctx, callback, "exit")
 
 	r.shellExited = true
 	// Restore the original exit status. We ignore the callbacks.
@@ -719,6 +785,15 @@ func (r *Runner) stmts(ctx context.Context, stmts []*syntax.Stmt) {
 	}
 }
 
+// stmtsNotCovered is like stmts, for code which isn't part of a file, such as
+// with eval, and so isn't recorded by Coverage.
+func (r *Runner) stmtsNotCovered(ctx context.Context, stmts []*syntax.Stmt) {
+	oldCoverFile := r.coverFile
+	r.coverFile = nil
+	r.stmts(ctx, stmts)
+	r.coverFile = oldCoverFile
+}
+
 func (r *Runner) hdocReader(rd *syntax.Redirect) io.Reader {
 	if rd.Op != syntax.DashHdoc {
 		hdoc := r.document(rd.Hdoc)
@@ -752,36 +827,76 @@ func (r *Runner) hdocReader(rd *syntax.Redirect) io.Reader {
 	return &buf
 }
 
-func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, error) {
-	if rd.Hdoc != nil {
-		r.stdin = r.hdocReader(rd)
-		return nil, nil
+// redir applies a redirection. If a file is opened for standard input, output,
+// or error, it is returned so that it can be closed once the redirection ends.
+// Files opened for other file descriptors are owned by the table of file
+// descriptors instead.
+func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) error {
+	arg := ""
+	if rd.Hdoc == nil {
+		arg = r.literal(rd.Word)
+	}
+	// The file descriptor being redirected, -1 if it's a new one to be
+	// stored in varName as in "{varname}>file".
+	fd := 1
+	varName := ""
+	switch rd.Op {
+	case syntax.RdrIn, syntax.RdrInOut, syntax.DplIn, syntax.Hdoc,
+		syntax.DashHdoc, syntax.WordHdoc:
+		fd = 0
 	}
-	orig := &r.stdout
 	if rd.N != nil {
-		switch rd.N.Value {
-		case "1":
-		case "2":
-			orig = &r.stderr
+		if s := rd.N.Value; strings.HasPrefix(s, "{") {
+			varName = s[1 : len(s)-1]
+			fd = -1
+		} else {
+			fd = atoi(s)
 		}
 	}
-	arg := r.literal(rd.Word)
+	if varName != "" && (rd.Op == syntax.DplIn || rd.Op == syntax.DplOut) && arg == "-" {
+		// "{varname}>&-" closes the file descriptor in $varname.
+		n, err := strconv.Atoi(r.envGet(varName))
+		if err != nil {
+			r.errf("%s: ambiguous redirect\n", varName)
+			return errBadFd
+		}
+		fd = n
+	}
+	if fd == -1 {
+		fd = r.freeFd()
+		r.setVarString(varName, strconv.Itoa(fd))
+	}
+
 	switch rd.Op {
+	case syntax.Hdoc, syntax.DashHdoc:
+		r.setFd(fd, &fdEntry{reader: r.hdocReader(rd)})
+		return nil
 	case syntax.WordHdoc:
-		r.stdin = strings.NewReader(arg + "\n")
-		return nil, nil
-	case syntax.DplOut:
-		switch arg {
-		case "1":
-			*orig = r.stdout
-		case "2":
-			*orig = r.stderr
-		}
-		return nil, nil
-	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut,
-		syntax.RdrAll, syntax.AppAll:
+		r.setFd(fd, &fdEntry{reader: strings.NewReader(arg + "\n")})
+		return nil
+	case syntax.DplIn, syntax.DplOut:
+		if arg == "-" {
+			r.unsetFd(fd)
+			return nil
+		}
+		if _, err := strconv.Atoi(arg); err != nil {
+			if rd.Op == syntax.DplOut && rd.N == nil {
+				// ">&word" is the same as "&>word".
+				break
+			}
+			r.errf("%s: ambiguous redirect\n", arg)
+			return errBadFd
+		}
+		e := r.lookupFd(arg)
+		if e == nil {
+			r.errf("%s: bad file descriptor\n", arg)
+			return errBadFd
+		}
+		r.setFd(fd, e.dup())
+		return nil
+	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut, syntax.ClbOut,
+		syntax.RdrInOut, syntax.RdrAll, syntax.AppAll:
 		// done further below
-	// case syntax.DplIn:
 	default:
 		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
 	}
@@ -789,25 +904,38 @@ func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, err
 	switch rd.Op {
 	case syntax.AppOut, syntax.AppAll:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	case syntax.RdrOut, syntax.RdrAll:
+	case syntax.RdrOut, syntax.ClbOut, syntax.RdrAll, syntax.DplOut:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case syntax.RdrInOut:
+		mode = os.O_RDWR | os.O_CREATE
+	}
+	if mode != os.O_RDONLY && r.opts[optRestricted] {
+		r.errf("%v: %s: restricted: cannot redirect output\n", rd.Pos(), arg)
+		return errRestricted
 	}
 	f, err := r.open(ctx, arg, mode, 0o644, true)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if mode != os.O_RDONLY {
+		r.wroteFile(arg)
+	}
+	e := newFdEntry(f)
 	switch rd.Op {
 	case syntax.RdrIn:
-		r.stdin = f
-	case syntax.RdrOut, syntax.AppOut:
-		*orig = f
-	case syntax.RdrAll, syntax.AppAll:
-		r.stdout = f
-		r.stderr = f
+		e.writer = nil
+	case syntax.RdrInOut:
 	default:
-		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
+		e.reader = nil
 	}
-	return f, nil
+	switch {
+	case rd.Op == syntax.RdrAll, rd.Op == syntax.AppAll, rd.Op == syntax.DplOut:
+		r.setFd(1, e)
+		r.setFd(2, e.dup())
+	default:
+		r.setFd(fd, e)
+	}
+	return nil
 }
 
 func (r *Runner) loopStmtsBroken(ctx context.Context, stmts []*syntax.Stmt) bool {
@@ -828,6 +956,105 @@ func (r *Runner) loopStmtsBroken(ctx context.Context, stmts []*syntax.Stmt) bool
 	return false
 }
 
+// selectLoop runs a select loop, which repeatedly prompts the user to choose
+// one of the items from a numbered menu, running stmts each time.
+func (r *Runner) selectLoop(ctx context.Context, name string, items []string, stmts []*syntax.Stmt) {
+	if len(items) == 0 {
+		return
+	}
+	prompt := "#? "
+	if vr := r.lookupVar("PS3"); vr.IsSet() {
+		prompt = vr.String()
+	}
+	printMenu := true
+	for !r.stop(ctx) {
+		if printMenu {
+			r.printSelectMenu(items)
+			printMenu = false
+		}
+		r.errf("%s", prompt)
+		line, err := r.readLine(ctx, r.stdin, readOpts{delim: '\n'})
+		if err != nil {
+			// Like Bash, end the line and the loop on EOF.
+			r.out("\n")
+			r.exit = 1
+			return
+		}
+		reply := string(line)
+		r.setVarString("REPLY", reply)
+		if reply == "" {
+			printMenu = true
+			continue
+		}
+		choice := ""
+		if n, err := strconv.Atoi(strings.TrimSpace(reply)); err == nil && n >= 1 && n <= len(items) {
+			choice = items[n-1]
+		}
+		r.setVarString(name, choice)
+		if r.loopStmtsBroken(ctx, stmts) {
+			break
+		}
+	}
+}
+
+// printSelectMenu prints the menu for a select loop to standard error, laying
+// out the items in columns which fit in $COLUMNS like Bash does.
+func (r *Runner) printSelectMenu(items []string) {
+	columns, _ := strconv.Atoi(r.envGet("COLUMNS"))
+	if columns <= 0 {
+		columns = 80
+	}
+	numLen := len(strconv.Itoa(len(items)))
+	maxLen := 0
+	for _, item := range items {
+		if n := utf8.RuneCountInString(item); n > maxLen {
+			maxLen = n
+		}
+	}
+	maxLen += numLen + len(") ") + 2
+
+	cols := columns / maxLen
+	if cols == 0 {
+		cols = 1
+	}
+	rows := (len(items) + cols - 1) / cols
+	cols = (len(items) + rows - 1) / rows
+	if rows == 1 {
+		rows, cols = cols, 1
+	}
+	firstNumLen := len(strconv.Itoa(rows))
+
+	var sb strings.Builder
+	for row := 0; row < rows; row++ {
+		pos := 0
+		for i := row; ; i += rows {
+			n := numLen
+			if pos == 0 {
+				n = firstNumLen
+			}
+			fmt.Fprintf(&sb, "%*d) %s", n, i+1, items[i])
+			if i+rows >= len(items) {
+				break
+			}
+			// Pad up to the next column with tabs and spaces.
+			from := pos + n + len(") ") + utf8.RuneCountInString(items[i])
+			to := pos + maxLen
+			for from < to {
+				if to/8 > from/8 {
+					sb.WriteByte('\t')
+					from += 8 - from%8
+				} else {
+					sb.WriteByte(' ')
+					from++
+				}
+			}
+			pos += maxLen
+		}
+		sb.WriteByte('\n')
+	}
+	r.errf("%s", sb.String())
+}
+
 type returnStatus uint8
 
 func (s returnStatus) Error() string { return fmt.Sprintf("return status %d", s) }
@@ -837,7 +1064,24 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		return
 	}
 	name := args[0]
+	if r.restrictedCommand(pos, name) {
+		r.exit = 1
+		return
+	}
 	if body := r.Funcs[name]; body != nil {
+		if r.limits != nil && r.limits.MaxFuncDepth > 0 && r.funcDepth >= r.limits.MaxFuncDepth {
+			r.limits.exceed("MaxFuncDepth", r.limits.MaxFuncDepth)
+			r.checkLimits(pos)
+			return
+		}
+		start := r.now()
+		if r.jsonTrace != nil {
+			r.traceEvent("enter", pos, args, time.Time{})
+		}
+		r.funcDepth++
+		r.pushFrame(pos, name, r.funcFiles[name])
+		oldCoverFile := r.coverFile
+		r.coverFile = r.funcCover[name]
 		// stack them to support nested func calls
 		oldParams := r.Params
 		r.Params = args[1:]
@@ -848,20 +1092,38 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		// Note that Runner.exec below does something similar.
 		origEnv := r.writeEnv
 		r.writeEnv = &overlayEnviron{parent: r.writeEnv, funcScope: true}
+		hiddenTraps := r.hideTraps(r.tracedFuncs[name])
 
 		r.stmt(ctx, body)
 
+		if code, ok := r.err.(returnStatus); ok {
+			r.err = nil
+			r.exit = int(code)
+		}
+		r.runTrap(ctx, "RETURN")
+
+		r.restoreTraps(hiddenTraps)
 		r.writeEnv = origEnv
 
 		r.Params = oldParams
 		r.inFunc = oldInFunc
-		if code, ok := r.err.(returnStatus); ok {
-			r.err = nil
-			r.exit = int(code)
+		r.funcDepth--
+		r.popFrame()
+		r.coverFile = oldCoverFile
+		if r.jsonTrace != nil {
+			r.traceEvent("return", pos, args, start)
 		}
 		return
 	}
-	if isBuiltin(name) {
+	if r.profiler != nil {
+		r.profStart()
+		if r.isBuiltin(name) {
+			defer r.profEnd(pos, "builtin "+name)
+		} else {
+			defer r.profEnd(pos, "exec "+name)
+		}
+	}
+	if r.isBuiltin(name) {
 		r.exit = r.builtinCode(ctx, pos, name, args[1:])
 		return
 	}
@@ -898,5 +1160,5 @@ func (r *Runner) open(ctx context.Context, path string, flags int, mode os.FileM
 }
 
 func (r *Runner) stat(name string) (os.FileInfo, error) {
-	return os.Stat(r.absPath(name))
+	return r.fs.Stat(r.absPath(name))
 }
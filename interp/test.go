@@ -7,7 +7,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"regexp"
 
 	"golang.org/x/term"
@@ -74,14 +73,14 @@ func (r *Runner) binTest(op syntax.BinTestOperator, x, y string) bool {
 		if err1 != nil || err2 != nil {
 			return false
 		}
-		return info1.ModTime().After(info2.ModTime())
+		return r.modTime(x, info1).After(r.modTime(y, info2))
 	case syntax.TsOlder:
 		info1, err1 := r.stat(x)
 		info2, err2 := r.stat(y)
 		if err1 != nil || err2 != nil {
 			return false
 		}
-		return info1.ModTime().Before(info2.ModTime())
+		return r.modTime(x, info1).Before(r.modTime(y, info2))
 	case syntax.TsDevIno:
 		info1, err1 := r.stat(x)
 		info2, err2 := r.stat(y)
@@ -138,7 +137,7 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 	case syntax.TsSocket:
 		return r.statMode(x, os.ModeSocket)
 	case syntax.TsSmbLink:
-		info, err := os.Lstat(r.absPath(x))
+		info, err := r.fs.Lstat(r.absPath(x))
 		return err == nil && info.Mode()&os.ModeSymlink != 0
 	case syntax.TsSticky:
 		return r.statMode(x, os.ModeSticky)
@@ -162,7 +161,7 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 		}
 		return err == nil
 	case syntax.TsExec:
-		_, err := exec.LookPath(r.absPath(x))
+		_, err := findExecutable(r.fs, r.Dir, x, pathExts(r.writeEnv))
 		return err == nil
 	case syntax.TsNoEmpty:
 		info, err := r.stat(x)
@@ -2,10 +2,16 @@ package interp
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
 )
 
@@ -14,7 +20,8 @@ import (
 type tracer struct {
 	buf       bytes.Buffer
 	printer   *syntax.Printer
-	stdout    io.Writer
+	output    io.Writer
+	prefix    string
 	needsPlus bool
 }
 
@@ -25,20 +32,62 @@ func (r *Runner) tracer() *tracer {
 
 	return &tracer{
 		printer:   syntax.NewPrinter(),
-		stdout:    r.stdout,
+		output:    r.traceOutput(),
+		prefix:    r.tracePrefix(),
 		needsPlus: true,
 	}
 }
 
+// traceOutput returns where to write the trace, which is standard error unless
+// BASH_XTRACEFD is set to another open file descriptor. Like in Bash, the
+// redirections of the statement being traced don't apply.
+func (r *Runner) traceOutput() io.Writer {
+	stdout, stderr, fds := r.traceStdout, r.traceStderr, r.traceFds
+	if stderr == nil { // not inside a statement
+		stdout, stderr, fds = r.stdout, r.stderr, r.fds
+	}
+	n, err := strconv.Atoi(r.lookupVar("BASH_XTRACEFD").String())
+	switch {
+	case err != nil || n == 2:
+	case n == 1:
+		return stdout
+	case fds[n] != nil && fds[n].writer != nil:
+		return fds[n].writer
+	}
+	return stderr
+}
+
+// tracePrefix returns the expanded value of PS4, whose first character is
+// repeated to show the nesting level of command substitutions.
+func (r *Runner) tracePrefix() string {
+	prefix := r.lookupVar("PS4").String()
+	if strings.ContainsAny(prefix, "$`\\") {
+		// Don't trace the expansion itself, such as any command
+		// substitutions.
+		r.opts[optXTrace] = false
+		if word, err := syntax.NewParser().Document(strings.NewReader(prefix)); err == nil {
+			if s, err := expand.Document(r.ecfg, word); err == nil {
+				prefix = s
+			}
+		}
+		r.opts[optXTrace] = true
+	}
+	if r.substLevel > 0 && prefix != "" {
+		_, size := utf8.DecodeRuneInString(prefix)
+		prefix = strings.Repeat(prefix[:size], r.substLevel) + prefix
+	}
+	return prefix
+}
+
 // string writes s to tracer.buf if tracer is non-nil,
-// prepending "+" if tracer.needsPlus is true.
+// prepending the prefix if tracer.needsPlus is true.
 func (t *tracer) string(s string) {
 	if t == nil {
 		return
 	}
 
 	if t.needsPlus {
-		t.buf.WriteString("+ ")
+		t.buf.WriteString(t.prefix)
 	}
 	t.needsPlus = false
 	t.buf.WriteString(s)
@@ -53,14 +102,14 @@ func (t *tracer) stringf(f string, a ...interface{}) {
 }
 
 // expr prints x to tracer.buf if tracer is non-nil,
-// prepending "+" if tracer.isFirstPrint is true.
+// prepending the prefix if tracer.needsPlus is true.
 func (t *tracer) expr(x syntax.Node) {
 	if t == nil {
 		return
 	}
 
 	if t.needsPlus {
-		t.buf.WriteString("+ ")
+		t.buf.WriteString(t.prefix)
 	}
 	t.needsPlus = false
 	if err := t.printer.Print(&t.buf, x); err != nil {
@@ -68,13 +117,13 @@ func (t *tracer) expr(x syntax.Node) {
 	}
 }
 
-// flush writes the contents of tracer.buf to the tracer.stdout.
+// flush writes the contents of tracer.buf to the tracer.output.
 func (t *tracer) flush() {
 	if t == nil {
 		return
 	}
 
-	t.stdout.Write(t.buf.Bytes())
+	t.output.Write(t.buf.Bytes())
 	t.buf.Reset()
 }
 
@@ -117,3 +166,78 @@ func (t *tracer) call(cmd string, args ...string) {
 		t.stringf("%s %s", cmd, s)
 	}
 }
+
+// TraceEvent is an event in a structured execution trace; see JSONTrace.
+type TraceEvent struct {
+	// Kind is one of "command" for a simple command, "assign" for an
+	// assignment without a command, "enter" and "return" for a function
+	// call, and "subshell" for a subshell like "(cmd)".
+	Kind string `json:"kind"`
+
+	// File, Line, and Col are the position of the node in the source. File
+	// may be empty, such as when Run was not given a *syntax.File.
+	File string `json:"file,omitempty"`
+	Line uint   `json:"line"`
+	Col  uint   `json:"col"`
+
+	// Args are the expanded arguments of a command or function call,
+	// including its name, or a single "name=value" for an assignment.
+	Args []string `json:"args,omitempty"`
+
+	// Duration is how long a command, function call, or subshell took.
+	// It is zero for "assign" and "enter" events.
+	Duration time.Duration `json:"duration_ns"`
+
+	// Exit is the exit status. It is zero for "enter" events.
+	Exit int `json:"exit"`
+
+	// Depth is the nesting level of function calls, sourced files, and
+	// subshells, starting at zero.
+	Depth int `json:"depth"`
+}
+
+// JSONTrace writes a structured execution trace to w, with one TraceEvent per
+// line encoded as JSON. Unlike the trace written by "set -x", it is written
+// for every command, and it includes the duration and exit status of each
+// command. A nil writer disables the trace.
+func JSONTrace(w io.Writer) RunnerOption {
+	return func(r *Runner) error {
+		if w == nil {
+			r.jsonTrace = nil
+			return nil
+		}
+		r.jsonTrace = &jsonTracer{enc: json.NewEncoder(w)}
+		return nil
+	}
+}
+
+// jsonTracer writes TraceEvents, and it is shared by subshells.
+type jsonTracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// traceEvent writes an event about the node at pos to the JSON trace, if any.
+// start is when the node started running, if the event has a duration.
+func (r *Runner) traceEvent(kind string, pos syntax.Pos, args []string, start time.Time) {
+	ev := TraceEvent{
+		Kind:  kind,
+		File:  r.frameFile,
+		Line:  pos.Line(),
+		Col:   pos.Col(),
+		Args:  args,
+		Depth: len(r.callers) + r.subshellLevel,
+	}
+	if code, ok := r.err.(returnStatus); ok {
+		ev.Exit = int(code) // the return builtin was just run
+	} else if kind != "enter" {
+		ev.Exit = r.exit
+	}
+	if !start.IsZero() {
+		ev.Duration = r.now().Sub(start)
+	}
+	t := r.jsonTrace
+	t.mu.Lock()
+	t.enc.Encode(ev)
+	t.mu.Unlock()
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"strings"
+	"syscall"
+)
+
+// getTrap returns the callback set via the trap builtin for a signal name like
+// "TERM" or a pseudo-signal like "EXIT". An empty callback means that the
+// signal is ignored, and ok is false if there is no trap at all.
+func (r *Runner) getTrap(name string) (callback string, ok bool) {
+	r.sigMu.Lock()
+	callback, ok = r.traps[name]
+	r.sigMu.Unlock()
+	return callback, ok
+}
+
+func (r *Runner) setTrap(name, callback string) {
+	r.sigMu.Lock()
+	if r.traps == nil {
+		r.traps = make(map[string]string)
+	}
+	r.traps[name] = callback
+	r.sigMu.Unlock()
+}
+
+func (r *Runner) resetTrap(name string) {
+	r.sigMu.Lock()
+	delete(r.traps, name)
+	r.sigMu.Unlock()
+}
+
+// parseTrapSpec parses a signal spec as accepted by the trap builtin, such as
+// "INT", "SIGINT", "2", or "EXIT", returning the name used to store the trap.
+func parseTrapSpec(spec string) (string, bool) {
+	switch upper := strings.ToUpper(spec); upper {
+	case "EXIT", "0":
+		return "EXIT", true
+	case "DEBUG", "ERR", "RETURN":
+		return upper, true
+	}
+	sig, ok := parseSignal(spec)
+	if !ok {
+		return "", false
+	}
+	return signalName(sig), true
+}
+
+// trapNames returns the names of all the signals and pseudo-signals which may
+// have a trap, in the order that "trap -p" uses.
+func trapNames() []string {
+	names := []string{"EXIT"}
+	for sig := syscall.Signal(1); sig <= maxSignal; sig++ {
+		if name := signalName(sig); name != "" {
+			names = append(names, name)
+		}
+	}
+	return append(names, "DEBUG", "ERR", "RETURN")
+}
+
+// trapDisplayName returns the name for a trap as printed by "trap -p".
+func trapDisplayName(name string) string {
+	switch name {
+	case "EXIT", "DEBUG", "ERR", "RETURN":
+		return name
+	}
+	return "SIG" + name
+}
+
+// quoteTrap quotes a trap callback like "trap -p" does in Bash, which always
+// uses single quotes.
+func quoteTrap(callback string) string {
+	return "'" + strings.ReplaceAll(callback, "'", `'\''`) + "'"
+}
+
+// sigTerminates reports whether a signal terminates a shell by default.
+func sigTerminates(sig syscall.Signal) bool {
+	switch signalName(sig) {
+	case "CHLD", "CONT", "URG", "WINCH":
+		return false // ignored by default
+	case "STOP", "TSTP", "TTIN", "TTOU":
+		return false // we don't have job control, so we can't stop
+	}
+	return true
+}
+
+// watchSignals starts receiving signals from r.signals in the background,
+// until the returned function is called.
+//
+// Signals with a trap are queued to be handled between statements; see
+// runPendingTraps. Ignored signals are dropped. Any other signal which
+// terminates the shell by default calls cancel, so that any blocking operation
+// such as a running program is interrupted.
+func (r *Runner) watchSignals(cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case s := <-r.signals:
+				sig, ok := s.(syscall.Signal)
+				if !ok {
+					continue
+				}
+				r.sigMu.Lock()
+				callback, trapped := r.traps[signalName(sig)]
+				switch {
+				case signalName(sig) == "KILL", !trapped && sigTerminates(sig):
+					if r.fatalSig == 0 {
+						r.fatalSig = sig
+					}
+					cancel()
+				case !trapped, callback == "":
+					// ignored
+				default:
+					r.pendingSigs = append(r.pendingSigs, sig)
+					select {
+					case r.sigInterrupt <- struct{}{}:
+					default:
+					}
+				}
+				r.sigMu.Unlock()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// signalSelf handles a signal sent by the shell to itself via kill, when it
+// doesn't have a real process ID. Like with watchSignals, a trapped signal is
+// queued, and one which terminates the shell by default makes it exit.
+func (r *Runner) signalSelf(ctx context.Context, sig syscall.Signal) {
+	if sig == 0 {
+		return // just checking that the process exists
+	}
+	callback, trapped := r.getTrap(signalName(sig))
+	switch {
+	case signalName(sig) == "KILL", !trapped && sigTerminates(sig):
+		// Like a fatal signal in Run, only run the exit trap.
+		callback, _ := r.getTrap("EXIT")
+		r.trapCallback(ctx, callback, "exit")
+		r.shellExited = true
+		r.exit = 128 + int(sig)
+		r.exitSig = sig
+	case !trapped, callback == "":
+		// ignored
+	default:
+		r.sigMu.Lock()
+		r.pendingSigs = append(r.pendingSigs, sig)
+		r.sigMu.Unlock()
+	}
+}
+
+// pendingSignal returns the first signal waiting to be handled, or zero.
+func (r *Runner) pendingSignal() syscall.Signal {
+	r.sigMu.Lock()
+	defer r.sigMu.Unlock()
+	if len(r.pendingSigs) == 0 {
+		return 0
+	}
+	return r.pendingSigs[0]
+}
+
+// waitInterrupted returns the exit status for the wait builtin when it stops
+// early, either due to a trapped signal or a cancelled context.
+func (r *Runner) waitInterrupted() int {
+	if sig := r.pendingSignal(); sig != 0 {
+		return 128 + int(sig)
+	}
+	return 1 // cancelled
+}
+
+// runPendingTraps runs the trap callbacks for any signals received since the
+// last call. The exit status is preserved, unless a callback exits the shell.
+func (r *Runner) runPendingTraps(ctx context.Context) {
+	if r.handlingTrap {
+		return
+	}
+	r.sigMu.Lock()
+	sigs := r.pendingSigs
+	r.pendingSigs = nil
+	r.sigMu.Unlock()
+	for _, sig := range sigs {
+		r.runTrap(ctx, signalName(sig))
+		if r.shellExited {
+			return
+		}
+	}
+}
+
+// runTrap runs the callback for a trap like "DEBUG" or "TERM", if there is one.
+// The exit status is preserved, unless the callback exits the shell.
+func (r *Runner) runTrap(ctx context.Context, name string) {
+	callback, _ := r.getTrap(name)
+	if callback == "" {
+		return
+	}
+	oldExit, oldLastExit := r.exit, r.lastExit
+	r.trapCallback(ctx, callback, strings.ToLower(name))
+	if r.shellExited {
+		return
+	}
+	r.exit, r.lastExit = oldExit, oldLastExit
+}
+
+// hideTraps removes the traps which a function doesn't inherit, which are
+// DEBUG and RETURN unless functrace is set or the function has the trace
+// attribute, and ERR unless errtrace is set.
+// The removed traps are returned, to be put back via restoreTraps.
+func (r *Runner) hideTraps(traced bool) map[string]string {
+	r.sigMu.Lock()
+	defer r.sigMu.Unlock()
+	var hidden map[string]string
+	for name, callback := range r.traps {
+		switch name {
+		case "ERR":
+			if r.opts[optErrTrace] {
+				continue
+			}
+		case "DEBUG", "RETURN":
+			if r.opts[optFuncTrace] || traced {
+				continue
+			}
+		default:
+			continue
+		}
+		if hidden == nil {
+			hidden = make(map[string]string)
+		}
+		hidden[name] = callback
+		delete(r.traps, name)
+	}
+	return hidden
+}
+
+// restoreTraps puts back the traps removed by hideTraps. Like in Bash, traps
+// set by the function itself are kept instead.
+func (r *Runner) restoreTraps(hidden map[string]string) {
+	r.sigMu.Lock()
+	defer r.sigMu.Unlock()
+	for name, callback := range hidden {
+		if _, ok := r.traps[name]; !ok {
+			r.traps[name] = callback
+		}
+	}
+}
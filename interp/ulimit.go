@@ -0,0 +1,159 @@
+// Copyright (c) 2022, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"strconv"
+)
+
+// Rlimit is a soft and hard limit for a resource, like with setrlimit(2).
+type Rlimit struct {
+	Cur uint64 // the soft limit
+	Max uint64 // the hard limit
+}
+
+// RlimInfinity is the value of an Rlimit field for an unlimited resource.
+const RlimInfinity = ^uint64(0)
+
+// ulimitResource is a resource supported by the ulimit builtin.
+type ulimitResource struct {
+	flag     byte
+	desc     string
+	unit     string // if any, like "kbytes"
+	factor   uint64 // the size of the unit, in the resource's own units
+	resource int
+}
+
+// ulimitResources is sorted by flag, like "ulimit -a" prints them in Bash.
+var ulimitResources = [...]ulimitResource{
+	{'c', "core file size", "blocks", 512, rlimitCore},
+	{'d', "data seg size", "kbytes", 1024, rlimitData},
+	{'f', "file size", "blocks", 512, rlimitFsize},
+	{'n', "open files", "", 1, rlimitNofile},
+	{'s', "stack size", "kbytes", 1024, rlimitStack},
+	{'t', "cpu time", "seconds", 1, rlimitCPU},
+	{'v', "virtual memory", "kbytes", 1024, rlimitAS},
+}
+
+// rlimit returns the limit for a resource, which is either set via the ulimit
+// builtin or inherited from the current process.
+func (r *Runner) rlimit(resource int) Rlimit {
+	if lim, ok := r.rlimits[resource]; ok {
+		return lim
+	}
+	return getRlimit(resource)
+}
+
+func (r *Runner) setRlimit(resource int, lim Rlimit) {
+	// Copy the map, as subshells and handlers may share it.
+	rlimits := make(map[int]Rlimit, len(r.rlimits)+1)
+	for res, lim := range r.rlimits {
+		rlimits[res] = lim
+	}
+	rlimits[resource] = lim
+	r.rlimits = rlimits
+}
+
+func (r *Runner) ulimit(args []string) int {
+	var soft, hard, all bool
+	var resources []ulimitResource
+	fp := flagParser{remaining: args}
+flags:
+	for fp.more() {
+		flag := fp.flag()
+		switch flag {
+		case "-S":
+			soft = true
+			continue
+		case "-H":
+			hard = true
+			continue
+		case "-a":
+			all = true
+			continue
+		}
+		for _, res := range ulimitResources {
+			if flag == "-"+string(res.flag) {
+				resources = append(resources, res)
+				continue flags
+			}
+		}
+		r.errf("ulimit: invalid option %q\n", flag)
+		return 2
+	}
+	args = fp.args()
+	if all {
+		resources = ulimitResources[:]
+		args = nil
+	}
+	if len(resources) == 0 {
+		resources = append(resources, ulimitResources[2]) // -f
+	}
+	if !soft && !hard && len(args) == 0 {
+		soft = true // print the soft limits by default
+	}
+	if len(args) > 1 {
+		r.errf("ulimit: too many arguments\n")
+		return 2
+	}
+
+	if len(args) == 0 {
+		for _, res := range resources {
+			lim := r.rlimit(res.resource)
+			val := lim.Cur
+			if hard && !soft {
+				val = lim.Max
+			}
+			str := "unlimited"
+			if val != RlimInfinity {
+				str = strconv.FormatUint(val/res.factor, 10)
+			}
+			if len(resources) == 1 {
+				r.outf("%s\n", str)
+				continue
+			}
+			unit := "(-" + string(res.flag) + ")"
+			if res.unit != "" {
+				unit = "(" + res.unit + ", -" + string(res.flag) + ")"
+			}
+			r.outf("%-20s %19s %s\n", res.desc, unit, str)
+		}
+		return 0
+	}
+
+	var n uint64
+	if args[0] != "unlimited" {
+		var err error
+		if n, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+			r.errf("ulimit: %s: invalid number\n", args[0])
+			return 1
+		}
+	}
+	for _, res := range resources {
+		val := RlimInfinity
+		if args[0] != "unlimited" {
+			val = n * res.factor
+		}
+		lim := r.rlimit(res.resource)
+		newLim := lim
+		if soft || !hard {
+			newLim.Cur = val
+		}
+		if hard || !soft {
+			newLim.Max = val
+		}
+		// Like setrlimit(2) for an unprivileged process, we can't have
+		// a soft limit above the hard limit, nor raise the hard limit.
+		if newLim.Cur > newLim.Max {
+			r.errf("ulimit: %s: cannot modify limit: invalid argument\n", res.desc)
+			return 1
+		}
+		if newLim.Max > lim.Max {
+			r.errf("ulimit: %s: cannot modify limit: operation not permitted\n", res.desc)
+			return 1
+		}
+		r.setRlimit(res.resource, newLim)
+	}
+	return 0
+}
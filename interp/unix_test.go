@@ -12,10 +12,13 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/creack/pty"
+	"golang.org/x/term"
 )
 
 func TestRunnerTerminalStdIO(t *testing.T) {
@@ -155,3 +158,135 @@ func TestRunnerTerminalExec(t *testing.T) {
 func shortPathName(path string) (string, error) {
 	panic("only works on windows")
 }
+
+func TestRunnerUmaskRlimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("umask and resource limits are only passed to programs on Linux")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is required")
+	}
+	t.Parallel()
+
+	// The limits are set right after the program starts, so give them a
+	// moment to apply.
+	file := parse(t, nil, `umask 027; ulimit -Sn 30; sh -c 'sleep 0.2; umask; ulimit -n'; umask; ulimit -n`)
+	var cb concBuffer
+	r, _ := New(StdIO(nil, &cb, &cb))
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	if want := "0027\n30\n0027\n30\n"; cb.String() != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, cb.String())
+	}
+	// The current process must not be affected.
+	if got := readUmask(); got != processUmask() {
+		t.Fatalf("process umask changed from %04o to %04o", processUmask(), got)
+	}
+	if lim := getRlimit(rlimitNofile); lim.Cur == 30 {
+		t.Fatalf("process limit on open files was changed")
+	}
+}
+
+func TestRunnerRealExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is required")
+	}
+	t.Parallel()
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Getenv("GOSH_PROG"), `
+		echo $$
+		trap 'echo exit trap' EXIT
+		exec 3>out
+		FOO=bar exec sh -c 'echo $$ $FOO; echo to fd 3 >&3'
+		echo unreachable
+	`)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOSH_CMD=real_exec")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	// The program must keep the PID, and the shell must not run anything
+	// else, such as its EXIT trap.
+	lines := strings.Split(string(out), "\n")
+	if len(lines) != 3 || lines[1] != lines[0]+" bar" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "to fd 3\n"; string(got) != want {
+		t.Fatalf("wrong output in fd 3:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestRunnerRealExecHandlers(t *testing.T) {
+	t.Parallel()
+
+	// The exec handlers must still apply, even though standard output
+	// and error are files which a new program could inherit. If they did
+	// not, "false" would replace the test process and make it fail.
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	file := parse(t, nil, "exec false")
+	r, _ := New(StdIO(nil, f, f), RealExec(true), ExecHandlers(AllowExecs("true")))
+	err = r.Run(context.Background(), file)
+	if status, ok := IsExitStatus(err); !ok || status != 126 {
+		t.Fatalf("want exit status 126, got: %v", err)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "false: command not allowed\n"; string(got) != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestRunnerReadEdit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, input, want string
+	}{
+		{`read -e x; read y; echo "[$x] [$y]"`, "foo\rbar\n", "[foo] [bar]\n"},
+		{`read -e -t 0.01 x; echo $?`, "", "142\n"},
+		{`read -e -n 2 x; echo "[$x]"`, "foo\n", "[fo]\n"},
+		{`read -e -d , x; echo "[$x]"`, "foo,bar\n", "[foo]\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			primary, secondary, err := pty.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer primary.Close()
+			defer secondary.Close()
+			// Pass the input as is, such as "\r" to end a line
+			// being edited.
+			if _, err := term.MakeRaw(int(secondary.Fd())); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(primary, test.input); err != nil {
+				t.Fatal(err)
+			}
+			file := parse(t, nil, test.in)
+			// Line editing echoes the input to standard error.
+			var cb concBuffer
+			r, _ := New(StdIO(secondary, &cb, io.Discard))
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Fatal(err)
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+}
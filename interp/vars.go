@@ -4,11 +4,17 @@
 package interp
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"math/rand"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -39,6 +45,7 @@ func (o *overlayEnviron) Set(name string, vr expand.Variable) error {
 			prev := o.Get(name)
 			prev.Exported = prev.Exported || vr.Exported
 			prev.ReadOnly = prev.ReadOnly || vr.ReadOnly
+			mergeAttrs(&prev, vr)
 			vr = prev
 		}
 		return o.parent.(expand.WriteEnviron).Set(name, vr)
@@ -48,11 +55,12 @@ func (o *overlayEnviron) Set(name string, vr expand.Variable) error {
 	if o.values == nil {
 		o.values = make(map[string]expand.Variable)
 	}
-	if !vr.IsSet() && (vr.Exported || vr.Local || vr.ReadOnly) {
-		// marking as exported/local/readonly
+	if !vr.IsSet() && (vr.Exported || vr.Local || vr.ReadOnly || hasAttrs(vr)) {
+		// marking as exported/local/readonly, or with other attributes
 		prev.Exported = prev.Exported || vr.Exported
 		prev.Local = prev.Local || vr.Local
 		prev.ReadOnly = prev.ReadOnly || vr.ReadOnly
+		mergeAttrs(&prev, vr)
 		vr = prev
 		o.values[name] = vr
 		return nil
@@ -90,6 +98,21 @@ func (o *overlayEnviron) Each(f func(name string, vr expand.Variable) bool) {
 	}
 }
 
+// hasAttrs reports whether a variable has any of the attributes which change
+// how values are assigned to it, such as via "declare -i".
+func hasAttrs(vr expand.Variable) bool {
+	return vr.Integer || vr.LowerCase || vr.UpperCase
+}
+
+// mergeAttrs adds the attributes of src to dst, like hasAttrs. Since a
+// variable can't be lower and upper case at once, those from src win.
+func mergeAttrs(dst *expand.Variable, src expand.Variable) {
+	dst.Integer = dst.Integer || src.Integer
+	if src.LowerCase || src.UpperCase {
+		dst.LowerCase, dst.UpperCase = src.LowerCase, src.UpperCase
+	}
+}
+
 func execEnv(env expand.Environ) []string {
 	list := make([]string, 0, 64)
 	env.Each(func(name string, vr expand.Variable) bool {
@@ -132,9 +155,42 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 	case "?":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.lastExit)
 	case "$":
-		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getpid())
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.mainPid())
+	case "!":
+		if r.lastBgPid != "" {
+			vr.Kind, vr.Str = expand.String, r.lastBgPid
+		}
 	case "PPID":
-		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getppid())
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.parentPid())
+	case "BASHPID":
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.bashPid())
+	case "RANDOM":
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.random().Intn(1<<15))
+	case "SRANDOM":
+		var n uint32
+		if r.randSource != nil {
+			n = r.random().Uint32()
+		} else {
+			var b [4]byte
+			crand.Read(b[:])
+			n = binary.LittleEndian.Uint32(b[:])
+		}
+		vr.Kind, vr.Str = expand.String, strconv.FormatUint(uint64(n), 10)
+	case "SECONDS":
+		secs := int64(r.now().Sub(r.startTime) / time.Second)
+		vr.Kind, vr.Str = expand.String, strconv.FormatInt(secs, 10)
+	case "EPOCHSECONDS":
+		vr.Kind, vr.Str = expand.String, strconv.FormatInt(r.now().Unix(), 10)
+	case "EPOCHREALTIME":
+		now := r.now()
+		vr.Kind, vr.Str = expand.String, fmt.Sprintf("%d.%06d", now.Unix(), now.Nanosecond()/1000)
+	case "FUNCNAME", "BASH_SOURCE", "BASH_LINENO":
+		// Even when unset, these can't be assigned to.
+		return r.callStackVar(name)
+	case "LINENO":
+		if r.lineno > 0 {
+			vr.Kind, vr.Str = expand.String, strconv.FormatUint(uint64(r.lineno), 10)
+		}
 	case "DIRSTACK":
 		vr.Kind, vr.List = expand.Indexed, r.dirStack
 	case "0":
@@ -154,9 +210,16 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 		}
 	}
 	if vr.IsSet() {
+		switch name {
+		case "RANDOM", "SECONDS", "SRANDOM", "EPOCHSECONDS", "EPOCHREALTIME", "BASHPID":
+			// Attributes like with "readonly SECONDS" still apply.
+			stored := r.writeEnv.Get(name)
+			vr.Exported, vr.ReadOnly, vr.Local = stored.Exported, stored.ReadOnly, stored.Local
+			mergeAttrs(&vr, stored)
+		}
 		return vr
 	}
-	if vr := r.writeEnv.Get(name); vr.IsSet() {
+	if vr = r.writeEnv.Get(name); vr.IsSet() {
 		return vr
 	}
 	if runtime.GOOS == "windows" {
@@ -165,7 +228,28 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 			return vr
 		}
 	}
-	return expand.Variable{}
+	// An unset variable may still have attributes, like after "declare -i".
+	return vr
+}
+
+// setDynamicVar handles assignments to the variables whose values are computed
+// by lookupVar, like Bash. It reports whether name is one of them.
+func (r *Runner) setDynamicVar(name string, vr expand.Variable) bool {
+	switch name {
+	case "RANDOM":
+		// Seeds the generator, to repeat the same sequence.
+		seed, _ := strconv.ParseInt(vr.String(), 10, 64)
+		r.rand = rand.New(rand.NewSource(seed))
+	case "SECONDS":
+		// Counts the seconds since the assignment, starting at the value.
+		secs, _ := strconv.ParseInt(vr.String(), 10, 64)
+		r.startTime = r.now().Add(-time.Duration(secs) * time.Second)
+	case "SRANDOM", "EPOCHSECONDS", "EPOCHREALTIME", "BASHPID":
+		// Assignments are ignored.
+	default:
+		return false
+	}
+	return true
 }
 
 func (r *Runner) envGet(name string) string {
@@ -184,15 +268,40 @@ func (r *Runner) setVarString(name, value string) {
 	r.setVar(name, nil, expand.Variable{Kind: expand.String, Str: value})
 }
 
-func (r *Runner) setVarInternal(name string, vr expand.Variable) {
+// setVarInternal sets a variable, replacing its previous value. If the
+// variable can't be set, such as when it's readonly, the error is reported and
+// also returned.
+func (r *Runner) setVarInternal(name string, vr expand.Variable) error {
+	if vr.IsSet() && !r.writeEnv.Get(name).ReadOnly && r.setDynamicVar(name, vr) &&
+		!vr.Exported && !vr.ReadOnly && !vr.Local && !hasAttrs(vr) {
+		// A plain assignment only changes the computed value; otherwise,
+		// the attributes are kept too.
+		return nil
+	}
 	if r.opts[optAllExport] {
 		vr.Exported = true
 	}
+	if vr.IsSet() {
+		if !hasAttrs(vr) {
+			// A new value keeps the attributes of the variable.
+			mergeAttrs(&vr, r.lookupVar(name))
+		}
+		var ok bool
+		if vr, ok = r.applyAttrs(vr); !ok {
+			r.exit = 1
+			return fmt.Errorf("%s: invalid value", name)
+		}
+		if r.limits != nil && !r.limitVar(vr) {
+			r.exit = 1
+			return fmt.Errorf("%s: value too large", name)
+		}
+	}
 	if err := r.writeEnv.Set(name, vr); err != nil {
 		r.errf("%s: %v\n", name, err)
 		r.exit = 1
-		return
+		return fmt.Errorf("%s: %w", name, err)
 	}
+	return nil
 }
 
 func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable) {
@@ -253,11 +362,56 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable
 	r.setVarInternal(name, cur)
 }
 
+// parseVarRef parses a variable name given to a builtin, such as "printf -v",
+// with an optional array index like "name[index]". The index of an
+// associative array is used as is, and any other is an arithmetic expression.
+func (r *Runner) parseVarRef(s string) (name string, index syntax.ArithmExpr, ok bool) {
+	i := strings.IndexByte(s, '[')
+	if i < 0 {
+		return s, nil, syntax.ValidName(s)
+	}
+	name, key := s[:i], s[i+1:]
+	if !syntax.ValidName(name) || !strings.HasSuffix(key, "]") {
+		return "", nil, false
+	}
+	key = key[:len(key)-1]
+	if key == "" {
+		return "", nil, false
+	}
+	cur := r.lookupVar(name)
+	if _, var2 := cur.Resolve(r.writeEnv); var2.Kind == expand.Associative {
+		return name, &syntax.Word{Parts: []syntax.WordPart{
+			&syntax.SglQuoted{Value: key},
+		}}, true
+	}
+	index, err := syntax.NewParser().Arithmetic(strings.NewReader(key))
+	if err != nil {
+		return "", nil, false
+	}
+	return name, index, true
+}
+
 func (r *Runner) setFunc(name string, body *syntax.Stmt) {
 	if r.Funcs == nil {
 		r.Funcs = make(map[string]*syntax.Stmt, 4)
 	}
 	r.Funcs[name] = body
+	if r.frameFile != "" {
+		if r.funcFiles == nil {
+			r.funcFiles = make(map[string]string, 4)
+		}
+		r.funcFiles[name] = r.frameFile
+	} else {
+		delete(r.funcFiles, name)
+	}
+	if r.coverFile != nil {
+		if r.funcCover == nil {
+			r.funcCover = make(map[string]*fileCoverage, 4)
+		}
+		r.funcCover[name] = r.coverFile
+	} else {
+		delete(r.funcCover, name)
+	}
 }
 
 func stringIndex(index syntax.ArithmExpr) bool {
@@ -288,6 +442,16 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 		}
 		switch prev.Kind {
 		case expand.String:
+			if prev.Integer {
+				// "+=" adds to the value of an integer variable.
+				n, err := r.evalInteger(s)
+				if err != nil {
+					r.errf("%s: %v\n", s, err)
+					r.exit = 1
+				}
+				prev.Str = strconv.Itoa(atoi(prev.Str) + n)
+				break
+			}
 			prev.Str += s
 		case expand.Indexed:
 			if len(prev.List) == 0 {
@@ -379,3 +543,398 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 	}
 	return prev
 }
+
+// applyAttrs converts a variable's value as required by its attributes, such
+// as evaluating it arithmetically for "declare -i". If the conversion fails,
+// an error is printed and ok is false.
+func (r *Runner) applyAttrs(vr expand.Variable) (_ expand.Variable, ok bool) {
+	if !hasAttrs(vr) || vr.Kind == expand.NameRef {
+		return vr, true
+	}
+	conv := func(s string) (string, bool) {
+		if vr.Integer {
+			n, err := r.evalInteger(s)
+			if err != nil {
+				r.errf("%s: %v\n", s, err)
+				return "", false
+			}
+			s = strconv.Itoa(n)
+		}
+		switch {
+		case vr.LowerCase:
+			s = strings.ToLower(s)
+		case vr.UpperCase:
+			s = strings.ToUpper(s)
+		}
+		return s, true
+	}
+	switch vr.Kind {
+	case expand.String:
+		if vr.Str, ok = conv(vr.Str); !ok {
+			return vr, false
+		}
+	case expand.Indexed:
+		list := make([]string, len(vr.List))
+		for i, s := range vr.List {
+			if list[i], ok = conv(s); !ok {
+				return vr, false
+			}
+		}
+		vr.List = list
+	case expand.Associative:
+		m := make(map[string]string, len(vr.Map))
+		for k, s := range vr.Map {
+			if m[k], ok = conv(s); !ok {
+				return vr, false
+			}
+		}
+		vr.Map = m
+	}
+	return vr, true
+}
+
+// evalInteger evaluates a string as an arithmetic expression, for variables
+// with the integer attribute. An empty string evaluates to zero.
+func (r *Runner) evalInteger(s string) (int, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	expr, err := syntax.NewParser().Arithmetic(strings.NewReader(s))
+	if err != nil {
+		return 0, err
+	}
+	// The parser stops after the first expression, like in "foo bar".
+	if rest := strings.Fields(s[expr.End().Offset():]); len(rest) > 0 {
+		return 0, fmt.Errorf("syntax error in expression (error token is %q)", rest[0])
+	}
+	return expand.Arithm(r.ecfg, expr)
+}
+
+// declClause runs a declaration clause, such as "declare -i foo=bar" or
+// "export foo".
+func (r *Runner) declClause(x *syntax.DeclClause) {
+	local, global := false, false
+	var modes []string
+	valType := ""
+	// attrs and removed are the attributes set via flags like "-i", and
+	// removed via flags like "+i".
+	var attrs, removed expand.Variable
+	printVars, funcs, funcNames, trace := false, false, false, false
+	switch x.Variant.Value {
+	case "declare", "typeset":
+		// When used in a function, "declare" acts as "local"
+		// unless the "-g" option is used.
+		local = r.inFunc
+	case "local":
+		if !r.inFunc {
+			r.errf("local: can only be used in a function\n")
+			r.exit = 1
+			return
+		}
+		local = true
+	case "export":
+		modes = append(modes, "-x")
+	case "readonly":
+		modes = append(modes, "-r")
+	case "nameref":
+		valType = "-n"
+	}
+	var asgns []*syntax.Assign
+	for _, as := range x.Args {
+		for _, as := range r.flattenAssign(as) {
+			name := as.Name.Value
+			if name == "--" {
+				continue
+			}
+			if len(name) < 2 || (name[0] != '-' && name[0] != '+') {
+				asgns = append(asgns, as)
+				continue
+			}
+			set := name[0] == '-'
+			// Flags like "-ix" may be combined.
+			for _, flag := range name[1:] {
+				vr := &attrs
+				if !set {
+					vr = &removed
+				}
+				switch flag {
+				case 'x', 'r':
+					if set {
+						modes = append(modes, "-"+string(flag))
+					} else if flag == 'x' {
+						removed.Exported = true
+					} else {
+						removed.ReadOnly = true
+					}
+				case 'a', 'A', 'n':
+					valType = "-" + string(flag)
+				case 'g':
+					global = true
+				case 'i':
+					vr.Integer = true
+				case 'l':
+					vr.LowerCase, vr.UpperCase = true, false
+				case 'u':
+					vr.UpperCase, vr.LowerCase = true, false
+				case 'p':
+					printVars = true
+				case 'f':
+					funcs = true
+				case 'F':
+					funcs, funcNames = true, true
+				case 't':
+					trace = true
+				default:
+					r.errf("declare: invalid option %q\n", name)
+					r.exit = 2
+					return
+				}
+			}
+		}
+	}
+	switch {
+	case funcs:
+		r.declFuncs(asgns, funcNames, trace)
+		return
+	case printVars:
+		r.declPrint(asgns)
+		return
+	}
+	for _, as := range asgns {
+		name := as.Name.Value
+		if !syntax.ValidName(name) {
+			r.errf("declare: invalid name %q\n", name)
+			r.exit = 1
+			return
+		}
+		if removed.ReadOnly && r.lookupVar(name).ReadOnly {
+			// Like in Bash, readonly variables can't be made writable.
+			r.errf("%s: %s: readonly variable\n", x.Variant.Value, name)
+			r.exit = 1
+			continue
+		}
+		var vr expand.Variable
+		if !as.Naked {
+			vr = r.assignVal(as, valType)
+		}
+		if global {
+			vr.Local = false
+		} else if local {
+			vr.Local = true
+		}
+		for _, mode := range modes {
+			switch mode {
+			case "-x":
+				vr.Exported = true
+			case "-r":
+				vr.ReadOnly = true
+			}
+		}
+		mergeAttrs(&vr, attrs)
+		if hasAttrs(removed) || removed.Exported {
+			// Attributes can only be removed by replacing the variable.
+			cur := r.lookupVar(name)
+			if as.Naked {
+				vr.Kind, vr.Str, vr.List, vr.Map = cur.Kind, cur.Str, cur.List, cur.Map
+			}
+			vr.Integer = (vr.Integer || cur.Integer) && !removed.Integer
+			vr.LowerCase = (vr.LowerCase || cur.LowerCase) && !removed.LowerCase
+			vr.UpperCase = (vr.UpperCase || cur.UpperCase) && !removed.UpperCase
+			vr.Exported = (vr.Exported || cur.Exported) && !removed.Exported
+			vr.ReadOnly = vr.ReadOnly || cur.ReadOnly
+			vr.Local = vr.Local || cur.Local
+			if removed.Exported && cur.Exported && !cur.ReadOnly {
+				// Exported variables stay exported when set,
+				// so unset the variable first.
+				r.writeEnv.Set(name, expand.Variable{})
+			}
+			if vr, ok := r.applyAttrs(vr); ok {
+				if err := r.writeEnv.Set(name, vr); err != nil {
+					r.errf("%s: %v\n", name, err)
+					r.exit = 1
+				}
+			}
+			continue
+		}
+		if as.Naked {
+			// Like in Bash, adding attributes to a variable doesn't
+			// change its current value.
+			if vr.Exported || vr.Local || vr.ReadOnly || hasAttrs(vr) {
+				r.setVarInternal(name, vr)
+			}
+		} else {
+			r.setVar(name, as.Index, vr)
+		}
+	}
+}
+
+// declPrint prints variables as "declare" commands which can be run to
+// restore them, like "declare -p". With no assignments, all variables are
+// printed.
+func (r *Runner) declPrint(asgns []*syntax.Assign) {
+	if len(asgns) == 0 {
+		vars := make(map[string]expand.Variable)
+		r.writeEnv.Each(func(name string, vr expand.Variable) bool {
+			vars[name] = vr
+			return true
+		})
+		names := make([]string, 0, len(vars))
+		for name, vr := range vars {
+			if vr.IsSet() || vr.Local || hasAttrs(vr) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r.outf("%s\n", declString(name, vars[name]))
+		}
+		return
+	}
+	for _, as := range asgns {
+		name := as.Name.Value
+		if !syntax.ValidName(name) {
+			r.errf("declare: %s: not found\n", name)
+			r.exit = 1
+			continue
+		}
+		vr := r.lookupVar(name)
+		if !vr.IsSet() && !vr.Exported && !vr.ReadOnly && !hasAttrs(vr) {
+			r.errf("declare: %s: not found\n", name)
+			r.exit = 1
+			continue
+		}
+		r.outf("%s\n", declString(name, vr))
+	}
+}
+
+// declString returns a "declare" command which restores a variable.
+func declString(name string, vr expand.Variable) string {
+	var flags []byte
+	switch vr.Kind {
+	case expand.Indexed:
+		flags = append(flags, 'a')
+	case expand.Associative:
+		flags = append(flags, 'A')
+	}
+	if vr.Integer {
+		flags = append(flags, 'i')
+	}
+	if vr.Kind == expand.NameRef {
+		flags = append(flags, 'n')
+	}
+	if vr.ReadOnly {
+		flags = append(flags, 'r')
+	}
+	if vr.Exported {
+		flags = append(flags, 'x')
+	}
+	if vr.LowerCase {
+		flags = append(flags, 'l')
+	}
+	if vr.UpperCase {
+		flags = append(flags, 'u')
+	}
+	var b strings.Builder
+	b.WriteString("declare -")
+	if len(flags) == 0 {
+		b.WriteByte('-')
+	}
+	b.Write(flags)
+	b.WriteByte(' ')
+	b.WriteString(name)
+	switch vr.Kind {
+	case expand.String, expand.NameRef:
+		b.WriteByte('=')
+		b.WriteString(declQuote(vr.Str))
+	case expand.Indexed:
+		b.WriteString("=(")
+		for i, s := range vr.List {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(&b, "[%d]=%s", i, declQuote(s))
+		}
+		b.WriteByte(')')
+	case expand.Associative:
+		keys := make([]string, 0, len(vr.Map))
+		for k := range vr.Map {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("=(")
+		for _, k := range keys {
+			qk, err := syntax.Quote(k, syntax.LangBash)
+			if err != nil {
+				qk = declQuote(k)
+			}
+			fmt.Fprintf(&b, "[%s]=%s ", qk, declQuote(vr.Map[k]))
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// declQuote quotes a value for declString. Like Bash, double quotes are used
+// unless the value has non-printable characters such as newlines.
+func declQuote(s string) string {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			if q, err := syntax.Quote(s, syntax.LangBash); err == nil {
+				return q
+			}
+			break
+		}
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '`', '$':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// declFuncs prints functions for "declare -f", or just their names for
+// "declare -F". With trace, the functions get the trace attribute instead,
+// so that they inherit the DEBUG and RETURN traps.
+func (r *Runner) declFuncs(asgns []*syntax.Assign, onlyNames, trace bool) {
+	var names []string
+	if len(asgns) == 0 {
+		for name := range r.Funcs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, as := range asgns {
+		names = append(names, as.Name.Value)
+	}
+	for _, name := range names {
+		body := r.Funcs[name]
+		if body == nil {
+			r.exit = 1
+			continue
+		}
+		switch {
+		case trace:
+			if r.tracedFuncs == nil {
+				r.tracedFuncs = make(map[string]bool)
+			}
+			r.tracedFuncs[name] = true
+		case onlyNames && len(asgns) > 0:
+			r.outf("%s\n", name)
+		case onlyNames:
+			r.outf("declare -f %s\n", name)
+		default:
+			var buf bytes.Buffer
+			syntax.NewPrinter().Print(&buf, &syntax.FuncDecl{
+				Name: &syntax.Lit{Value: name},
+				Body: body,
+			})
+			r.outf("%s\n", &buf)
+		}
+	}
+}